@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -15,6 +16,8 @@ import (
 	peer "github.com/SotaUeda/usbgp"
 	"github.com/SotaUeda/usbgp/config"
 	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/message/capability"
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
 	"github.com/SotaUeda/usbgp/internal/rib"
 )
 
@@ -49,8 +52,14 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// SIGHUPで全Peerの対向機器にRoute Refreshを要求する
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	peers := []*peer.Peer{}
+
 	for _, c := range cfgs {
 		p := peer.New(c, lr)
+		peers = append(peers, p)
 		p.Start()
 		go func() {
 			for {
@@ -62,6 +71,14 @@ func main() {
 			}
 		}()
 	}
+	go func() {
+		for range hupChan {
+			log.Println("Received a hangup, requesting route refresh...")
+			for _, p := range peers {
+				p.RouteRefresh()
+			}
+		}
+	}()
 	<-ctx.Done()
 	wg.Wait()
 	log.Println("usbgp is done.")
@@ -105,13 +122,235 @@ func parseConfig(s string) (*config.Config, error) {
 		return config.New(lAS, lIP.String(), rAS, rIP.String(), mode, nil)
 	}
 
+	// 6番目以降は広告するネットワーク、または"key=value"形式のオプション
 	nws := []*net.IPNet{}
-	for _, nw := range cStrs[5:] {
-		_, nw, err := net.ParseCIDR(nw)
+	opts := []config.Option{}
+	for _, cs := range cStrs[5:] {
+		if k, v, ok := strings.Cut(cs, "="); ok {
+			opt, err := parseOption(k, v, lAS)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %v as option and config is %v: %v", cs, s, err)
+			}
+			opts = append(opts, opt)
+			continue
+		}
+		_, nw, err := net.ParseCIDR(cs)
 		if err != nil {
-			return nil, fmt.Errorf("cannot parse %v as network and config is %v", nw, s)
+			return nil, fmt.Errorf("cannot parse %v as network and config is %v", cs, s)
 		}
 		nws = append(nws, nw)
 	}
-	return config.New(lAS, lIP.String(), rAS, rIP.String(), mode, nws)
+	return config.New(lAS, lIP.String(), rAS, rIP.String(), mode, nws, opts...)
+}
+
+// las は4-octet AS Number Capabilityの値として使用する
+func parseOption(k, v string, las bgp.ASNumber) (config.Option, error) {
+	switch k {
+	case "holdtime":
+		sec, err := parseSec(v)
+		if err != nil {
+			return nil, err
+		}
+		return config.WithHoldTime(sec), nil
+	case "connectretry":
+		sec, err := parseSec(v)
+		if err != nil {
+			return nil, err
+		}
+		return config.WithConnectRetryTime(sec), nil
+	case "delayopen":
+		sec, err := parseSec(v)
+		if err != nil {
+			return nil, err
+		}
+		return config.WithDelayOpenTime(sec), nil
+	case "idlehold":
+		sec, err := parseSec(v)
+		if err != nil {
+			return nil, err
+		}
+		return config.WithIdleHoldTime(sec), nil
+	case "router-id":
+		return config.WithRouterID(v), nil
+	case "next-hop":
+		return config.WithNextHop(v), nil
+	case "local-pref":
+		v, err := parseUint32(v)
+		if err != nil {
+			return nil, err
+		}
+		return config.WithLocalPref(v), nil
+	case "med":
+		v, err := parseUint32(v)
+		if err != nil {
+			return nil, err
+		}
+		return config.WithMED(v), nil
+	case "aggregate":
+		return parseAggregate(v)
+	case "communities":
+		return parseCommunities(v)
+	case "bilateral-peer":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bool: %s", v)
+		}
+		return config.WithBilateralPeer(b), nil
+	case "password":
+		return config.WithPassword(v), nil
+	case "max-prefix":
+		return parseMaxPrefix(v)
+	case "capabilities":
+		// 何も広告しない場合は"capabilities="とする
+		caps := []capability.Capability{}
+		for _, name := range splitList(v) {
+			c, err := parseCapability(name, las)
+			if err != nil {
+				return nil, err
+			}
+			caps = append(caps, c)
+		}
+		return config.WithCapabilities(caps...), nil
+	case "require":
+		codes := []capability.Code{}
+		for _, name := range splitList(v) {
+			c, err := parseCapability(name, las)
+			if err != nil {
+				return nil, err
+			}
+			codes = append(codes, c.Code())
+		}
+		return config.WithRequiredCapabilities(codes...), nil
+	default:
+		return nil, fmt.Errorf("unknown option: %s", k)
+	}
+}
+
+// 秒数を表す文字列をパースする
+func parseSec(s string) (uint16, error) {
+	sec, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid seconds: %s", s)
+	}
+	return uint16(sec), nil
+}
+
+// LOCAL_PREF, MEDの値を表す文字列をパースする
+func parseUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value: %s", s)
+	}
+	return uint32(v), nil
+}
+
+// 集約ルートの設定をパースする
+// "Prefix[,summary-only][,as-set]"の形式で指定する。
+func parseAggregate(s string) (config.Option, error) {
+	fs := splitList(s)
+	if len(fs) == 0 {
+		return nil, fmt.Errorf("aggregate prefix is required")
+	}
+	_, nw, err := net.ParseCIDR(fs[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid aggregate prefix: %s", fs[0])
+	}
+	var summaryOnly, asSet bool
+	for _, f := range fs[1:] {
+		switch f {
+		case "summary-only":
+			summaryOnly = true
+		case "as-set":
+			asSet = true
+		default:
+			return nil, fmt.Errorf("unknown aggregate option: %s", f)
+		}
+	}
+	return config.WithAggregate(nw, summaryOnly, asSet), nil
+}
+
+// 対向機器から受信するPrefix数の上限をパースする
+// "Limit[,threshold=Percent][,warning-only][,restart=Minutes]"の形式で指定する。
+func parseMaxPrefix(s string) (config.Option, error) {
+	fs := splitList(s)
+	if len(fs) == 0 {
+		return nil, fmt.Errorf("max prefix limit is required")
+	}
+	limit, err := parseUint32(fs[0])
+	if err != nil {
+		return nil, err
+	}
+	mp := config.MaxPrefix{Limit: limit}
+	for _, f := range fs[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "threshold":
+			t, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max prefix threshold: %s", v)
+			}
+			mp.Threshold = uint8(t)
+		case "warning-only":
+			mp.WarningOnly = true
+		case "restart":
+			r, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max prefix restart time: %s", v)
+			}
+			mp.RestartTime = uint16(r)
+		default:
+			return nil, fmt.Errorf("unknown max prefix option: %s", f)
+		}
+	}
+	return config.WithMaxPrefix(mp), nil
+}
+
+// 広告するネットワークに付加するCOMMUNITIESをパースする
+// "Prefix,Community[,Community...]"の形式で指定し、Communityは"ASN:value"またはWell-known Communityの名前とする。
+func parseCommunities(s string) (config.Option, error) {
+	fs := splitList(s)
+	if len(fs) < 2 {
+		return nil, fmt.Errorf("network and communities are required: %s", s)
+	}
+	_, nw, err := net.ParseCIDR(fs[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid network: %s", fs[0])
+	}
+	cs := make([]pathattribute.Community, 0, len(fs)-1)
+	for _, f := range fs[1:] {
+		c, err := pathattribute.ParseCommunity(f)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return config.WithCommunities(nw, cs...), nil
+}
+
+// カンマ区切りの文字列を分割する
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// Capabilityの名前をパースする
+func parseCapability(s string, las bgp.ASNumber) (capability.Capability, error) {
+	switch s {
+	case "ipv4-unicast":
+		return capability.NewMultiprotocol(bgp.IPv4Unicast), nil
+	case "ipv6-unicast":
+		return capability.NewMultiprotocol(bgp.IPv6Unicast), nil
+	case "four-octet-as":
+		return capability.NewFourOctetAS(las), nil
+	case "route-refresh":
+		return capability.RouteRefreshCap{}, nil
+	case "enhanced-route-refresh":
+		return capability.EnhancedRouteRefreshCap{}, nil
+	case "extended-message":
+		return capability.ExtendedMessageCap{}, nil
+	default:
+		return nil, fmt.Errorf("unknown capability: %s", s)
+	}
 }
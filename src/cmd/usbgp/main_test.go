@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"net"
+	"slices"
 	"testing"
 
 	"github.com/SotaUeda/usbgp/config"
+	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/message/capability"
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
 )
 
 func TestPaseConfig(t *testing.T) {
@@ -16,6 +21,36 @@ func TestPaseConfig(t *testing.T) {
 	psvConf, _ := config.New(64513, "198.51.100.20", 65412, "198.51.100.10", config.Passive, []*net.IPNet{nw2})
 	actConf2, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, []*net.IPNet{nw1, nw2})
 	actConfNillNW, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, nil)
+	actConfHold, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, []*net.IPNet{nw1},
+		config.WithHoldTime(30))
+	actConfTimers, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, nil,
+		config.WithConnectRetryTime(30), config.WithDelayOpenTime(5), config.WithIdleHoldTime(10))
+	actConf4AS, _ := config.New(4200000001, "198.51.100.10", 65413, "198.51.100.20", config.Active, []*net.IPNet{nw1})
+	actConfCaps, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, nil,
+		config.WithCapabilities(capability.RouteRefreshCap{}),
+		config.WithRequiredCapabilities(capability.RouteRefresh))
+	actConfNoCaps, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, nil,
+		config.WithCapabilities())
+	_, nw6, _ := net.ParseCIDR("2001:db8:1::/48")
+	actConfV6NW, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, []*net.IPNet{nw1, nw6},
+		config.WithNextHop("2001:db8::10"))
+	actConfV6Peer, _ := config.New(64512, "2001:db8::10", 65413, "2001:db8::20", config.Active, []*net.IPNet{nw6},
+		config.WithRouterID("198.51.100.10"),
+		config.WithCapabilities(capability.NewMultiprotocol(bgp.IPv6Unicast)))
+	actConfPolicy, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, nil,
+		config.WithLocalPref(200), config.WithMED(50))
+	_, agg, _ := net.ParseCIDR("192.0.0.0/16")
+	actConfAgg, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, []*net.IPNet{nw1},
+		config.WithAggregate(agg, true, false), config.WithAggregate(nw2, false, true))
+	actConfCommunities, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, []*net.IPNet{nw1},
+		config.WithCommunities(nw1, pathattribute.Community(64512<<16|100), pathattribute.NoExport),
+		config.WithBilateralPeer(true))
+	actConfMaxPrefix, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, nil,
+		config.WithMaxPrefix(config.MaxPrefix{Limit: 1000, Threshold: 80, RestartTime: 5}))
+	actConfMaxPrefixWarn, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, nil,
+		config.WithMaxPrefix(config.MaxPrefix{Limit: 1000, WarningOnly: true}))
+	actConfPassword, _ := config.New(64512, "198.51.100.10", 65413, "198.51.100.20", config.Active, nil,
+		config.WithPassword("secret"))
 	tests := []struct {
 		name  string
 		args  string
@@ -23,8 +58,8 @@ func TestPaseConfig(t *testing.T) {
 		isErr bool
 	}{
 		{name: "none args", args: "", want: nil, isErr: true},
-		{name: "invalid las", args: "65536 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24", want: nil, isErr: true},
-		{name: "invalid ras", args: "64512 198.51.100.10 65536 198.51.100.20 active 192.0.2.0/24", want: nil, isErr: true},
+		{name: "invalid las", args: "4294967296 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24", want: nil, isErr: true},
+		{name: "invalid ras", args: "64512 198.51.100.10 4294967296 198.51.100.20 active 192.0.2.0/24", want: nil, isErr: true},
 		{name: "invalid lip", args: "64512 198.51.100.300 65413 198.51.100.20 active 192.0.2.0/24", want: nil, isErr: true},
 		{name: "invalid rip", args: "64512 198.51.100.10 65413 198.51.100.300 active 192.0.2.0/24", want: nil, isErr: true},
 		{name: "invalid mode", args: "64512 198.51.100.10 65413 198.51.100.20 foobar 192.0.2.0/24", want: nil, isErr: true},
@@ -33,6 +68,36 @@ func TestPaseConfig(t *testing.T) {
 		{name: "Active 1 network", args: "64512 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24", want: actConf, isErr: false},
 		{name: "Passive 1 network", args: "64513 198.51.100.20 65412 198.51.100.10 passive 203.0.113.0/24", want: psvConf, isErr: false},
 		{name: "Active 2 network", args: "64512 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24 203.0.113.0/24", want: actConf2, isErr: false},
+		{name: "hold time", args: "64512 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24 holdtime=30", want: actConfHold, isErr: false},
+		{name: "timers", args: "64512 198.51.100.10 65413 198.51.100.20 active connectretry=30 delayopen=5 idlehold=10", want: actConfTimers, isErr: false},
+		{name: "invalid connect retry time", args: "64512 198.51.100.10 65413 198.51.100.20 active connectretry=0", want: nil, isErr: true},
+		{name: "invalid hold time", args: "64512 198.51.100.10 65413 198.51.100.20 active holdtime=2", want: nil, isErr: true},
+		{name: "4-octet las", args: "4200000001 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24", want: actConf4AS, isErr: false},
+		{name: "asdot las", args: "64086.59905 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24", want: actConf4AS, isErr: false},
+		{name: "capabilities", args: "64512 198.51.100.10 65413 198.51.100.20 active capabilities=route-refresh require=route-refresh", want: actConfCaps, isErr: false},
+		{name: "no capabilities", args: "64512 198.51.100.10 65413 198.51.100.20 active capabilities=", want: actConfNoCaps, isErr: false},
+		{name: "unknown capability", args: "64512 198.51.100.10 65413 198.51.100.20 active capabilities=foo", want: nil, isErr: true},
+		{name: "required capability not advertised", args: "64512 198.51.100.10 65413 198.51.100.20 active capabilities=route-refresh require=enhanced-route-refresh", want: nil, isErr: true},
+		{name: "IPv6 network", args: "64512 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24 2001:db8:1::/48 next-hop=2001:db8::10", want: actConfV6NW, isErr: false},
+		{name: "IPv6 network without next hop", args: "64512 198.51.100.10 65413 198.51.100.20 active 2001:db8:1::/48", want: nil, isErr: true},
+		{name: "IPv6 peer", args: "64512 2001:db8::10 65413 2001:db8::20 active 2001:db8:1::/48 router-id=198.51.100.10 capabilities=ipv6-unicast", want: actConfV6Peer, isErr: false},
+		{name: "IPv6 peer without router id", args: "64512 2001:db8::10 65413 2001:db8::20 active", want: nil, isErr: true},
+		{name: "invalid router id", args: "64512 198.51.100.10 65413 198.51.100.20 active router-id=2001:db8::10", want: nil, isErr: true},
+		{name: "policy", args: "64512 198.51.100.10 65413 198.51.100.20 active local-pref=200 med=50", want: actConfPolicy, isErr: false},
+		{name: "invalid local pref", args: "64512 198.51.100.10 65413 198.51.100.20 active local-pref=-1", want: nil, isErr: true},
+		{name: "aggregate", args: "64512 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24 aggregate=192.0.0.0/16,summary-only aggregate=203.0.113.0/24,as-set", want: actConfAgg, isErr: false},
+		{name: "invalid aggregate option", args: "64512 198.51.100.10 65413 198.51.100.20 active aggregate=192.0.0.0/16,foo", want: nil, isErr: true},
+		{name: "IPv6 aggregate without next hop", args: "64512 198.51.100.10 65413 198.51.100.20 active aggregate=2001:db8::/32", want: nil, isErr: true},
+		{name: "communities", args: "64512 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24 communities=192.0.2.0/24,64512:100,no-export bilateral-peer=true", want: actConfCommunities, isErr: false},
+		{name: "invalid community", args: "64512 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24 communities=192.0.2.0/24,65536:100", want: nil, isErr: true},
+		{name: "communities for unknown network", args: "64512 198.51.100.10 65413 198.51.100.20 active 192.0.2.0/24 communities=203.0.113.0/24,64512:100", want: nil, isErr: true},
+		{name: "max prefix", args: "64512 198.51.100.10 65413 198.51.100.20 active max-prefix=1000,threshold=80,restart=5", want: actConfMaxPrefix, isErr: false},
+		{name: "max prefix warning only", args: "64512 198.51.100.10 65413 198.51.100.20 active max-prefix=1000,warning-only", want: actConfMaxPrefixWarn, isErr: false},
+		{name: "invalid max prefix limit", args: "64512 198.51.100.10 65413 198.51.100.20 active max-prefix=0", want: nil, isErr: true},
+		{name: "invalid max prefix threshold", args: "64512 198.51.100.10 65413 198.51.100.20 active max-prefix=1000,threshold=101", want: nil, isErr: true},
+		{name: "password", args: "64512 198.51.100.10 65413 198.51.100.20 active password=secret", want: actConfPassword, isErr: false},
+		{name: "too long password", args: "64512 198.51.100.10 65413 198.51.100.20 active password=aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", want: nil, isErr: true},
+		{name: "unknown option", args: "64512 198.51.100.10 65413 198.51.100.20 active foo=bar", want: nil, isErr: true},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -72,11 +137,71 @@ func equalConfig(c1, c2 *config.Config) bool {
 	if c1.Mode() != c2.Mode() {
 		return false
 	}
+	if !c1.RouterID().Equal(c2.RouterID()) {
+		return false
+	}
+	for _, afi := range []bgp.AFI{bgp.AFIIPv4, bgp.AFIIPv6} {
+		if !c1.NextHop(afi).Equal(c2.NextHop(afi)) {
+			return false
+		}
+	}
+	if c1.HoldTime() != c2.HoldTime() {
+		return false
+	}
+	lp1, ok1 := c1.LocalPref()
+	lp2, ok2 := c2.LocalPref()
+	med1, mok1 := c1.MED()
+	med2, mok2 := c2.MED()
+	if lp1 != lp2 || ok1 != ok2 || med1 != med2 || mok1 != mok2 {
+		return false
+	}
+	if c1.ConnectRetryTime() != c2.ConnectRetryTime() ||
+		c1.DelayOpenTime() != c2.DelayOpenTime() ||
+		c1.IdleHoldTime() != c2.IdleHoldTime() {
+		return false
+	}
+	if len(c1.Capabilities()) != len(c2.Capabilities()) ||
+		len(c1.RequiredCapabilities()) != len(c2.RequiredCapabilities()) {
+		return false
+	}
+	for i, c := range c1.Capabilities() {
+		if c.Code() != c2.Capabilities()[i].Code() ||
+			!bytes.Equal(c.Value(), c2.Capabilities()[i].Value()) {
+			return false
+		}
+	}
+	for i, c := range c1.RequiredCapabilities() {
+		if c != c2.RequiredCapabilities()[i] {
+			return false
+		}
+	}
 	if len(c1.Networks()) != len(c2.Networks()) {
 		return false
 	}
 	for i, nw := range c1.Networks() {
-		if nw.String() != c2.Networks()[i].String() {
+		if nw.String() != c2.Networks()[i].String() ||
+			!slices.Equal(c1.Communities(nw), c2.Communities(c2.Networks()[i])) {
+			return false
+		}
+	}
+	mp1, ok1 := c1.MaxPrefix()
+	mp2, ok2 := c2.MaxPrefix()
+	if mp1 != mp2 || ok1 != ok2 {
+		return false
+	}
+	if c1.Password() != c2.Password() {
+		return false
+	}
+	if c1.BilateralPeer() != c2.BilateralPeer() {
+		return false
+	}
+	if len(c1.Aggregates()) != len(c2.Aggregates()) {
+		return false
+	}
+	for i, a := range c1.Aggregates() {
+		a2 := c2.Aggregates()[i]
+		if a.Prefix.String() != a2.Prefix.String() ||
+			a.SummaryOnly != a2.SummaryOnly || a.ASSet != a2.ASSet {
 			return false
 		}
 	}
@@ -3,9 +3,12 @@ package config
 import (
 	"fmt"
 	"net"
+	"slices"
 
 	"github.com/SotaUeda/usbgp/internal/bgp"
 	"github.com/SotaUeda/usbgp/internal/ip"
+	"github.com/SotaUeda/usbgp/internal/message/capability"
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
 )
 
 type Config struct {
@@ -14,7 +17,281 @@ type Config struct {
 	remoteAS bgp.ASNumber
 	remoteIP net.IP
 	mode     Mode
-	networks []*ip.IPv4Net
+	networks []ip.Prefix
+	holdTime uint16 // 秒
+
+	// BGP Identifier
+	// IPv4アドレスでなければならないため、IPv6でピアリングする場合は設定が必要になる。
+	routerID net.IP
+	// 対向機器に広告するNEXT_HOP(AFIごと)
+	nextHops map[bgp.AFI]net.IP
+
+	// RFC 4271 8.1で定義されているSession Attribute(秒)
+	connectRetryTime uint16
+	delayOpenTime    uint16
+	idleHoldTime     uint16
+
+	// OPEN Messageで広告するCapability
+	capabilities []capability.Capability
+	// 対向機器が広告しなかった場合に、OPEN Messageを拒否するCapability
+	requiredCapabilities []capability.Code
+
+	// 対向機器から受信したルートに設定するLOCAL_PREF(Import Policy)
+	// nilの場合は、iBGPの対向機器から受信したLOCAL_PREFを使用する。
+	localPref *uint32
+	// 対向機器に広告するルートに設定するMULTI_EXIT_DISC(Export Policy)
+	// nilの場合は、MEDを設定しない。
+	med *uint32
+
+	// 自身が生成する集約ルート
+	aggregates []Aggregate
+	// 広告するネットワークに付加するCOMMUNITIES(Prefixの文字列ごと)
+	communities map[string][]pathattribute.Community
+	// 対向機器がBilateral Peerであるか
+	// trueの場合は、NO_PEERのCommunityを持つルートを広告しない(RFC 3765)。
+	bilateralPeer bool
+	// 対向機器から受信するPrefix数の上限
+	// nilの場合は、上限を設けない。
+	maxPrefix *MaxPrefix
+	// TCP MD5 Signature Option(RFC 2385)のパスワード
+	// 空の場合は使用しない。
+	password string
+}
+
+// 経路集約の設定
+// Prefixより長いPrefixのルートがLocRIBに存在する場合に、Prefixの集約ルートを生成する。
+type Aggregate struct {
+	Prefix ip.Prefix
+	// 集約ルートのみを広告し、集約されたルートを広告しない
+	SummaryOnly bool
+	// 集約されたルートのAS番号をAS_SETとして集約ルートのAS_PATHに含める
+	// falseの場合はAS_PATHを空にし、ATOMIC_AGGREGATEを付加する。
+	ASSet bool
+}
+
+// 対向機器から受信するPrefix数の上限(Maximum Prefix)の設定
+// 対向機器がフルルートを誤って広告した場合などに、受信するルートを制限する。
+type MaxPrefix struct {
+	// 受信できるPrefix数(すべてのAFI/SAFIの合計)
+	Limit uint32
+	// 警告を出力する、Limitに対するPrefix数の割合(%)
+	// 0の場合はDefaultMaxPrefixThresholdとする。
+	Threshold uint8
+	// trueの場合は、Limitを超えても警告のみを出力し、セッションを切断しない
+	WarningOnly bool
+	// Limitを超えてセッションを切断した後、自動的に再開するまでの時間(分)
+	// 0の場合は自動的に再開しない。
+	RestartTime uint16
+}
+
+// Maximum Prefixの警告を出力する割合の既定値(%)
+const DefaultMaxPrefixThreshold uint8 = 75
+
+// 各タイマーの既定値(秒)
+// Hold Time, ConnectRetryTimeはRFC 4271 10章で推奨されている値
+const (
+	DefaultHoldTime         uint16 = 90
+	DefaultConnectRetryTime uint16 = 120
+	DefaultIdleHoldTime     uint16 = 5
+)
+
+// Configの必須ではない設定を行うための関数
+type Option func(*Config) error
+
+// Hold Timeを設定する
+// 0の場合、Hold Timer, Keepalive Timerを使用しない。
+func WithHoldTime(sec uint16) Option {
+	return func(c *Config) error {
+		if sec == 1 || sec == 2 {
+			return fmt.Errorf("hold time must be 0 or at least 3 seconds: %d", sec)
+		}
+		c.holdTime = sec
+		return nil
+	}
+}
+
+// ConnectRetryTimeを設定する
+func WithConnectRetryTime(sec uint16) Option {
+	return func(c *Config) error {
+		if sec == 0 {
+			return fmt.Errorf("connect retry time must be greater than 0")
+		}
+		c.connectRetryTime = sec
+		return nil
+	}
+}
+
+// DelayOpenTimeを設定する
+// 0以外の場合、TCP Connectionが確立してからOPEN Messageを送信するまで、
+// 指定した時間だけ対向機器からのOPEN Messageを待つ(DelayOpen)。
+func WithDelayOpenTime(sec uint16) Option {
+	return func(c *Config) error {
+		c.delayOpenTime = sec
+		return nil
+	}
+}
+
+// IdleHoldTimeを設定する
+// エラーによってIdleに遷移した後、指定した時間が経過すると自動的にPeerを再開する。
+// 0の場合、自動的に再開しない。
+func WithIdleHoldTime(sec uint16) Option {
+	return func(c *Config) error {
+		c.idleHoldTime = sec
+		return nil
+	}
+}
+
+// BGP Identifierを設定する
+// 設定しない場合は、Local IPアドレス(IPv4の場合)を使用する。
+func WithRouterID(id string) Option {
+	return func(c *Config) error {
+		rid := net.ParseIP(id).To4()
+		if rid == nil {
+			return fmt.Errorf("router ID must be an IPv4 address: %s", id)
+		}
+		c.routerID = rid
+		return nil
+	}
+}
+
+// 対向機器に広告するNEXT_HOPを設定する
+// アドレスのAFIごとに設定でき、設定しない場合はLocal IPアドレスと同じAFIのみ
+// Local IPアドレスを使用する。
+func WithNextHop(nh string) Option {
+	return func(c *Config) error {
+		ip := net.ParseIP(nh)
+		if ip == nil {
+			return fmt.Errorf("invalid next hop: %s", nh)
+		}
+		c.nextHops[afiOf(ip)] = ip
+		return nil
+	}
+}
+
+// OPEN Messageで広告するCapabilityを設定する
+// 設定しない場合は、Multiprotocol Extensions(IPv4 Unicast, IPv6 Unicast), Route Refresh,
+// Enhanced Route Refresh, 4-octet AS Numberを広告する。
+func WithCapabilities(caps ...capability.Capability) Option {
+	return func(c *Config) error {
+		c.capabilities = caps
+		return nil
+	}
+}
+
+// 対向機器が広告しなかった場合に、
+// Unsupported CapabilityのNOTIFICATION MessageでOPEN Messageを拒否するCapabilityを設定する
+// 自身が広告するCapabilityでなければならない。
+func WithRequiredCapabilities(codes ...capability.Code) Option {
+	return func(c *Config) error {
+		c.requiredCapabilities = codes
+		return nil
+	}
+}
+
+// 対向機器から受信したルートのLOCAL_PREFを設定する
+// ベストパスの選択でLOCAL_PREFが大きいルートを優先する。
+func WithLocalPref(v uint32) Option {
+	return func(c *Config) error {
+		c.localPref = &v
+		return nil
+	}
+}
+
+// 対向機器に広告するルートのMULTI_EXIT_DISCを設定する
+// 対向機器のASは、MEDが小さいルートを優先する。
+func WithMED(v uint32) Option {
+	return func(c *Config) error {
+		c.med = &v
+		return nil
+	}
+}
+
+// 集約ルートを生成するPrefixを追加する
+// 複数回指定した場合は、それぞれの集約ルートを生成する。
+func WithAggregate(nw *net.IPNet, summaryOnly, asSet bool) Option {
+	return func(c *Config) error {
+		if nw == nil {
+			return fmt.Errorf("invalid aggregate: %v", nw)
+		}
+		p, err := ip.NewPrefix(&net.IPNet{IP: nw.IP, Mask: nw.Mask})
+		if err != nil {
+			return fmt.Errorf("invalid aggregate: %v", nw)
+		}
+		c.aggregates = append(c.aggregates, Aggregate{
+			Prefix:      p,
+			SummaryOnly: summaryOnly,
+			ASSet:       asSet,
+		})
+		return nil
+	}
+}
+
+// 広告するネットワーク(nw)に付加するCOMMUNITIESを設定する
+// nwは広告するネットワークでなければならない。
+func WithCommunities(nw *net.IPNet, cs ...pathattribute.Community) Option {
+	return func(c *Config) error {
+		if nw == nil {
+			return fmt.Errorf("invalid network: %v", nw)
+		}
+		i := slices.IndexFunc(c.networks, func(p ip.Prefix) bool {
+			return p.Net().String() == nw.String()
+		})
+		if i < 0 {
+			return fmt.Errorf("communities for network that is not advertised: %v", nw)
+		}
+		c.communities[c.networks[i].Net().String()] = slices.Clone(cs)
+		return nil
+	}
+}
+
+// 対向機器をBilateral Peerとして扱う
+// NO_PEERのCommunityを持つルートを広告しない。
+func WithBilateralPeer(v bool) Option {
+	return func(c *Config) error {
+		c.bilateralPeer = v
+		return nil
+	}
+}
+
+// 対向機器から受信するPrefix数の上限を設定する
+func WithMaxPrefix(mp MaxPrefix) Option {
+	return func(c *Config) error {
+		if mp.Limit == 0 {
+			return fmt.Errorf("max prefix limit must be greater than 0")
+		}
+		if mp.Threshold > 100 {
+			return fmt.Errorf("max prefix threshold must be 1-100 percent: %d", mp.Threshold)
+		}
+		if mp.Threshold == 0 {
+			mp.Threshold = DefaultMaxPrefixThreshold
+		}
+		c.maxPrefix = &mp
+		return nil
+	}
+}
+
+// TCP MD5 Signature Option(RFC 2385)のパスワードを設定する
+// 対向機器と同じパスワードを設定しなければ、TCP Connectionを確立できない。
+func WithPassword(pw string) Option {
+	return func(c *Config) error {
+		// Linuxのカーネルで扱えるパスワードは80byteまで
+		if len(pw) > 80 {
+			return fmt.Errorf("password must be at most 80 bytes: %d", len(pw))
+		}
+		c.password = pw
+		return nil
+	}
+}
+
+func defaultCapabilities(localAS bgp.ASNumber) []capability.Capability {
+	return []capability.Capability{
+		capability.NewMultiprotocol(bgp.IPv4Unicast),
+		capability.NewMultiprotocol(bgp.IPv6Unicast),
+		capability.RouteRefreshCap{},
+		capability.EnhancedRouteRefreshCap{},
+		capability.ExtendedMessageCap{},
+		capability.NewFourOctetAS(localAS),
+	}
 }
 
 type Mode int
@@ -40,6 +317,7 @@ func New(
 	localAS bgp.ASNumber, localIP string,
 	remoteAS bgp.ASNumber, remoteIP string,
 	mode Mode, nets []*net.IPNet,
+	opts ...Option,
 ) (*Config, error) {
 	lIP := net.ParseIP(localIP)
 	if lIP == nil {
@@ -49,31 +327,61 @@ func New(
 	if rIP == nil {
 		return nil, fmt.Errorf("invalid remote IP address: %s", remoteIP)
 	}
-	nws := []*ip.IPv4Net{}
-	if len(nets) > 0 {
-		for _, nw := range nets {
-			if nw == nil {
-				return nil, fmt.Errorf("invalid network: %v", nw)
-			}
-			v4 := nw.IP.To4()
-			if v4 == nil {
-				return nil, fmt.Errorf("invalid network: %v", nw)
-			}
-			nws = append(nws, &ip.IPv4Net{
-				IPNet: &net.IPNet{
-					IP:   v4,
-					Mask: nw.Mask,
-				}})
-		}
-	}
-	return &Config{
+	nws := []ip.Prefix{}
+	for _, nw := range nets {
+		if nw == nil {
+			return nil, fmt.Errorf("invalid network: %v", nw)
+		}
+		p, err := ip.NewPrefix(&net.IPNet{IP: nw.IP, Mask: nw.Mask})
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %v", nw)
+		}
+		nws = append(nws, p)
+	}
+	c := &Config{
 		localAS:  localAS,
 		localIP:  lIP,
 		remoteAS: remoteAS,
 		remoteIP: rIP,
 		mode:     mode,
 		networks: nws,
-	}, nil
+		holdTime: DefaultHoldTime,
+
+		routerID: lIP.To4(),
+		nextHops: map[bgp.AFI]net.IP{afiOf(lIP): lIP},
+
+		connectRetryTime: DefaultConnectRetryTime,
+		idleHoldTime:     DefaultIdleHoldTime,
+
+		capabilities: defaultCapabilities(localAS),
+		communities:  map[string][]pathattribute.Community{},
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.routerID == nil {
+		return nil, fmt.Errorf("router ID is required when local IP is not IPv4: %s", localIP)
+	}
+	for _, nw := range c.networks {
+		if c.NextHop(nw.AFI()) == nil {
+			return nil, fmt.Errorf("next hop is required to advertise network: %v", nw)
+		}
+	}
+	for _, a := range c.aggregates {
+		if c.NextHop(a.Prefix.AFI()) == nil {
+			return nil, fmt.Errorf("next hop is required to advertise aggregate: %v", a.Prefix)
+		}
+	}
+	for _, code := range c.requiredCapabilities {
+		if !slices.ContainsFunc(c.capabilities, func(lc capability.Capability) bool {
+			return lc.Code() == code
+		}) {
+			return nil, fmt.Errorf("required capability is not advertised: %v", code)
+		}
+	}
+	return c, nil
 }
 
 func (c *Config) LocalAS() bgp.ASNumber {
@@ -92,10 +400,101 @@ func (c *Config) RemoteIP() net.IP {
 	return c.remoteIP
 }
 
+// 受信したルートに設定するLOCAL_PREF
+// 設定されていない場合はfalseを返す。
+func (c *Config) LocalPref() (uint32, bool) {
+	if c.localPref == nil {
+		return 0, false
+	}
+	return *c.localPref, true
+}
+
+// 広告するルートに設定するMULTI_EXIT_DISC
+// 設定されていない場合はfalseを返す。
+func (c *Config) MED() (uint32, bool) {
+	if c.med == nil {
+		return 0, false
+	}
+	return *c.med, true
+}
+
+// 対向機器が自身と同じASのPeer(iBGP)であるか
+func (c *Config) IBGP() bool {
+	return c.remoteAS == c.localAS
+}
+
 func (c *Config) Mode() Mode {
 	return c.mode
 }
 
-func (c *Config) Networks() []*ip.IPv4Net {
+func (c *Config) Networks() []ip.Prefix {
 	return c.networks
 }
+
+// 広告するネットワークに付加するCOMMUNITIES
+// 設定されていない場合はnilを返す。
+func (c *Config) Communities(nw ip.Prefix) []pathattribute.Community {
+	return c.communities[nw.Net().String()]
+}
+
+func (c *Config) BilateralPeer() bool {
+	return c.bilateralPeer
+}
+
+// 対向機器から受信するPrefix数の上限
+// 設定されていない場合はfalseを返す。
+func (c *Config) MaxPrefix() (MaxPrefix, bool) {
+	if c.maxPrefix == nil {
+		return MaxPrefix{}, false
+	}
+	return *c.maxPrefix, true
+}
+
+func (c *Config) Password() string {
+	return c.password
+}
+
+func (c *Config) Aggregates() []Aggregate {
+	return c.aggregates
+}
+
+func (c *Config) RouterID() net.IP {
+	return c.routerID
+}
+
+// AFIに対応するNEXT_HOPを返す
+// 設定されていない場合はnilを返す。
+func (c *Config) NextHop(afi bgp.AFI) net.IP {
+	return c.nextHops[afi]
+}
+
+func (c *Config) HoldTime() uint16 {
+	return c.holdTime
+}
+
+func (c *Config) ConnectRetryTime() uint16 {
+	return c.connectRetryTime
+}
+
+func (c *Config) DelayOpenTime() uint16 {
+	return c.delayOpenTime
+}
+
+func (c *Config) IdleHoldTime() uint16 {
+	return c.idleHoldTime
+}
+
+func (c *Config) Capabilities() []capability.Capability {
+	return c.capabilities
+}
+
+func (c *Config) RequiredCapabilities() []capability.Code {
+	return c.requiredCapabilities
+}
+
+func afiOf(ip net.IP) bgp.AFI {
+	if ip.To4() != nil {
+		return bgp.AFIIPv4
+	}
+	return bgp.AFIIPv6
+}
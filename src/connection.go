@@ -2,11 +2,11 @@ package peer
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"time"
+	"sync/atomic"
 
 	"github.com/SotaUeda/usbgp/config"
 	"github.com/SotaUeda/usbgp/internal/message"
@@ -20,98 +20,118 @@ var BGPPort = 179
 type conn struct {
 	*net.TCPConn
 	buf []byte
+	// 4-octet AS Number Capabilityをネゴシエーションしたか
+	// 受信用のgoroutineから参照するため、atomicに扱う。
+	fourOctetAS atomic.Bool
+	// Extended Message Capabilityをネゴシエーションしたか
+	extendedMessage atomic.Bool
 }
 
-func newConnection(ctx context.Context, cfg *config.Config) (*conn, error) {
-	c := &conn{}
-	c.buf = make([]byte, 0, 1500)
-	err := c.connect(ctx, cfg)
-	if err != nil {
-		return nil, err
+// TCP Connectionを確立した結果
+type tcpResult struct {
+	c   *conn
+	err error
+	// 対向機器から接続された場合はtrue、自身から接続した場合はfalse
+	passive bool
+}
+
+func newConnection(tc *net.TCPConn) *conn {
+	return &conn{
+		TCPConn: tc,
+		buf:     make([]byte, 0, 1500),
 	}
-	return c, nil
 }
 
-func (c *conn) connect(
+// Modeに応じて、対向機器とのTCP Connectionの確立を試みる。
+// Active Modeの場合は自身から接続し、Passive Modeの場合は対向機器からの接続を待ち受ける。
+// 結果はchに送信する。ctxがキャンセルされた場合は送信しない。
+func connect(
 	ctx context.Context,
 	cfg *config.Config,
-) error {
-	switch cfg.Mode() {
-	case config.Active:
-		// エラーが発生した場合、接続を繰り返す
-		// TODO: Timeout、エラーハンドリング
-		for {
-			select {
-			case <-ctx.Done():
-				return fmt.Errorf("connection dial canceled")
-			case err, ok := <-c.dial(cfg):
-				if !ok {
-					return nil
-				}
-				log.Printf("connection dial error: %v", err)
-				time.Sleep(1 * time.Second)
-			}
+	ch chan<- tcpResult,
+	invalid func(net.Addr),
+) {
+	go func() {
+		var r tcpResult
+		switch cfg.Mode() {
+		case config.Active:
+			r.c, r.err = dial(ctx, cfg)
+		case config.Passive:
+			r.c, r.err = accept(ctx, cfg, invalid)
+			r.passive = true
+		default:
+			r.err = fmt.Errorf("invalid mode: %v", cfg.Mode())
 		}
-	case config.Passive:
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("connection dial canceled")
-		case err, ok := <-c.accept(cfg):
-			if !ok {
-				return nil
+			if r.c != nil {
+				r.c.Close()
 			}
-			return fmt.Errorf("connection accept error: %v", err)
+		case ch <- r:
 		}
-	default:
-		return fmt.Errorf("invalid mode: %v", cfg.Mode())
-	}
+	}()
 }
 
-func (c *conn) dial(cfg *config.Config) <-chan error {
-	ech := make(chan error)
-	go func() {
-		defer close(ech)
-		laddr := &net.TCPAddr{
-			IP:   cfg.LocalIP(),
-			Port: BGPPort,
-		}
-		raddr := &net.TCPAddr{
-			IP:   cfg.RemoteIP(),
-			Port: BGPPort,
-		}
-		conn, err := net.DialTCP("tcp", laddr, raddr)
-		if err != nil {
-			ech <- err
-			return
-		}
-		log.Printf("dial connected to %v", conn.RemoteAddr())
-		c.TCPConn = conn
-	}()
-	return ech
+func dial(ctx context.Context, cfg *config.Config) (*conn, error) {
+	// 送信元のPort番号はOSに任せる。
+	// BGPPortを使用すると、再接続時に前のTCP ConnectionがTIME_WAITの場合に失敗する。
+	d := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: cfg.LocalIP()},
+	}
+	// 接続(SYNの送信)前にTCP MD5 Signature Optionを設定する
+	if pw := cfg.Password(); pw != "" {
+		d.Control = md5Control(cfg.RemoteIP(), pw)
+	}
+	raddr := &net.TCPAddr{
+		IP:   cfg.RemoteIP(),
+		Port: BGPPort,
+	}
+	c, err := d.DialContext(ctx, "tcp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("dial connected to %v", c.RemoteAddr())
+	return newConnection(c.(*net.TCPConn)), nil
 }
 
-func (c *conn) accept(cfg *config.Config) <-chan error {
-	ech := make(chan error)
-	go func() {
-		defer close(ech)
-		laddr := &net.TCPAddr{
-			IP:   cfg.LocalIP(),
-			Port: BGPPort,
-		}
-		listener, err := net.ListenTCP("tcp", laddr)
+// 対向機器からのTCP Connectionを1つ受け付ける。
+// Configで設定されていない機器からの接続は切断し、待ち受けを続ける。
+func accept(ctx context.Context, cfg *config.Config, invalid func(net.Addr)) (*conn, error) {
+	laddr := &net.TCPAddr{
+		IP:   cfg.LocalIP(),
+		Port: BGPPort,
+	}
+	lc := &net.ListenConfig{}
+	// 待ち受けるSocketに対向機器のアドレスごとに設定し、受け付けたTCP Connectionに引き継ぐ
+	if pw := cfg.Password(); pw != "" {
+		lc.Control = md5Control(cfg.RemoteIP(), pw)
+	}
+	l, err := lc.Listen(ctx, "tcp", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	// ctxがキャンセルされた場合は、Listenerを閉じてAcceptを終了させる
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		c, err := l.Accept()
 		if err != nil {
-			ech <- err
-			return
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
 		}
-		conn, err := listener.AcceptTCP()
-		if err != nil {
-			ech <- err
-			return
+		ra := c.RemoteAddr().(*net.TCPAddr)
+		if !ra.IP.Equal(cfg.RemoteIP()) {
+			log.Printf("reject connection from %v", ra)
+			c.Close()
+			invalid(ra)
+			continue
 		}
-		log.Printf("accept connected from %v", conn.RemoteAddr())
-		c.TCPConn = conn
-	}()
-	return ech
+		log.Printf("accept connected from %v", ra)
+		return newConnection(c.(*net.TCPConn)), nil
+	}
 }
 
 func (c *conn) sendMsg(
@@ -122,20 +142,35 @@ func (c *conn) sendMsg(
 	go c.send(ctx, mch, ech)
 }
 
+// 送信に失敗した場合も、ctxがキャンセルされるまでmchから受け取り続ける。
+// 状態遷移のgoroutineはmchへの送信中にechを受け取れないため、
+// 受け取りをやめると、エラーを通知できずに双方が停止する。
 func (c *conn) send(
 	ctx context.Context,
 	mch chan message.Message,
 	ech chan error,
 ) {
+	var (
+		failed bool
+		// 通知するエラー。通知するまではechに送信できるようにする。
+		errCh chan error
+		err   error
+	)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case m := <-mch:
-			err := c.writeMsg(m)
-			if err != nil {
-				ech <- err
+			// 送信に失敗した後のMessageは破棄する
+			if failed {
+				continue
+			}
+			if err = c.writeMsg(m); err != nil {
+				failed = true
+				errCh = ech
 			}
+		case errCh <- err:
+			errCh = nil
 		}
 	}
 }
@@ -162,52 +197,60 @@ func (c *conn) recvMsg(
 	go c.recv(ctx, mch, ech)
 }
 
+// 受信に失敗した場合、以降のByte列を正しく区切れないため受信を終了する。
 func (c *conn) recv(
 	ctx context.Context,
 	mch chan message.Message,
 	ech chan error,
 ) {
 	for {
+		m, err := c.readMsg()
+		// Peer側でTCP Connectionが閉じられた場合は受信を終了する
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case ech <- err:
+			}
+			return
+		}
+		if m == nil {
+			continue
+		}
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			m, err := c.readMsg()
-			if err != nil {
-				ech <- err
-			}
-			if m != nil {
-				mch <- m
-			}
+		case mch <- m:
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
 }
 
 // メッセージの受信
-// BGP Messageを1つ以上受信している場合は
+// bufに1つ以上のBGP Messageを受信している場合は
 // 最も古く受信したMessageを返す。
-// BGP Messageを受信中（途中）あるいは
-// 何も受信していない場合はnilを返す。
+// BGP Messageを受信中（途中）の場合はnilを返す。
+// 対向機器がTCP Connectionを閉じた場合はio.EOFを返す。
 func (c *conn) readMsg() (message.Message, error) {
-	t := make([]byte, 1500)
-	n, err := c.Read(t)
-	switch {
-	case n == 0 || err == io.EOF:
-		return nil, nil
-	case err != nil:
-		return nil, err
-	}
-	c.buf = append(c.buf, t[:n]...)
 	b, err := c.splitMsg()
 	if err != nil {
 		return nil, err
 	}
 	// 1つのBGP Messageを表すbyteが揃っていない場合
 	if b == nil {
+		t := make([]byte, 1500)
+		n, err := c.Read(t)
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, t[:n]...)
 		return nil, nil
 	}
-	m, err := message.UnMarshal(b)
+	m, err := message.UnMarshal(b,
+		message.WithFourOctetAS(c.fourOctetAS.Load()),
+		message.WithExtendedMessage(c.extendedMessage.Load()),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -220,7 +263,17 @@ func (c *conn) readMsg() (message.Message, error) {
 func (c *conn) splitMsg() ([]byte, error) {
 	// 1つのBGP Messageを表すbyteが揃っている場合
 	ml := msgLen(c.buf)
-	if ml == 0 || len(c.buf) < ml {
+	if ml == 0 {
+		return nil, nil
+	}
+	// Lengthが不正な場合は、以降のByte列からMessageを切り出せない
+	if ml < 19 || ml > c.maxMsgLen() {
+		return nil, message.NewConvMsgErr(
+			message.MessageHeaderError, message.BadMessageLength, c.buf[16:18],
+			fmt.Sprintf("HeaderのLengthが不正です: %d", ml),
+		)
+	}
+	if len(c.buf) < ml {
 		return nil, nil
 	}
 	b := c.buf[:ml]
@@ -228,11 +281,22 @@ func (c *conn) splitMsg() ([]byte, error) {
 	return b, nil
 }
 
+// 送受信できるBGP Messageの最大長を返す
+func (c *conn) maxMsgLen() int {
+	if c.extendedMessage.Load() {
+		return message.MaxExtendedMsgLen
+	}
+	return message.MaxMsgLen
+}
+
 // []byteのうちどこまでが1つのBGP Messageを表すbyteであるか、整数を返す
 // HeaderのLengthフィールドを参照して、BGP Messageの長さを取得する
 func msgLen(b []byte) int {
 	if len(b) < 19 {
 		// 19byte未満の場合は1つのBGP Messageを表すbyteが揃っていない
+		if len(b) == 0 {
+			return 0
+		}
 		log.Printf("MessageのSeparateorを表すデータまでbufferに入っていません。"+
 			"データの受信が半端であることが想定されます。 buffer: %v", len(b))
 		return 0
@@ -2,9 +2,9 @@ module github.com/SotaUeda/usbgp
 
 go 1.23.2
 
-require github.com/vishvananda/netlink v1.3.0
-
 require (
-	github.com/vishvananda/netns v0.0.4 // indirect
-	golang.org/x/sys v0.10.0 // indirect
+	github.com/vishvananda/netlink v1.3.0
+	golang.org/x/sys v0.10.0
 )
+
+require github.com/vishvananda/netns v0.0.4 // indirect
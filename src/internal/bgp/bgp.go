@@ -3,18 +3,88 @@ package bgp
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
-type ASNumber uint16
+// AS番号
+// 4-octet AS Number(RFC 6793)に対応するため、32bitで表現する。
+type ASNumber uint32
 
+// 2octetで表現できないAS番号の代わりに使用するAS番号(RFC 6793)
+const ASTrans ASNumber = 23456
+
+// AS番号をパースする
+// asplain(例: 4200000001)とasdot(例: 64086.59905)の表記に対応する(RFC 5396)。
 func ParseASNumber(s string) (ASNumber, error) {
-	as, err := strconv.ParseUint(s, 10, 16)
+	if hi, lo, ok := strings.Cut(s, "."); ok {
+		h, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid AS number: %s", s)
+		}
+		l, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid AS number: %s", s)
+		}
+		return ASNumber(h<<16 | l), nil
+	}
+	as, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
 		return 0, fmt.Errorf("invalid AS number: %s", s)
 	}
 	return ASNumber(as), nil
 }
 
+// 2octetで表現できるAS番号かを返す
+func (a ASNumber) IsTwoOctet() bool {
+	return a <= 0xffff
+}
+
+// 2octetのAS番号を返す
+// 2octetで表現できない場合はAS_TRANSを返す。
 func (a ASNumber) Uint16() uint16 {
+	if !a.IsTwoOctet() {
+		return uint16(ASTrans)
+	}
 	return uint16(a)
 }
+
+func (a ASNumber) Uint32() uint32 {
+	return uint32(a)
+}
+
+// Address Family Identifier
+// (https://www.iana.org/assignments/address-family-numbers)
+type AFI uint16
+
+const (
+	AFIIPv4 AFI = 1
+	AFIIPv6 AFI = 2
+)
+
+// Subsequent Address Family Identifier
+// (https://datatracker.ietf.org/doc/html/rfc4760#section-6)
+type SAFI uint8
+
+const SAFIUnicast SAFI = 1
+
+// AFIとSAFIの組
+// RIBのテーブルやMultiprotocol Extensions Capabilityの単位となる。
+type Family struct {
+	AFI  AFI
+	SAFI SAFI
+}
+
+var (
+	IPv4Unicast = Family{AFI: AFIIPv4, SAFI: SAFIUnicast}
+	IPv6Unicast = Family{AFI: AFIIPv6, SAFI: SAFIUnicast}
+)
+
+func (f Family) String() string {
+	switch f {
+	case IPv4Unicast:
+		return "IPv4 Unicast"
+	case IPv6Unicast:
+		return "IPv6 Unicast"
+	}
+	return fmt.Sprintf("AFI: %d, SAFI: %d", f.AFI, f.SAFI)
+}
@@ -0,0 +1,42 @@
+package bgp
+
+import "testing"
+
+func TestParseASNumber(t *testing.T) {
+	tests := []struct {
+		s     string
+		want  ASNumber
+		isErr bool
+	}{
+		{s: "64512", want: 64512},
+		{s: "4200000001", want: 4200000001},
+		{s: "64086.59905", want: 4200000001},
+		{s: "0.65535", want: 65535},
+		{s: "4294967296", isErr: true},
+		{s: "65536.0", isErr: true},
+		{s: "1.65536", isErr: true},
+		{s: "1.", isErr: true},
+		{s: "-1", isErr: true},
+	}
+	for _, tc := range tests {
+		got, err := ParseASNumber(tc.s)
+		if tc.isErr {
+			if err == nil {
+				t.Errorf("ParseASNumber(%q) = %v, want error", tc.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ParseASNumber(%q) = %v, %v, want %v", tc.s, got, err, tc.want)
+		}
+	}
+}
+
+func TestASNumberUint16(t *testing.T) {
+	if got := ASNumber(64512).Uint16(); got != 64512 {
+		t.Errorf("Uint16() = %d, want 64512", got)
+	}
+	if got := ASNumber(4200000001).Uint16(); got != uint16(ASTrans) {
+		t.Errorf("Uint16() = %d, want AS_TRANS", got)
+	}
+}
@@ -3,19 +3,62 @@ package event
 // / BGPのRFC内 8.1
 // / (https://datatracker.ietf.org/doc/html/rfc4271#section-8.1)で
 // / 定義されているEventを表す列挙型です。
+// / RFC内のEvent番号と値が一致するように定義しています。
 type Event int
 
 //go:generate stringer -type=Event event.go
 const (
-	ManualStart Event = iota
-	// 正常系しか実装しない本実装では別のEventとして扱う意味がないため、
-	// TCPConnectionConfirmedはTcpCrAckedも兼ねている。
+	// Administrative Events (8.1.2)
+	ManualStart Event = iota + 1
+	ManualStop
+	AutomaticStart
+	ManualStartWithPassiveTCPEstablishment
+	AutomaticStartWithPassiveTCPEstablishment
+	AutomaticStartWithDampPeerOscillations
+	AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment
+	AutomaticStop
+
+	// Timer Events (8.1.3)
+	// BGPのRFC内ではConnectRetryTimer_Expires
+	ConnectRetryTimerExpires
+	// Hold Timerが満了したときのイベント
+	// BGPのRFC内ではHoldTimer_Expires
+	HoldTimerExpires
+	// Keepalive Timerが満了したときのイベント
+	// BGPのRFC内ではKeepaliveTimer_Expires
+	KeepaliveTimerExpires
+	// BGPのRFC内ではDelayOpenTimer_Expires
+	DelayOpenTimerExpires
+	// BGPのRFC内ではIdleHoldTimer_Expires
+	IdleHoldTimerExpires
+
+	// TCP Connection-Based Events (8.1.4)
+	// BGPのRFC内ではTcpConnection_Valid
+	TCPConnectionValid
+	// BGPのRFC内ではTcp_CR_Invalid
+	TCPCRInvalid
+	// 自身から接続したTCP Connectionが確立したときのイベント
+	// BGPのRFC内ではTcp_CR_Acked
+	TCPCRAcked
+	// 対向機器から接続されたTCP Connectionが確立したときのイベント
 	TCPConnectionConfirmed
+	TCPConnectionFails
+
+	// BGP Message-Based Events (8.1.5)
 	BGPOpen
+	// BGPのRFC内ではBGPOpen with DelayOpenTimer running
+	BGPOpenWithDelayOpenTimerRunning
+	BGPHeaderErr
+	BGPOpenMsgErr
+	OpenCollisionDump
+	NotifMsgVerErr
+	NotifMsg
 	// BGPのRFC内での表記
 	KeepAliveMsg
 	// BGPのRFC内での表記
 	UpdateMsg
+	UpdateMsgErr
+
 	// StateがEstablishedに遷移したことを表す。
 	// 存在するほうが実装が楽なので追加したオリジナルのイベント
 	Established
@@ -25,4 +68,10 @@ const (
 	LocRIBChanged
 	AdjRIBOutChanged
 	AdjRIBInChanged
+
+	// ROUTE-REFRESH Messageを受信したときのイベント(RFC 2918)
+	RouteRefreshMsg
+	// 対向機器にROUTE-REFRESH Messageを送信するときのイベント
+	// Import Policyを変更したときなどに、運用者が発行する。
+	ManualRouteRefresh
 )
@@ -8,23 +8,50 @@ func _() {
 	// An "invalid array index" compiler error signifies that the constant values have changed.
 	// Re-run the stringer command to generate them again.
 	var x [1]struct{}
-	_ = x[ManualStart-0]
-	_ = x[TCPConnectionConfirmed-1]
-	_ = x[BGPOpen-2]
-	_ = x[KeepAliveMsg-3]
-	_ = x[UpdateMsg-4]
-	_ = x[Established-5]
-	_ = x[LocRIBChanged-6]
-	_ = x[AdjRIBOutChanged-7]
+	_ = x[ManualStart-1]
+	_ = x[ManualStop-2]
+	_ = x[AutomaticStart-3]
+	_ = x[ManualStartWithPassiveTCPEstablishment-4]
+	_ = x[AutomaticStartWithPassiveTCPEstablishment-5]
+	_ = x[AutomaticStartWithDampPeerOscillations-6]
+	_ = x[AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment-7]
+	_ = x[AutomaticStop-8]
+	_ = x[ConnectRetryTimerExpires-9]
+	_ = x[HoldTimerExpires-10]
+	_ = x[KeepaliveTimerExpires-11]
+	_ = x[DelayOpenTimerExpires-12]
+	_ = x[IdleHoldTimerExpires-13]
+	_ = x[TCPConnectionValid-14]
+	_ = x[TCPCRInvalid-15]
+	_ = x[TCPCRAcked-16]
+	_ = x[TCPConnectionConfirmed-17]
+	_ = x[TCPConnectionFails-18]
+	_ = x[BGPOpen-19]
+	_ = x[BGPOpenWithDelayOpenTimerRunning-20]
+	_ = x[BGPHeaderErr-21]
+	_ = x[BGPOpenMsgErr-22]
+	_ = x[OpenCollisionDump-23]
+	_ = x[NotifMsgVerErr-24]
+	_ = x[NotifMsg-25]
+	_ = x[KeepAliveMsg-26]
+	_ = x[UpdateMsg-27]
+	_ = x[UpdateMsgErr-28]
+	_ = x[Established-29]
+	_ = x[LocRIBChanged-30]
+	_ = x[AdjRIBOutChanged-31]
+	_ = x[AdjRIBInChanged-32]
+	_ = x[RouteRefreshMsg-33]
+	_ = x[ManualRouteRefresh-34]
 }
 
-const _Event_name = "ManualStartTCPConnectionConfirmedBGPOpenKeepAliveMsgUpdateMsgEstablishedLocRIBChangedAdjRIBOutChanged"
+const _Event_name = "ManualStartManualStopAutomaticStartManualStartWithPassiveTCPEstablishmentAutomaticStartWithPassiveTCPEstablishmentAutomaticStartWithDampPeerOscillationsAutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishmentAutomaticStopConnectRetryTimerExpiresHoldTimerExpiresKeepaliveTimerExpiresDelayOpenTimerExpiresIdleHoldTimerExpiresTCPConnectionValidTCPCRInvalidTCPCRAckedTCPConnectionConfirmedTCPConnectionFailsBGPOpenBGPOpenWithDelayOpenTimerRunningBGPHeaderErrBGPOpenMsgErrOpenCollisionDumpNotifMsgVerErrNotifMsgKeepAliveMsgUpdateMsgUpdateMsgErrEstablishedLocRIBChangedAdjRIBOutChangedAdjRIBInChangedRouteRefreshMsgManualRouteRefresh"
 
-var _Event_index = [...]uint8{0, 11, 33, 40, 52, 61, 72, 85, 101}
+var _Event_index = [...]uint16{0, 11, 21, 35, 73, 114, 152, 216, 229, 253, 269, 290, 311, 331, 349, 361, 371, 393, 411, 418, 450, 462, 475, 492, 506, 514, 526, 535, 547, 558, 571, 587, 602, 617, 635}
 
 func (i Event) String() string {
+	i -= 1
 	if i < 0 || i >= Event(len(_Event_index)-1) {
-		return "Event(" + strconv.FormatInt(int64(i), 10) + ")"
+		return "Event(" + strconv.FormatInt(int64(i+1), 10) + ")"
 	}
 	return _Event_name[_Event_index[i]:_Event_index[i+1]]
 }
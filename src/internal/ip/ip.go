@@ -3,8 +3,96 @@ package ip
 import (
 	"fmt"
 	"net"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
 )
 
+// NLRIとして送受信するPrefix
+// IPv4NetとIPv6Netが実装する。
+type Prefix interface {
+	AFI() bgp.AFI
+	Net() *net.IPNet
+	// bytesにしたときのオクテット数
+	Len() uint8
+	Equal(Prefix) bool
+	MarshalBytes() ([]byte, error)
+	String() string
+}
+
+// net.IPNetからPrefixを生成する
+func NewPrefix(nw *net.IPNet) (Prefix, error) {
+	if nw == nil {
+		return nil, fmt.Errorf("invalid network: %v", nw)
+	}
+	if nw.IP.To4() != nil {
+		return NewIPv4Net(nw)
+	}
+	return NewIPv6Net(nw)
+}
+
+// AFIに応じて、NLRIのByte列からPrefixのリストを生成する
+func NewPrefixesFromBytes(afi bgp.AFI, b []byte) ([]Prefix, error) {
+	var ps []Prefix
+	switch afi {
+	case bgp.AFIIPv4:
+		nws, err := NewIPv4NetsFromBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, nw := range nws {
+			ps = append(ps, nw)
+		}
+	case bgp.AFIIPv6:
+		nws, err := NewIPv6NetsFromBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, nw := range nws {
+			ps = append(ps, nw)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported AFI: %d", afi)
+	}
+	return ps, nil
+}
+
+// Prefix長から、Length(1octet)とPrefixを合わせたオクテット数を返す
+func nlriLen(ones, bits int) (uint8, error) {
+	if ones < 0 || ones > bits {
+		return 0, fmt.Errorf("prefixが不正です: %v", ones)
+	}
+	return uint8(1 + (ones+7)/8), nil
+}
+
+// NLRIのByte列から、Prefixのアドレス(addrLenのオクテット数)とPrefix長を読み出す
+// 戻り値のuint8は読み出したオクテット数
+func readNLRI(b []byte, addrLen int) (*net.IPNet, uint8, error) {
+	ones := int(b[0])
+	l, err := nlriLen(ones, addrLen*8)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b) < int(l) {
+		return nil, 0, fmt.Errorf("NLRIのByte列が短すぎます: %v", b)
+	}
+	n := make(net.IP, addrLen)
+	copy(n, b[1:l])
+	return &net.IPNet{
+		IP:   n,
+		Mask: net.CIDRMask(ones, addrLen*8),
+	}, l, nil
+}
+
+func samePrefix(nw *net.IPNet, o Prefix) bool {
+	if o == nil {
+		return false
+	}
+	on := o.Net()
+	nwOnes, _ := nw.Mask.Size()
+	oOnes, _ := on.Mask.Size()
+	return nw.IP.Equal(on.IP) && nwOnes == oOnes
+}
+
 type IPv4Net struct {
 	*net.IPNet
 	len uint8
@@ -13,68 +101,60 @@ type IPv4Net struct {
 func NewIPv4Net(nw *net.IPNet) (*IPv4Net, error) {
 	nw.IP = nw.IP.To4()
 	if nw.IP == nil {
-		return nil, fmt.Errorf("IPv4アドレスにのみ対応しています: %v", nw)
+		return nil, fmt.Errorf("IPv4アドレスではありません: %v", nw)
 	}
 	ipv4nw := &IPv4Net{
 		IPNet: nw,
 	}
-	ones, _ := nw.Mask.Size()
-	switch {
-	case ones == 0:
-		ipv4nw.len = 1
-	case ones <= 8:
-		ipv4nw.len = 2
-	case ones <= 16:
-		ipv4nw.len = 3
-	case ones <= 24:
-		ipv4nw.len = 4
-	case ones <= 32:
-		ipv4nw.len = 5
-	default:
+	ones, bits := nw.Mask.Size()
+	if bits != 32 {
+		return nil, fmt.Errorf("prefixが不正です: %v", nw)
+	}
+	l, err := nlriLen(ones, bits)
+	if err != nil {
 		return nil, fmt.Errorf("prefixが不正です: %v", nw)
 	}
+	ipv4nw.len = l
 	return ipv4nw, nil
 }
 
 func NewIPv4NetsFromBytes(b []byte) ([]*IPv4Net, error) {
 	var nws []*IPv4Net
 	for len(b) > 0 {
-		ones := int(b[0])
-		var len uint8
-		switch {
-		case ones == 0:
-			len = 1
-		case ones <= 8:
-			len = 2
-		case ones <= 16:
-			len = 3
-		case ones <= 24:
-			len = 4
-		case ones <= 32:
-			len = 5
-		default:
-			return nil, fmt.Errorf("prefixが不正です: %v", ones)
-		}
-		n := make([]byte, 4)
-		copy(n, b[1:len])
-		nw := net.IPNet{
-			IP:   net.IPv4(n[0], n[1], n[2], n[3]),
-			Mask: net.CIDRMask(ones, 32),
+		nw, l, err := readNLRI(b, net.IPv4len)
+		if err != nil {
+			return nil, err
 		}
-		b = b[len:]
+		b = b[l:]
 		nnw := &IPv4Net{
-			IPNet: &nw,
-			len:   len,
+			IPNet: nw,
+			len:   l,
 		}
 		nws = append(nws, nnw)
 	}
 	return nws, nil
 }
 
+func (*IPv4Net) AFI() bgp.AFI {
+	return bgp.AFIIPv4
+}
+
+func (nw *IPv4Net) Net() *net.IPNet {
+	return nw.IPNet
+}
+
 func (i *IPv4Net) Len() uint8 {
 	return i.len
 }
 
+// 同じPrefixであるかを返す
+func (nw *IPv4Net) Equal(o Prefix) bool {
+	if nw == nil || o == nil {
+		return false
+	}
+	return o.AFI() == bgp.AFIIPv4 && samePrefix(nw.IPNet, o)
+}
+
 func (nw *IPv4Net) MarshalBytes() ([]byte, error) {
 	b := make([]byte, nw.len)
 	ones, _ := nw.Mask.Size()
@@ -86,3 +166,76 @@ func (nw *IPv4Net) MarshalBytes() ([]byte, error) {
 func (nw *IPv4Net) String() string {
 	return fmt.Sprintf("%s/%d len:%d", nw.IPNet.IP, nw.IPNet.Mask, nw.len)
 }
+
+type IPv6Net struct {
+	*net.IPNet
+	len uint8
+}
+
+func NewIPv6Net(nw *net.IPNet) (*IPv6Net, error) {
+	if nw.IP.To4() != nil || nw.IP.To16() == nil {
+		return nil, fmt.Errorf("IPv6アドレスではありません: %v", nw)
+	}
+	nw.IP = nw.IP.To16()
+	ones, bits := nw.Mask.Size()
+	if bits != 128 {
+		return nil, fmt.Errorf("prefixが不正です: %v", nw)
+	}
+	l, err := nlriLen(ones, bits)
+	if err != nil {
+		return nil, fmt.Errorf("prefixが不正です: %v", nw)
+	}
+	return &IPv6Net{
+		IPNet: nw,
+		len:   l,
+	}, nil
+}
+
+func NewIPv6NetsFromBytes(b []byte) ([]*IPv6Net, error) {
+	var nws []*IPv6Net
+	for len(b) > 0 {
+		nw, l, err := readNLRI(b, net.IPv6len)
+		if err != nil {
+			return nil, err
+		}
+		b = b[l:]
+		nws = append(nws, &IPv6Net{
+			IPNet: nw,
+			len:   l,
+		})
+	}
+	return nws, nil
+}
+
+func (*IPv6Net) AFI() bgp.AFI {
+	return bgp.AFIIPv6
+}
+
+func (nw *IPv6Net) Net() *net.IPNet {
+	return nw.IPNet
+}
+
+func (nw *IPv6Net) Len() uint8 {
+	return nw.len
+}
+
+// 同じPrefixであるかを返す
+func (nw *IPv6Net) Equal(o Prefix) bool {
+	if nw == nil || o == nil {
+		return false
+	}
+	return o.AFI() == bgp.AFIIPv6 && samePrefix(nw.IPNet, o)
+}
+
+func (nw *IPv6Net) MarshalBytes() ([]byte, error) {
+	b := make([]byte, nw.len)
+	ones, _ := nw.Mask.Size()
+	b[0] = byte(ones)
+	copy(b[1:], nw.IP.To16())
+	return b, nil
+}
+
+func (nw *IPv6Net) String() string {
+	ones, _ := nw.Mask.Size()
+	return fmt.Sprintf("%s/%d len:%d", nw.IPNet.IP, ones, nw.len)
+}
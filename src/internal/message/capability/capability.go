@@ -0,0 +1,114 @@
+package capability
+
+import "fmt"
+
+// OPEN MessageのCapabilities Optional Parameter(RFC 5492)で広告されるCapability
+// (https://datatracker.ietf.org/doc/html/rfc5492#section-4)
+type Capability interface {
+	Code() Code
+	// Capability Valueのバイト列を返す
+	Value() []byte
+}
+
+// Capability Code
+// (https://www.iana.org/assignments/capability-codes)
+type Code uint8
+
+//go:generate stringer -type=Code capability.go
+const (
+	// RFC 4760
+	Multiprotocol Code = 1
+	// RFC 2918
+	RouteRefresh Code = 2
+	// RFC 8654
+	ExtendedMessage Code = 6
+	// RFC 6793
+	FourOctetAS Code = 65
+	// RFC 7313
+	EnhancedRouteRefresh Code = 70
+)
+
+// 値の一致までネゴシエーションに必要なCapabilityが実装する
+// 実装していないCapabilityは、Codeが一致すればネゴシエーションできたとみなす。
+type matcher interface {
+	match(Capability) bool
+}
+
+// Capability ValueからCapabilityを生成する関数
+type decoder func(v []byte) (Capability, error)
+
+// Capability Codeごとのdecoder
+// 登録されていないCodeのCapabilityはUnknownとして保持する。
+var decoders = map[Code]decoder{
+	Multiprotocol:        decodeMultiprotocol,
+	RouteRefresh:         decodeRouteRefresh,
+	ExtendedMessage:      decodeExtendedMessage,
+	FourOctetAS:          decodeFourOctetAS,
+	EnhancedRouteRefresh: decodeEnhancedRouteRefresh,
+}
+
+// CapabilityをCapability Code, Capability Length, Capability Valueの
+// バイト列に変換する
+func MarshalBytes(c Capability) ([]byte, error) {
+	v := c.Value()
+	if len(v) > 0xff {
+		return nil, fmt.Errorf("capability value is too long: %v, %d", c.Code(), len(v))
+	}
+	b := []byte{uint8(c.Code()), uint8(len(v))}
+	return append(b, v...), nil
+}
+
+// Capabilities Optional ParameterのParameter Valueから、
+// Capabilityのリストを生成する
+func NewCapabilitiesFromBytes(b []byte) ([]Capability, error) {
+	var caps []Capability
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("invalid capability length: %d", len(b))
+		}
+		code := Code(b[0])
+		l := int(b[1])
+		if len(b) < 2+l {
+			return nil, fmt.Errorf("capability is too short: %v, %d", code, len(b))
+		}
+		// 受信したByte列を保持しないようにコピーする
+		v := make([]byte, l)
+		copy(v, b[2:2+l])
+		d, ok := decoders[code]
+		if !ok {
+			caps = append(caps, Unknown{code: code, value: v})
+			b = b[2+l:]
+			continue
+		}
+		c, err := d(v)
+		if err != nil {
+			return nil, err
+		}
+		caps = append(caps, c)
+		b = b[2+l:]
+	}
+	return caps, nil
+}
+
+// Registryに登録されていないCapability
+// 受信したCapability Code, Capability Valueをそのまま保持する。
+type Unknown struct {
+	code  Code
+	value []byte
+}
+
+func NewUnknown(code Code, v []byte) Unknown {
+	return Unknown{code: code, value: v}
+}
+
+func (u Unknown) Code() Code {
+	return u.code
+}
+
+func (u Unknown) Value() []byte {
+	return u.value
+}
+
+func (u Unknown) String() string {
+	return fmt.Sprintf("Unknown{code: %d, value: %v}", u.code, u.value)
+}
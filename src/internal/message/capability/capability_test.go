@@ -0,0 +1,121 @@
+package capability
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+func TestCapabilitiesFromBytes(t *testing.T) {
+	b := []byte{
+		0x02, 0x00, // Route Refresh
+		0x80, 0x02, 0xab, 0xcd, // 未知のCapability
+		0x46, 0x00, // Enhanced Route Refresh
+		0x41, 0x04, 0xfa, 0x56, 0xea, 0x01, // 4-octet AS(4200000001)
+		0x01, 0x04, 0x00, 0x02, 0x00, 0x01, // Multiprotocol(IPv6 Unicast)
+	}
+	caps, err := NewCapabilitiesFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Capability{
+		RouteRefreshCap{},
+		NewUnknown(0x80, []byte{0xab, 0xcd}),
+		EnhancedRouteRefreshCap{},
+		NewFourOctetAS(4200000001),
+		NewMultiprotocol(bgp.IPv6Unicast),
+	}
+	if len(caps) != len(want) {
+		t.Fatalf("len(caps) = %d, want %d", len(caps), len(want))
+	}
+	var got []byte
+	for i, c := range caps {
+		if c.Code() != want[i].Code() || !bytes.Equal(c.Value(), want[i].Value()) {
+			t.Errorf("caps[%d] = %v, want %v", i, c, want[i])
+		}
+		cb, err := MarshalBytes(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, cb...)
+	}
+	// 未知のCapabilityもそのまま再送できる
+	if !bytes.Equal(got, b) {
+		t.Errorf("MarshalBytes() = %v, want %v", got, b)
+	}
+}
+
+func TestCapabilitiesFromInvalidBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "short", b: []byte{0x02}},
+		{name: "too long length", b: []byte{0x80, 0x03, 0x00}},
+		{name: "invalid route refresh", b: []byte{0x02, 0x01, 0x00}},
+		{name: "invalid 4-octet AS", b: []byte{0x41, 0x02, 0xfd, 0xe8}},
+		{name: "invalid multiprotocol", b: []byte{0x01, 0x02, 0x00, 0x02}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewCapabilitiesFromBytes(tc.b); err == nil {
+				t.Errorf("%s: want error, got nil", tc.name)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	local := []Capability{RouteRefreshCap{}, EnhancedRouteRefreshCap{}}
+	remote := []Capability{RouteRefreshCap{}, NewUnknown(0x80, nil)}
+	s := Negotiate(local, remote)
+	if !s.Has(RouteRefresh) {
+		t.Errorf("route refresh is not negotiated: %v", s)
+	}
+	if s.Has(EnhancedRouteRefresh) || s.Has(0x80) {
+		t.Errorf("unexpected capability is negotiated: %v", s)
+	}
+	missing := s.Missing(local, []Code{RouteRefresh, EnhancedRouteRefresh})
+	if len(missing) != 1 || missing[0].Code() != EnhancedRouteRefresh {
+		t.Errorf("Missing() = %v, want [EnhancedRouteRefresh]", missing)
+	}
+}
+
+func TestNegotiateMultiprotocol(t *testing.T) {
+	local := []Capability{
+		NewMultiprotocol(bgp.IPv4Unicast),
+		NewMultiprotocol(bgp.IPv6Unicast),
+	}
+	tests := []struct {
+		name   string
+		remote []Capability
+		want   []bgp.Family
+	}{
+		{
+			name:   "dual stack",
+			remote: local,
+			want:   []bgp.Family{bgp.IPv4Unicast, bgp.IPv6Unicast},
+		},
+		{
+			name:   "ipv6 only",
+			remote: []Capability{NewMultiprotocol(bgp.IPv6Unicast)},
+			want:   []bgp.Family{bgp.IPv6Unicast},
+		},
+		{
+			// Multiprotocol Extensionsを広告しない対向機器とはIPv4 Unicastのみを扱う
+			name:   "not advertised",
+			remote: []Capability{RouteRefreshCap{}},
+			want:   []bgp.Family{bgp.IPv4Unicast},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Negotiate(local, tc.remote).Families()
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("Families() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package capability
+
+import "fmt"
+
+// Extended Message Capability(RFC 8654)
+// OPEN, KEEPALIVE Message以外のBGP Messageの最大長を65535byteに拡張する。
+// Capability Valueは持たない。
+type ExtendedMessageCap struct{}
+
+func (ExtendedMessageCap) Code() Code {
+	return ExtendedMessage
+}
+
+func (ExtendedMessageCap) Value() []byte {
+	return []byte{}
+}
+
+func (ExtendedMessageCap) String() string {
+	return "ExtendedMessage"
+}
+
+func decodeExtendedMessage(v []byte) (Capability, error) {
+	if len(v) != 0 {
+		return nil, fmt.Errorf("invalid extended message capability length: %d", len(v))
+	}
+	return ExtendedMessageCap{}, nil
+}
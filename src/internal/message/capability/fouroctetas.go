@@ -0,0 +1,42 @@
+package capability
+
+import (
+	"fmt"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// Support for 4-octet AS Number Capability(RFC 6793)
+// Capability Valueとして、自身のAS番号を4octetで保持する。
+type FourOctetASCap struct {
+	as bgp.ASNumber
+}
+
+func NewFourOctetAS(as bgp.ASNumber) FourOctetASCap {
+	return FourOctetASCap{as: as}
+}
+
+func (FourOctetASCap) Code() Code {
+	return FourOctetAS
+}
+
+func (c FourOctetASCap) Value() []byte {
+	as := c.as.Uint32()
+	return []byte{uint8(as >> 24), uint8(as >> 16), uint8(as >> 8), uint8(as)}
+}
+
+func (c FourOctetASCap) AS() bgp.ASNumber {
+	return c.as
+}
+
+func (c FourOctetASCap) String() string {
+	return fmt.Sprintf("FourOctetAS{as: %d}", c.as)
+}
+
+func decodeFourOctetAS(v []byte) (Capability, error) {
+	if len(v) != 4 {
+		return nil, fmt.Errorf("invalid 4-octet AS capability length: %d", len(v))
+	}
+	as := uint32(v[0])<<24 | uint32(v[1])<<16 | uint32(v[2])<<8 | uint32(v[3])
+	return FourOctetASCap{as: bgp.ASNumber(as)}, nil
+}
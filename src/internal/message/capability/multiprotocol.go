@@ -0,0 +1,51 @@
+package capability
+
+import (
+	"fmt"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// Multiprotocol Extensions Capability(RFC 4760)
+// Capability Valueとして、AFI(2octet), Reserved(1octet), SAFI(1octet)を持つ。
+// AFI/SAFIごとに1つのCapabilityを広告する。
+type MultiprotocolCap struct {
+	family bgp.Family
+}
+
+func NewMultiprotocol(f bgp.Family) MultiprotocolCap {
+	return MultiprotocolCap{family: f}
+}
+
+func (MultiprotocolCap) Code() Code {
+	return Multiprotocol
+}
+
+func (c MultiprotocolCap) Value() []byte {
+	afi := c.family.AFI
+	return []byte{uint8(afi >> 8), uint8(afi), 0, uint8(c.family.SAFI)}
+}
+
+func (c MultiprotocolCap) Family() bgp.Family {
+	return c.family
+}
+
+func (c MultiprotocolCap) String() string {
+	return fmt.Sprintf("Multiprotocol{%v}", c.family)
+}
+
+// AFI/SAFIが一致する場合のみネゴシエーションできる
+func (c MultiprotocolCap) match(o Capability) bool {
+	m, ok := o.(MultiprotocolCap)
+	return ok && m.family == c.family
+}
+
+func decodeMultiprotocol(v []byte) (Capability, error) {
+	if len(v) != 4 {
+		return nil, fmt.Errorf("invalid multiprotocol capability length: %d", len(v))
+	}
+	return MultiprotocolCap{family: bgp.Family{
+		AFI:  bgp.AFI(uint16(v[0])<<8 | uint16(v[1])),
+		SAFI: bgp.SAFI(v[3]),
+	}}, nil
+}
@@ -0,0 +1,49 @@
+package capability
+
+import "fmt"
+
+// Route Refresh Capability(RFC 2918)
+// Capability Valueは持たない。
+type RouteRefreshCap struct{}
+
+func (RouteRefreshCap) Code() Code {
+	return RouteRefresh
+}
+
+func (RouteRefreshCap) Value() []byte {
+	return []byte{}
+}
+
+func (RouteRefreshCap) String() string {
+	return "RouteRefresh"
+}
+
+func decodeRouteRefresh(v []byte) (Capability, error) {
+	if len(v) != 0 {
+		return nil, fmt.Errorf("invalid route refresh capability length: %d", len(v))
+	}
+	return RouteRefreshCap{}, nil
+}
+
+// Enhanced Route Refresh Capability(RFC 7313)
+// Capability Valueは持たない。
+type EnhancedRouteRefreshCap struct{}
+
+func (EnhancedRouteRefreshCap) Code() Code {
+	return EnhancedRouteRefresh
+}
+
+func (EnhancedRouteRefreshCap) Value() []byte {
+	return []byte{}
+}
+
+func (EnhancedRouteRefreshCap) String() string {
+	return "EnhancedRouteRefresh"
+}
+
+func decodeEnhancedRouteRefresh(v []byte) (Capability, error) {
+	if len(v) != 0 {
+		return nil, fmt.Errorf("invalid enhanced route refresh capability length: %d", len(v))
+	}
+	return EnhancedRouteRefreshCap{}, nil
+}
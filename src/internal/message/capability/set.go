@@ -0,0 +1,93 @@
+package capability
+
+import (
+	"slices"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// ネゴシエーションしたCapabilityの集合
+type Set []Capability
+
+// 自身と対向機器の両方が広告したCapabilityを返す
+// Capability Valueは対向機器が広告したものを保持する。
+func Negotiate(local, remote []Capability) Set {
+	s := Set{}
+	for _, r := range remote {
+		for _, l := range local {
+			if matches(l, r) {
+				s = append(s, r)
+				break
+			}
+		}
+	}
+	return s
+}
+
+func matches(l, r Capability) bool {
+	if l.Code() != r.Code() {
+		return false
+	}
+	if m, ok := l.(matcher); ok {
+		return m.match(r)
+	}
+	return true
+}
+
+// Capability Codeがネゴシエーションされているかを返す
+func (s Set) Has(code Code) bool {
+	for _, c := range s {
+		if c.Code() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Capability Codeに対応する、対向機器が広告したCapabilityを返す
+func (s Set) Get(code Code) (Capability, bool) {
+	for _, c := range s {
+		if c.Code() == code {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// 自身が広告したCapabilityのうち、
+// Codeがrequiredに含まれ、ネゴシエーションされなかったものを返す
+func (s Set) Missing(local []Capability, required []Code) []Capability {
+	var missing []Capability
+	for _, l := range local {
+		if !slices.Contains(required, l.Code()) {
+			continue
+		}
+		found := false
+		for _, c := range s {
+			if matches(l, c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, l)
+		}
+	}
+	return missing
+}
+
+// ネゴシエーションしたAFI/SAFIを返す
+// Multiprotocol Extensions Capabilityを1つもネゴシエーションしていない場合は、
+// IPv4 Unicastのみを扱う(RFC 4760 8章)。
+func (s Set) Families() []bgp.Family {
+	var fs []bgp.Family
+	for _, c := range s {
+		if m, ok := c.(MultiprotocolCap); ok {
+			fs = append(fs, m.Family())
+		}
+	}
+	if len(fs) == 0 {
+		return []bgp.Family{bgp.IPv4Unicast}
+	}
+	return fs
+}
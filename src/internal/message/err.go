@@ -1,18 +1,64 @@
 package message
 
-import "fmt"
+import (
+	"fmt"
 
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
+)
+
+// BytesからMessageへの変換に失敗したことを表すエラー
+// 対向機器に送信するNOTIFICATION Messageを生成できるように、
+// RFC 4271 6章で定められたError Code, Error Subcode, Dataを保持する。
 type ConvMsgErr struct {
-	Err error
+	Err     error
+	Code    ErrorCode
+	Subcode ErrorSubcode
+	Data    []byte
 }
 
 func (e ConvMsgErr) Error() string {
 	return e.Err.Error()
 }
 
-func NewConvMsgErr(s string) ConvMsgErr {
+func (e ConvMsgErr) Unwrap() error {
+	return e.Err
+}
+
+func NewConvMsgErr(
+	code ErrorCode,
+	subcode ErrorSubcode,
+	data []byte,
+	s string,
+) ConvMsgErr {
 	err := fmt.Errorf("BytesからMessageへの変換に失敗しました: %s", s)
-	return ConvMsgErr{Err: err}
+	return ConvMsgErr{
+		Err:     err,
+		Code:    code,
+		Subcode: subcode,
+		Data:    data,
+	}
+}
+
+// pathattributeパッケージのエラーをUPDATE Message ErrorのConvMsgErrに変換する
+func newUpdateAttrErr(err error) ConvMsgErr {
+	if ae, ok := err.(pathattribute.AttrErr); ok {
+		return ConvMsgErr{
+			Err:     fmt.Errorf("BytesからMessageへの変換に失敗しました: %w", ae.Err),
+			Code:    UpdateMessageError,
+			Subcode: ErrorSubcode(ae.Subcode),
+			Data:    ae.Data,
+		}
+	}
+	return ConvMsgErr{
+		Err:     fmt.Errorf("BytesからMessageへの変換に失敗しました: %w", err),
+		Code:    UpdateMessageError,
+		Subcode: MalformedAttributeList,
+	}
+}
+
+// エラーの内容を対向機器に通知するNOTIFICATION Messageを生成する
+func (e ConvMsgErr) NotificationMsg() (*NotificationMessage, error) {
+	return NewNotificationMsg(e.Code, e.Subcode, e.Data)
 }
 
 type ConvBytesErr struct {
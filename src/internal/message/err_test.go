@@ -0,0 +1,228 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
+)
+
+func marker() []byte {
+	return bytes.Repeat([]byte{0xff}, 16)
+}
+
+// 不正なByte列をUnMarshalしたとき、
+// RFC 4271 6章で定められたError Code, Error Subcodeが返ることを確認する
+// セッションを切断しないPathAttributeのエラー(RFC 7606)は、
+// UpdateMessageにErrActionとともに記録されることを確認する
+func TestUnMarshalErrorCode(t *testing.T) {
+	keepalive := append(marker(), 0x00, 0x13, 0x04)
+	badMarker := append([]byte{}, keepalive...)
+	badMarker[0] = 0x00
+	// Header + Withdrawn Routes Length + Total Path Attribute Length + NLRI
+	update := func(pa []byte, nlri []byte) []byte {
+		l := 19 + 2 + 2 + len(pa) + len(nlri)
+		b := append(marker(), uint8(l>>8), uint8(l), 0x02)
+		b = append(b, 0x00, 0x00, uint8(len(pa)>>8), uint8(len(pa)))
+		b = append(b, pa...)
+		return append(b, nlri...)
+	}
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	asPath := []byte{0x40, 0x02, 0x04, 0x02, 0x01, 0xfd, 0xe9}
+	nextHop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	nlri := []byte{0x18, 0x0a, 0x64, 0xdc}
+	concat := func(bs ...[]byte) []byte {
+		var r []byte
+		for _, b := range bs {
+			r = append(r, b...)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		b       []byte
+		code    ErrorCode
+		subcode ErrorSubcode
+		data    []byte
+		// セッションを切断しない場合のErrAction
+		action pathattribute.ErrAction
+	}{
+		{
+			name:    "bad marker",
+			b:       badMarker,
+			code:    MessageHeaderError,
+			subcode: ConnectionNotSynchronized,
+		},
+		{
+			name:    "bad message length",
+			b:       append(marker(), 0x00, 0x14, 0x04, 0x00),
+			code:    MessageHeaderError,
+			subcode: BadMessageLength,
+			data:    []byte{0x00, 0x14},
+		},
+		{
+			name:    "bad message type",
+			b:       append(marker(), 0x00, 0x13, 0x07),
+			code:    MessageHeaderError,
+			subcode: BadMessageType,
+			data:    []byte{0x07},
+		},
+		{
+			name: "unsupported version",
+			b: append(marker(), 0x00, 0x1d, 0x01,
+				0x03, 0xfc, 0x00, 0x00, 0x00, 0x7f, 0x00, 0x00, 0x01, 0x00),
+			code:    OpenMessageError,
+			subcode: UnsupportedVersionNumber,
+			data:    []byte{0x00, 0x04},
+		},
+		{
+			name: "unacceptable hold time",
+			b: append(marker(), 0x00, 0x1d, 0x01,
+				0x04, 0xfc, 0x00, 0x00, 0x02, 0x7f, 0x00, 0x00, 0x01, 0x00),
+			code:    OpenMessageError,
+			subcode: UnacceptableHoldTime,
+		},
+		{
+			name: "unsupported optional parameter",
+			b: append(marker(), 0x00, 0x1f, 0x01,
+				0x04, 0xfc, 0x00, 0x00, 0x5a, 0x7f, 0x00, 0x00, 0x01, 0x02,
+				0x01, 0x00),
+			code:    OpenMessageError,
+			subcode: UnsupportedOptionalParameter,
+		},
+		{
+			name:    "invalid route refresh length",
+			b:       append(marker(), 0x00, 0x18, 0x05, 0x00, 0x01, 0x00, 0x01, 0x00),
+			code:    RouteRefreshMessageError,
+			subcode: InvalidMessageLength,
+			data:    append(marker(), 0x00, 0x18, 0x05, 0x00, 0x01, 0x00, 0x01, 0x00),
+		},
+		{
+			name:    "malformed as path",
+			b:       update(concat(origin, []byte{0x40, 0x02, 0x04, 0x02, 0x03, 0xfd, 0xe9}, nextHop), nlri),
+			code:    UpdateMessageError,
+			subcode: MalformedASPath,
+			action:  pathattribute.TreatAsWithdraw,
+		},
+		{
+			name:    "invalid next hop",
+			b:       update(concat(origin, asPath, []byte{0x40, 0x03, 0x04, 0x00, 0x00, 0x00, 0x00}), nlri),
+			code:    UpdateMessageError,
+			subcode: InvalidNextHopAttribute,
+			data:    []byte{0x40, 0x03, 0x04, 0x00, 0x00, 0x00, 0x00},
+			action:  pathattribute.TreatAsWithdraw,
+		},
+		{
+			name:    "invalid origin",
+			b:       update(concat([]byte{0x40, 0x01, 0x01, 0x03}, asPath, nextHop), nlri),
+			code:    UpdateMessageError,
+			subcode: InvalidOriginAttribute,
+			data:    []byte{0x40, 0x01, 0x01, 0x03},
+			action:  pathattribute.TreatAsWithdraw,
+		},
+		{
+			name:    "attribute flags error",
+			b:       update(concat([]byte{0xc0, 0x01, 0x01, 0x00}, asPath, nextHop), nlri),
+			code:    UpdateMessageError,
+			subcode: AttributeFlagsError,
+			data:    []byte{0xc0, 0x01, 0x01, 0x00},
+			action:  pathattribute.TreatAsWithdraw,
+		},
+		{
+			name:    "missing well-known attribute",
+			b:       update(concat(origin, asPath), nlri),
+			code:    UpdateMessageError,
+			subcode: MissingWellKnownAttribute,
+			data:    []byte{0x03},
+			action:  pathattribute.TreatAsWithdraw,
+		},
+		{
+			// 認識できないWell-knownなPathAttribute(Type Code 200)は、セッションを切断する
+			name:    "unrecognized well-known attribute",
+			b:       update(concat(origin, asPath, nextHop, []byte{0x40, 0xc8, 0x01, 0x00}), nlri),
+			code:    UpdateMessageError,
+			subcode: UnrecognizedWellKnownAttribute,
+			data:    []byte{0x40, 0xc8, 0x01, 0x00},
+		},
+		{
+			// 対応していないAFI(3)のMP_REACH_NLRI
+			name:    "optional attribute error",
+			b:       update(concat(origin, asPath, []byte{0x80, 0x0e, 0x05, 0x00, 0x03, 0x01, 0x00, 0x00}), nil),
+			code:    UpdateMessageError,
+			subcode: OptionalAttributeError,
+			data:    []byte{0x80, 0x0e, 0x05, 0x00, 0x03, 0x01, 0x00, 0x00},
+		},
+		{
+			name:    "malformed atomic aggregate",
+			b:       update(concat(origin, asPath, nextHop, []byte{0x40, 0x06, 0x01, 0x00}), nlri),
+			code:    UpdateMessageError,
+			subcode: AttributeLengthError,
+			data:    []byte{0x40, 0x06, 0x01, 0x00},
+			action:  pathattribute.AttributeDiscard,
+		},
+		{
+			name:    "duplicate attribute",
+			b:       update(concat(origin, origin, asPath, nextHop), nlri),
+			code:    UpdateMessageError,
+			subcode: MalformedAttributeList,
+			action:  pathattribute.AttributeDiscard,
+		},
+		{
+			// Next Hopの長さが不正なIPv6 UnicastのMP_REACH_NLRI
+			name:    "malformed mp reach nlri",
+			b:       update(concat(origin, asPath, []byte{0x80, 0x0e, 0x05, 0x00, 0x02, 0x01, 0x10, 0x00}), nil),
+			code:    UpdateMessageError,
+			subcode: OptionalAttributeError,
+			data:    []byte{0x80, 0x0e, 0x05, 0x00, 0x02, 0x01, 0x10, 0x00},
+			action:  pathattribute.AFISAFIDisable,
+		},
+		{
+			name: "duplicate mp unreach nlri",
+			b: update(concat(origin, asPath,
+				[]byte{0x80, 0x0f, 0x03, 0x00, 0x02, 0x01}, []byte{0x80, 0x0f, 0x03, 0x00, 0x02, 0x01}), nil),
+			code:    UpdateMessageError,
+			subcode: MalformedAttributeList,
+		},
+		{
+			name:    "invalid network field",
+			b:       update(concat(origin, asPath, nextHop), []byte{0x21, 0x0a}),
+			code:    UpdateMessageError,
+			subcode: InvalidNetworkField,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := UnMarshal(tc.b)
+			if tc.action != 0 {
+				if err != nil {
+					t.Fatalf("%s: want no error, got %v", tc.name, err)
+				}
+				u := m.(*UpdateMessage)
+				errs := u.AttrErrors()
+				if u.ErrAction() != tc.action || len(errs) != 1 {
+					t.Fatalf("%s: want %v, got %v %v", tc.name, tc.action, u.ErrAction(), errs)
+				}
+				if ErrorSubcode(errs[0].Subcode) != tc.subcode {
+					t.Errorf("%s: want subcode %d, got %d", tc.name, tc.subcode, errs[0].Subcode)
+				}
+				if tc.data != nil && !bytes.Equal(errs[0].Data, tc.data) {
+					t.Errorf("%s: want data %v, got %v", tc.name, tc.data, errs[0].Data)
+				}
+				return
+			}
+			var cme ConvMsgErr
+			if !errors.As(err, &cme) {
+				t.Fatalf("%s: want ConvMsgErr, got %v", tc.name, err)
+			}
+			if cme.Code != tc.code || cme.Subcode != tc.subcode {
+				t.Errorf("%s: want %v/%d, got %v/%d",
+					tc.name, tc.code, tc.subcode, cme.Code, cme.Subcode)
+			}
+			if tc.data != nil && !bytes.Equal(cme.Data, tc.data) {
+				t.Errorf("%s: want data %v, got %v", tc.name, tc.data, cme.Data)
+			}
+		})
+	}
+}
@@ -29,18 +29,35 @@ func (h *Header) marshalBytes() ([]byte, error) {
 }
 
 func (h *Header) unMarshalBytes(b []byte) error {
+	return h.unMarshal(b, MaxMsgLen)
+}
+
+// Lengthの最大長(maxLen)を指定して、HeaderのByte列を変換する
+func (h *Header) unMarshal(b []byte, maxLen uint16) error {
 	// Headerの長さは19byte
 	if len(b) != 19 {
-		return NewConvMsgErr(fmt.Sprintf("HeaderのByte列が短すぎます: %d", len(b)))
+		return NewConvMsgErr(
+			MessageHeaderError, BadMessageLength, nil,
+			fmt.Sprintf("HeaderのByte列が短すぎます: %d", len(b)),
+		)
 	}
 	// Marker
 	for i := 0; i < 16; i++ {
 		if b[i] != 0xff {
-			return NewConvMsgErr(fmt.Sprintf("HeaderのMarkerが不正です:%v", b[:16]))
+			return NewConvMsgErr(
+				MessageHeaderError, ConnectionNotSynchronized, nil,
+				fmt.Sprintf("HeaderのMarkerが不正です:%v", b[:16]),
+			)
 		}
 	}
 	// Length
 	h.len = uint16(b[16])<<8 | uint16(b[17])
+	if h.len < 19 || h.len > maxLen {
+		return NewConvMsgErr(
+			MessageHeaderError, BadMessageLength, []byte{b[16], b[17]},
+			fmt.Sprintf("HeaderのLengthが不正です: %d", h.len),
+		)
+	}
 	// Type
 	t, err := newType(b[18])
 	if err != nil {
@@ -50,6 +67,31 @@ func (h *Header) unMarshalBytes(b []byte) error {
 	return nil
 }
 
+// Message Typeごとの長さの制約を満たしているかを確認する
+// RFC 4271 6.1で定められている。
+// OPEN, KEEPALIVE Message以外の最大長はmaxLenとする(RFC 8654)。
+func (h *Header) validLen(maxLen uint16) error {
+	min, max := uint16(19), maxLen
+	switch h.msgType {
+	case Open:
+		min, max = 29, MaxMsgLen
+	case Update:
+		min = 23
+	case Notification:
+		min = 21
+	case Keepalive:
+		max = 19
+	}
+	if h.len < min || h.len > max {
+		return NewConvMsgErr(
+			MessageHeaderError, BadMessageLength,
+			[]byte{uint8(h.len >> 8), uint8(h.len)},
+			fmt.Sprintf("%vのLengthが不正です: %d", h.msgType, h.len),
+		)
+	}
+	return nil
+}
+
 func (h *Header) String() string {
 	return fmt.Sprintf("Header{len: %d, type: %v}", h.len, h.msgType)
 }
@@ -38,7 +38,11 @@ func (k *KeepaliveMessage) unMarshalBytes(b []byte) error {
 		return nil
 	}
 	if len(b) != 0 {
-		return NewConvMsgErr(fmt.Sprintf("Keepalive MessageのByte列が不正です: %d", len(b)))
+		l := uint16(len(b) + 19)
+		return NewConvMsgErr(
+			MessageHeaderError, BadMessageLength, []byte{uint8(l >> 8), uint8(l)},
+			fmt.Sprintf("Keepalive MessageのByte列が不正です: %d", len(b)),
+		)
 	}
 	return nil
 }
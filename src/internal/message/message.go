@@ -1,19 +1,36 @@
 package message
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
+)
 
 type Type uint8
 
 //go:generate stringer -type=Type message.go
 const (
-	Open      Type = 1
-	Update    Type = 2
-	Keepalive Type = 4
+	Open         Type = 1
+	Update       Type = 2
+	Notification Type = 3
+	Keepalive    Type = 4
+	// RFC 2918で定められている。
+	RouteRefresh Type = 5
 )
 
+// BGP Messageの最大長(Headerを含む)
+const MaxMsgLen = 4096
+
+// Extended Message Capability(RFC 8654)をネゴシエーションした場合の、
+// OPEN, KEEPALIVE Message以外のBGP Messageの最大長
+const MaxExtendedMsgLen = 65535
+
 func newType(t uint8) (Type, error) {
-	if t <= 0 || t > 4 {
-		return 0, NewConvMsgErr(fmt.Sprintf("BGPのTypeは1-4が期待されています: %d", t))
+	if t <= 0 || t > 5 {
+		return 0, NewConvMsgErr(
+			MessageHeaderError, BadMessageType, []byte{t},
+			fmt.Sprintf("BGPのTypeは1-5が期待されています: %d", t),
+		)
 	}
 	return Type(t), nil
 }
@@ -28,9 +45,13 @@ type Message interface {
 type version uint8
 
 func newVersion(v uint8) (version, error) {
-	if v > 4 {
+	// 本実装はBGP-4のみに対応している。
+	// 対応していないVersionの場合は、対応しているVersionをDataとして通知する。
+	if v != uint8(defaultVersion) {
 		return defaultVersion, NewConvMsgErr(
-			fmt.Sprintf("BGPのVersionは1-4が期待されています: %d", v))
+			OpenMessageError, UnsupportedVersionNumber,
+			[]byte{0, uint8(defaultVersion)},
+			fmt.Sprintf("BGPのVersionは4が期待されています: %d", v))
 	}
 	return version(v), nil
 }
@@ -41,6 +62,13 @@ var defaultVersion = version(4)
 type holdtime uint16
 
 func newHoldtime(ht uint16) (holdtime, error) {
+	// Hold Timeは0または3秒以上でなければならない
+	if ht == 1 || ht == 2 {
+		return defaultHoldtime, NewConvMsgErr(
+			OpenMessageError, UnacceptableHoldTime, nil,
+			fmt.Sprintf("Hold Timeが不正です: %d", ht),
+		)
+	}
 	return holdtime(ht), nil
 }
 
@@ -52,16 +80,66 @@ func Marshal(m Message) ([]byte, error) {
 	return m.marshalBytes()
 }
 
-func UnMarshal(b []byte) (Message, error) {
+// UnMarshalのオプション
+// ネゴシエーションしたCapabilityによって、Messageの変換方法が変わる。
+type Option func(*options)
+
+type options struct {
+	pa pathattribute.DecodeOptions
+	// Extended Message Capabilityをネゴシエーションしているか
+	extended bool
+}
+
+// 4-octet AS Number Capabilityをネゴシエーションしている場合、
+// UPDATE MessageのAS番号を4octetとして変換する
+func WithFourOctetAS(v bool) Option {
+	return func(o *options) {
+		o.pa.FourOctetAS = v
+	}
+}
+
+// Extended Message Capabilityをネゴシエーションしている場合、
+// OPEN, KEEPALIVE Message以外は65535byteまでのMessageを受け付ける
+func WithExtendedMessage(v bool) Option {
+	return func(o *options) {
+		o.extended = v
+	}
+}
+
+// Messageの最大長を返す
+func (o *options) maxLen() uint16 {
+	if o.extended {
+		return MaxExtendedMsgLen
+	}
+	return MaxMsgLen
+}
+
+func UnMarshal(b []byte, opts ...Option) (Message, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
 	hLen := 19
 	if len(b) < hLen {
-		return nil, NewConvMsgErr(fmt.Sprintf("Byte列が短すぎます: %d", len(b)))
+		return nil, NewConvMsgErr(
+			MessageHeaderError, BadMessageLength, nil,
+			fmt.Sprintf("Byte列が短すぎます: %d", len(b)),
+		)
 	}
 	h := &Header{}
-	err := h.unMarshalBytes(b[:hLen])
+	err := h.unMarshal(b[:hLen], o.maxLen())
 	if err != nil {
 		return nil, err
 	}
+	if int(h.len) != len(b) {
+		return nil, NewConvMsgErr(
+			MessageHeaderError, BadMessageLength, b[16:18],
+			fmt.Sprintf("HeaderのLengthとByte列の長さが一致しません: %d, %d", h.len, len(b)),
+		)
+	}
+	if err := h.validLen(o.maxLen()); err != nil {
+		return nil, err
+	}
 	switch h.msgType {
 	case Open:
 		o := &OpenMessage{header: h}
@@ -72,11 +150,18 @@ func UnMarshal(b []byte) (Message, error) {
 		return o, nil
 	case Update:
 		u := &UpdateMessage{header: h}
-		err := u.unMarshalBytes(b[hLen:])
+		err := u.unMarshal(b[hLen:], o.pa)
 		if err != nil {
 			return nil, err
 		}
 		return u, nil
+	case Notification:
+		n := &NotificationMessage{header: h}
+		err := n.unMarshalBytes(b[hLen:])
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
 	case Keepalive:
 		k := &KeepaliveMessage{header: h}
 		err := k.unMarshalBytes(b[hLen:])
@@ -84,7 +169,17 @@ func UnMarshal(b []byte) (Message, error) {
 			return nil, err
 		}
 		return k, nil
+	case RouteRefresh:
+		r := &RouteRefreshMessage{header: h}
+		err := r.unMarshalBytes(b[hLen:])
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
 	default:
-		return nil, NewConvMsgErr(fmt.Sprintf("未知のMessage Typeです: %d", h.msgType))
+		return nil, NewConvMsgErr(
+			MessageHeaderError, BadMessageType, []byte{uint8(h.msgType)},
+			fmt.Sprintf("未知のMessage Typeです: %d", h.msgType),
+		)
 	}
 }
@@ -0,0 +1,199 @@
+package message
+
+import (
+	"fmt"
+)
+
+// NOTIFICATION MessageのError Code
+// (https://datatracker.ietf.org/doc/html/rfc4271#section-4.5)
+type ErrorCode uint8
+
+//go:generate stringer -type=ErrorCode notification.go
+const (
+	MessageHeaderError ErrorCode = 1
+	OpenMessageError   ErrorCode = 2
+	UpdateMessageError ErrorCode = 3
+	HoldTimerExpired   ErrorCode = 4
+	FSMError           ErrorCode = 5
+	Cease              ErrorCode = 6
+	// RFC 7313で定められている。
+	RouteRefreshMessageError ErrorCode = 7
+)
+
+// NOTIFICATION MessageのError Subcode
+// Error Codeごとに意味が異なるため、Stringerは生成しない。
+// Subcodeが定義されていないError Codeでは0を使用する。
+type ErrorSubcode uint8
+
+const Unspecific ErrorSubcode = 0
+
+// Message Header Error(1)のSubcode
+const (
+	ConnectionNotSynchronized ErrorSubcode = 1
+	BadMessageLength          ErrorSubcode = 2
+	BadMessageType            ErrorSubcode = 3
+)
+
+// OPEN Message Error(2)のSubcode
+// 5(Authentication Failure)はRFC 4271で廃止されている。
+const (
+	UnsupportedVersionNumber     ErrorSubcode = 1
+	BadPeerAS                    ErrorSubcode = 2
+	BadBGPIdentifier             ErrorSubcode = 3
+	UnsupportedOptionalParameter ErrorSubcode = 4
+	UnacceptableHoldTime         ErrorSubcode = 6
+	// RFC 5492で定められている。
+	UnsupportedCapability ErrorSubcode = 7
+)
+
+// UPDATE Message Error(3)のSubcode
+// 7(AS Routing Loop)はRFC 4271で廃止されている。
+const (
+	MalformedAttributeList         ErrorSubcode = 1
+	UnrecognizedWellKnownAttribute ErrorSubcode = 2
+	MissingWellKnownAttribute      ErrorSubcode = 3
+	AttributeFlagsError            ErrorSubcode = 4
+	AttributeLengthError           ErrorSubcode = 5
+	InvalidOriginAttribute         ErrorSubcode = 6
+	InvalidNextHopAttribute        ErrorSubcode = 8
+	OptionalAttributeError         ErrorSubcode = 9
+	InvalidNetworkField            ErrorSubcode = 10
+	MalformedASPath                ErrorSubcode = 11
+)
+
+// Finite State Machine Error(5)のSubcode
+// RFC 6608で定められている。
+const (
+	UnexpectedMessageInOpenSent    ErrorSubcode = 1
+	UnexpectedMessageInOpenConfirm ErrorSubcode = 2
+	UnexpectedMessageInEstablished ErrorSubcode = 3
+)
+
+// Cease(6)のSubcode
+// RFC 4486で定められている。
+const (
+	MaximumNumberOfPrefixesReached ErrorSubcode = 1
+	AdministrativeShutdown         ErrorSubcode = 2
+	PeerDeConfigured               ErrorSubcode = 3
+	AdministrativeReset            ErrorSubcode = 4
+	ConnectionRejected             ErrorSubcode = 5
+	OtherConfigurationChange       ErrorSubcode = 6
+	ConnectionCollisionResolution  ErrorSubcode = 7
+	OutOfResources                 ErrorSubcode = 8
+)
+
+// ROUTE-REFRESH Message Error(7)のSubcode
+// RFC 7313で定められている。
+const InvalidMessageLength ErrorSubcode = 1
+
+type NotificationMessage struct {
+	header  *Header
+	code    ErrorCode
+	subcode ErrorSubcode
+	data    []byte
+}
+
+func (*NotificationMessage) Type() Type {
+	return Notification
+}
+
+func NewNotificationMsg(
+	code ErrorCode,
+	subcode ErrorSubcode,
+	data []byte,
+) (*NotificationMessage, error) {
+	// Header(19) + Error Code(1) + Error Subcode(1) + Data
+	l := 21 + len(data)
+	if l > MaxMsgLen {
+		return nil, NewConvBytesErr(
+			fmt.Sprintf("NOTIFICATION MessageのDataが長すぎます: %d", len(data)),
+		)
+	}
+	h, err := newHeader(uint16(l), Notification)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return &NotificationMessage{
+		header:  h,
+		code:    code,
+		subcode: subcode,
+		data:    data,
+	}, nil
+}
+
+func (n *NotificationMessage) ErrorCode() ErrorCode {
+	return n.code
+}
+
+func (n *NotificationMessage) ErrorSubcode() ErrorSubcode {
+	return n.subcode
+}
+
+func (n *NotificationMessage) Data() []byte {
+	return n.data
+}
+
+func (n *NotificationMessage) marshalBytes() ([]byte, error) {
+	b := make([]byte, 21, 21+len(n.data))
+	// Header
+	h, err := n.header.marshalBytes()
+	if err != nil {
+		return nil, err
+	}
+	copy(b, h)
+	// Error Code
+	b[19] = uint8(n.code)
+	// Error Subcode
+	b[20] = uint8(n.subcode)
+	// Data
+	b = append(b, n.data...)
+	return b, nil
+}
+
+func (n *NotificationMessage) unMarshalBytes(b []byte) error {
+	// NOTIFICATION Messageの長さは21byte以上
+	nLen := 21
+	hLen := 19
+	// Header
+	// message.goから利用する場合、Headerは作成済
+	if n.header == nil {
+		if len(b) < hLen {
+			return NewConvMsgErr(
+				MessageHeaderError, BadMessageLength, nil,
+				"NOTIFICATION MessageのByte列が短すぎます",
+			)
+		}
+		h := &Header{}
+		err := h.unMarshalBytes(b[:hLen])
+		if err != nil {
+			return err
+		}
+		n.header = h
+		b = b[hLen:]
+	}
+	nLen -= hLen
+	if len(b) < nLen {
+		return NewConvMsgErr(
+			MessageHeaderError, BadMessageLength, nil,
+			"NOTIFICATION MessageのByte列が短すぎます",
+		)
+	}
+	// Error Code
+	n.code = ErrorCode(b[0])
+	// Error Subcode
+	n.subcode = ErrorSubcode(b[1])
+	// Data
+	n.data = make([]byte, len(b)-nLen)
+	copy(n.data, b[nLen:])
+	return nil
+}
+
+func (n *NotificationMessage) String() string {
+	return fmt.Sprintf(
+		"NotificationMessage{header: %v, code: %v, subcode: %v, data: %v}",
+		n.header, n.code, n.subcode, n.data,
+	)
+}
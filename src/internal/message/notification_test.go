@@ -0,0 +1,68 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNotificationMessageMarshalAndUnmarshal(t *testing.T) {
+	n, err := NewNotificationMsg(
+		UpdateMessageError,
+		MalformedASPath,
+		[]byte{0x40, 0x02, 0x00},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	b, err := Marshal(n)
+	if err != nil {
+		t.Error(err)
+	}
+	n2, err := UnMarshal(b)
+	if err != nil {
+		t.Error(err)
+	}
+	if !notificationMsgEqual(n, n2.(*NotificationMessage), t) {
+		t.Errorf("notification message not equal: %v, %v", n, n2)
+	}
+}
+
+func TestNotificationMessageWithoutData(t *testing.T) {
+	n, err := NewNotificationMsg(Cease, Unspecific, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	b, err := Marshal(n)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(b) != 21 {
+		t.Errorf("notification message length = %d, want 21", len(b))
+	}
+	n2, err := UnMarshal(b)
+	if err != nil {
+		t.Error(err)
+	}
+	if !notificationMsgEqual(n, n2.(*NotificationMessage), t) {
+		t.Errorf("notification message not equal: %v, %v", n, n2)
+	}
+}
+
+func notificationMsgEqual(n1, n2 *NotificationMessage, t *testing.T) bool {
+	if !headerEqual(n1.header, n2.header, t) {
+		return false
+	}
+	if n1.code != n2.code {
+		t.Errorf("notification message code not equal: %v, %v", n1.code, n2.code)
+		return false
+	}
+	if n1.subcode != n2.subcode {
+		t.Errorf("notification message subcode not equal: %v, %v", n1.subcode, n2.subcode)
+		return false
+	}
+	if !bytes.Equal(n1.data, n2.data) {
+		t.Errorf("notification message data not equal: %v, %v", n1.data, n2.data)
+		return false
+	}
+	return true
+}
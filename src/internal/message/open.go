@@ -5,29 +5,46 @@ import (
 	"net"
 
 	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/message/capability"
 )
 
 type OpenMessage struct {
 	header   *Header
 	version  version
 	myAS     bgp.ASNumber
-	holdtime holdtime // 正常系のみ実装するので、実質的に使用しない
+	holdtime holdtime
 	bgpID    net.IP
 
-	// 使用しないが、受信用に念のため用意
 	optsLen uint8
 	opts    []byte
+	// Optional Parametersに含まれるCapability
+	caps []capability.Capability
 }
 
 func (*OpenMessage) Type() Type {
 	return Open
 }
 
-func NewOpenMsg(as bgp.ASNumber, ip net.IP) (*OpenMessage, error) {
-	h, err := newHeader(29, Open)
+func NewOpenMsg(
+	as bgp.ASNumber,
+	ip net.IP,
+	ht uint16,
+	caps []capability.Capability,
+) (*OpenMessage, error) {
+	opts, err := marshalOptParams(caps)
 	if err != nil {
 		return nil, err
 	}
+	h, err := newHeader(29+uint16(len(opts)), Open)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := newHoldtime(ht)
+	if err != nil {
+		return nil, NewConvBytesErr(
+			fmt.Sprintf("Hold Timeは0または3秒以上である必要があります: %d", ht),
+		)
+	}
 	ipv4 := ip.To4()
 	if ipv4 == nil {
 		return nil, NewConvBytesErr(
@@ -38,13 +55,32 @@ func NewOpenMsg(as bgp.ASNumber, ip net.IP) (*OpenMessage, error) {
 		header:   h,
 		version:  defaultVersion,
 		myAS:     as,
-		holdtime: defaultHoldtime,
+		holdtime: hold,
 		bgpID:    ipv4,
-		optsLen:  0,
-		opts:     []byte{},
+		optsLen:  uint8(len(opts)),
+		opts:     opts,
+		caps:     caps,
 	}, nil
 }
 
+func (o *OpenMessage) MyAS() bgp.ASNumber {
+	return o.myAS
+}
+
+func (o *OpenMessage) BGPID() net.IP {
+	return o.bgpID
+}
+
+// 対向機器が広告したCapabilityを返す
+func (o *OpenMessage) Capabilities() []capability.Capability {
+	return o.caps
+}
+
+// Hold Timeの秒数を返す
+func (o *OpenMessage) HoldTime() uint16 {
+	return uint16(o.holdtime)
+}
+
 func (o *OpenMessage) marshalBytes() ([]byte, error) {
 	b := make([]byte, 29)
 	// Header
@@ -97,7 +133,11 @@ func (o *OpenMessage) unMarshalBytes(b []byte) error {
 		oLen -= hLen
 	}
 	if len(b) < oLen {
-		return NewConvMsgErr("OpenMessageのByte列が短すぎます")
+		l := uint16(len(b) + hLen)
+		return NewConvMsgErr(
+			MessageHeaderError, BadMessageLength, []byte{uint8(l >> 8), uint8(l)},
+			"OpenMessageのByte列が短すぎます",
+		)
 	}
 	var err error
 	// Version
@@ -113,18 +153,33 @@ func (o *OpenMessage) unMarshalBytes(b []byte) error {
 		return err
 	}
 	// BGP Identifier
-	o.bgpID = net.IP(b[5:9]).To4()
-	if o.bgpID == nil {
-		return NewConvMsgErr("BGP Identifierの変換に失敗しました")
+	// 有効なユニキャストのIPv4アドレスでなければならない
+	id := net.IP(b[5:9]).To4()
+	if id.IsUnspecified() || id.IsMulticast() || id.Equal(net.IPv4bcast) {
+		return NewConvMsgErr(
+			OpenMessageError, BadBGPIdentifier, b[5:9],
+			fmt.Sprintf("BGP Identifierが不正です: %v", net.IP(b[5:9])),
+		)
 	}
+	o.bgpID = id
 	// Optional Parameters Length
 	o.optsLen = b[9]
+	if int(o.optsLen) != len(b[10:]) {
+		return NewConvMsgErr(
+			OpenMessageError, Unspecific, nil,
+			fmt.Sprintf("Optional Parameters Lengthが不正です: %d", o.optsLen),
+		)
+	}
 	// Optional Parameters
 	if o.optsLen > 0 {
 		o.opts = b[10:]
 	} else {
 		o.opts = []byte{}
 	}
+	o.caps, err = unMarshalOptParams(o.opts)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -132,8 +187,8 @@ func (o *OpenMessage) unMarshalBytes(b []byte) error {
 func (o *OpenMessage) String() string {
 	return fmt.Sprintf(
 		"OpenMessage{header: %v, version: %v, myAS: %v, "+
-			"holdtime: %v, bgpID: %v, optsLen: %v, opts: %v}",
+			"holdtime: %v, bgpID: %v, optsLen: %v, opts: %v, caps: %v}",
 		o.header, o.version, o.myAS,
-		o.holdtime, o.bgpID, o.optsLen, o.opts,
+		o.holdtime, o.bgpID, o.optsLen, o.opts, o.caps,
 	)
 }
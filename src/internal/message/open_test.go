@@ -6,12 +6,19 @@ import (
 	"testing"
 
 	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/message/capability"
 )
 
 func TestOpenMessageMarshalAndUnmarshal(t *testing.T) {
 	o, err := NewOpenMsg(
 		bgp.ASNumber(64512),
 		net.ParseIP("127.0.0.1"),
+		90,
+		[]capability.Capability{
+			capability.RouteRefreshCap{},
+			capability.EnhancedRouteRefreshCap{},
+			capability.NewUnknown(128, []byte{0x01}),
+		},
 	)
 	if err != nil {
 		t.Error(err)
@@ -57,5 +64,16 @@ func openMsgeEqual(o1, o2 *OpenMessage, t *testing.T) bool {
 		t.Errorf("open message opts not equal: %v, %v", o1.opts, o2.opts)
 		return false
 	}
+	if len(o1.caps) != len(o2.caps) {
+		t.Errorf("open message caps not equal: %v, %v", o1.caps, o2.caps)
+		return false
+	}
+	for i := range o1.caps {
+		if o1.caps[i].Code() != o2.caps[i].Code() ||
+			!bytes.Equal(o1.caps[i].Value(), o2.caps[i].Value()) {
+			t.Errorf("open message caps not equal: %v, %v", o1.caps, o2.caps)
+			return false
+		}
+	}
 	return true
 }
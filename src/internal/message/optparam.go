@@ -0,0 +1,72 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/SotaUeda/usbgp/internal/message/capability"
+)
+
+// OPEN MessageのOptional ParameterのParameter Type
+// 本実装ではCapabilities(RFC 5492)のみ扱う。
+const optParamCapabilities uint8 = 2
+
+// CapabilityのリストをOptional ParametersのByte列に変換する
+// すべてのCapabilityを1つのOptional Parameterにまとめる。
+func marshalOptParams(caps []capability.Capability) ([]byte, error) {
+	if len(caps) == 0 {
+		return []byte{}, nil
+	}
+	var v []byte
+	for _, c := range caps {
+		cb, err := capability.MarshalBytes(c)
+		if err != nil {
+			return nil, NewConvBytesErr(err.Error())
+		}
+		v = append(v, cb...)
+	}
+	// Optional Parameters LengthとParameter Lengthは1byte
+	if len(v)+2 > 0xff {
+		return nil, NewConvBytesErr(
+			fmt.Sprintf("Optional Parametersが長すぎます: %d", len(v)+2),
+		)
+	}
+	b := []byte{optParamCapabilities, uint8(len(v))}
+	return append(b, v...), nil
+}
+
+// Optional ParametersのByte列からCapabilityのリストを取り出す
+// Capabilitiesが複数のOptional Parameterに分かれている場合にも対応する。
+func unMarshalOptParams(b []byte) ([]capability.Capability, error) {
+	var caps []capability.Capability
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, NewConvMsgErr(
+				OpenMessageError, Unspecific, nil,
+				fmt.Sprintf("Optional Parameterが短すぎます: %d", len(b)),
+			)
+		}
+		t, l := b[0], int(b[1])
+		if len(b) < 2+l {
+			return nil, NewConvMsgErr(
+				OpenMessageError, Unspecific, nil,
+				fmt.Sprintf("Optional Parameter Lengthが不正です: %d", l),
+			)
+		}
+		if t != optParamCapabilities {
+			return nil, NewConvMsgErr(
+				OpenMessageError, UnsupportedOptionalParameter, nil,
+				fmt.Sprintf("未知のOptional Parameterです: %d", t),
+			)
+		}
+		cs, err := capability.NewCapabilitiesFromBytes(b[2 : 2+l])
+		if err != nil {
+			return nil, NewConvMsgErr(
+				OpenMessageError, Unspecific, nil,
+				fmt.Sprintf("Capabilityが不正です: %v", err),
+			)
+		}
+		caps = append(caps, cs...)
+		b = b[2+l:]
+	}
+	return caps, nil
+}
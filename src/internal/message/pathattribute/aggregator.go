@@ -0,0 +1,91 @@
+package pathattribute
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// ATOMIC_AGGREGATE
+// 経路集約により、集約されたルートのAS_PATHの情報が失われたことを表す。
+// Attribute Valueを持たない。
+type AtomicAggregate struct{}
+
+func (a AtomicAggregate) BytesLen() uint16 {
+	return bytesLen(0)
+}
+
+func (a AtomicAggregate) Type() AttrType {
+	return ATA
+}
+
+func (a AtomicAggregate) MarshalBytes() ([]byte, error) {
+	return attrHeader(flagTransitive, ATA, 0), nil
+}
+
+func (a AtomicAggregate) String() string {
+	return "AtomicAggregate"
+}
+
+// AGGREGATOR
+// 経路を集約したBGPスピーカーのAS番号とBGP Identifierを表す。
+type Aggregator struct {
+	as bgp.ASNumber
+	ip net.IP
+}
+
+func NewAggregator(as bgp.ASNumber, ip net.IP) (Aggregator, error) {
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return Aggregator{}, fmt.Errorf("invalid aggregator address: %v", ip)
+	}
+	return Aggregator{as: as, ip: slices.Clone(ipv4)}, nil
+}
+
+func (a Aggregator) AS() bgp.ASNumber {
+	return a.as
+}
+
+func (a Aggregator) IP() net.IP {
+	return slices.Clone(a.ip)
+}
+
+func (a Aggregator) BytesLen() uint16 {
+	return bytesLen(4 + fourOctetASLen)
+}
+
+func (a Aggregator) Type() AttrType {
+	return AGG
+}
+
+func (a Aggregator) MarshalBytes() ([]byte, error) {
+	return marshalAggregator(AGG, a, fourOctetASLen)
+}
+
+func (a Aggregator) String() string {
+	return fmt.Sprintf("Aggregator{as: %d, ip: %v}", a.as, a.ip)
+}
+
+// AGGREGATOR, AS4_AGGREGATORをbytesに変換する
+// AS番号はasLenのoctet数で表現する。
+func marshalAggregator(atc AttrType, a Aggregator, asLen int) ([]byte, error) {
+	ip := a.ip.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid aggregator address: %v", a.ip)
+	}
+	b := []byte{flagOptional | flagTransitive, byte(atc), byte(asLen + 4)}
+	if asLen == twoOctetASLen {
+		b = append(b, byte(a.as.Uint16()>>8), byte(a.as.Uint16()))
+	} else {
+		b = append(b, byte(a.as>>24), byte(a.as>>16), byte(a.as>>8), byte(a.as))
+	}
+	return append(b, ip...), nil
+}
+
+func decodeAggregator(av []byte, asLen int) Aggregator {
+	ip := make(net.IP, 4)
+	copy(ip, av[asLen:asLen+4])
+	return Aggregator{as: decodeAS(av[:asLen]), ip: ip}
+}
@@ -0,0 +1,208 @@
+package pathattribute
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// 4-octet AS Number Capabilityをネゴシエーションしていない対向機器(RFC 6793のOLD BGP Speaker)と
+// 経路を交換するためのPathAttribute
+// 受信したAS_PATH, AGGREGATORはAS4_PATH, AS4_AGGREGATORと合わせて4octetのAS番号に復元し、
+// 送信するAS_PATH, AGGREGATORは2octetで表現できないAS番号をAS_TRANSに置き換える。
+
+// AS4_PATH
+// AS_TRANSに置き換える前のAS_PATHを4octetのAS番号で表す。
+type AS4Path struct {
+	path ASPath
+}
+
+func (a AS4Path) Path() ASPath {
+	return a.path
+}
+
+func (a AS4Path) BytesLen() uint16 {
+	return bytesLen(asByteLen(a.path, fourOctetASLen))
+}
+
+func (a AS4Path) Type() AttrType {
+	return AS4P
+}
+
+func (a AS4Path) MarshalBytes() ([]byte, error) {
+	return marshalASPath(flagOptional|flagTransitive, AS4P, a.path, fourOctetASLen)
+}
+
+func (a AS4Path) String() string {
+	return fmt.Sprintf("AS4Path{%v}", a.path)
+}
+
+// AS4_AGGREGATOR
+// AS_TRANSに置き換える前のAGGREGATORを4octetのAS番号で表す。
+type AS4Aggregator Aggregator
+
+func (a AS4Aggregator) BytesLen() uint16 {
+	return bytesLen(4 + fourOctetASLen)
+}
+
+func (a AS4Aggregator) Type() AttrType {
+	return AS4A
+}
+
+func (a AS4Aggregator) MarshalBytes() ([]byte, error) {
+	return marshalAggregator(AS4A, Aggregator(a), fourOctetASLen)
+}
+
+func (a AS4Aggregator) String() string {
+	return fmt.Sprintf("AS4Aggregator{as: %d, ip: %v}", a.as, a.ip)
+}
+
+// AS番号を2octetで表現するAS_PATH
+type twoOctetASPath struct {
+	path ASPath
+}
+
+func (a twoOctetASPath) BytesLen() uint16 {
+	return bytesLen(asByteLen(a.path, twoOctetASLen))
+}
+
+func (a twoOctetASPath) Type() AttrType {
+	return ASP
+}
+
+func (a twoOctetASPath) MarshalBytes() ([]byte, error) {
+	return marshalASPath(flagTransitive, ASP, a.path, twoOctetASLen)
+}
+
+func (a twoOctetASPath) String() string {
+	return fmt.Sprintf("%v", a.path)
+}
+
+// AS番号を2octetで表現するAGGREGATOR
+type twoOctetAggregator Aggregator
+
+func (a twoOctetAggregator) BytesLen() uint16 {
+	return bytesLen(4 + twoOctetASLen)
+}
+
+func (a twoOctetAggregator) Type() AttrType {
+	return AGG
+}
+
+func (a twoOctetAggregator) MarshalBytes() ([]byte, error) {
+	return marshalAggregator(AGG, Aggregator(a), twoOctetASLen)
+}
+
+func (a twoOctetAggregator) String() string {
+	return Aggregator(a).String()
+}
+
+// OLD BGP Speakerに送信するPathAttributeに変換する
+// 2octetで表現できないAS番号を含む場合は、AS4_PATH, AS4_AGGREGATORを追加する(RFC 6793 4.2.2)。
+// 引数のスライスは変更せず、新しいスライスを返す。
+func ToTwoOctetAS(pas []PathAttribute) []PathAttribute {
+	r := make([]PathAttribute, 0, len(pas))
+	var as4 []PathAttribute
+	for _, pa := range pas {
+		switch a := pa.(type) {
+		case ASPath:
+			r = append(r, twoOctetASPath{path: a})
+			if !isTwoOctetPath(a) {
+				// AS4_PATHはConfederationのSegmentを含まない
+				as4 = append(as4, AS4Path{path: a.withoutConfed()})
+			}
+		case Aggregator:
+			r = append(r, twoOctetAggregator(a))
+			if !a.as.IsTwoOctet() {
+				as4 = append(as4, AS4Aggregator(a))
+			}
+		default:
+			r = append(r, pa)
+		}
+	}
+	return append(r, as4...)
+}
+
+func isTwoOctetPath(a ASPath) bool {
+	for _, as := range a.ASNumbers() {
+		if !as.IsTwoOctet() {
+			return false
+		}
+	}
+	return true
+}
+
+// OLD BGP Speakerから受信したAS_PATH, AGGREGATORを、
+// AS4_PATH, AS4_AGGREGATORを使って4octetのAS番号に復元する(RFC 6793 4.2.3)。
+// AS4_PATH, AS4_AGGREGATORは取り除く。
+func mergeAS4(pas []PathAttribute) []PathAttribute {
+	var (
+		as4Path *AS4Path
+		agg     *Aggregator
+		as4Agg  *AS4Aggregator
+	)
+	r := make([]PathAttribute, 0, len(pas))
+	for _, pa := range pas {
+		switch a := pa.(type) {
+		case AS4Path:
+			as4Path = &a
+			continue
+		case AS4Aggregator:
+			as4Agg = &a
+			continue
+		case Aggregator:
+			agg = &a
+		}
+		r = append(r, pa)
+	}
+	if agg != nil && agg.as != bgp.ASTrans {
+		// AGGREGATORのAS番号がAS_TRANSでない場合、
+		// AS4_PATH, AS4_AGGREGATORは途中のNEW BGP Speakerが付与したものではないため無視する
+		return r
+	}
+	for i, pa := range r {
+		switch a := pa.(type) {
+		case Aggregator:
+			if as4Agg != nil {
+				r[i] = Aggregator(*as4Agg)
+			}
+		case ASPath:
+			if as4Path != nil {
+				r[i] = mergeASPath(a, as4Path.path)
+			}
+		}
+	}
+	return r
+}
+
+// AS_PATHの先頭から、AS4_PATHに含まれないAS番号を取り出し、AS4_PATHの前に追加する
+// AS番号の数は、AS_SETを1、ConfederationのSegmentを0として数える(RFC 6793 4.2.3)。
+// AS_PATHよりAS4_PATHの方が長い場合は、AS4_PATHを無視する。
+func mergeASPath(asPath, as4Path ASPath) ASPath {
+	n := asPath.Len() - as4Path.Len()
+	if n < 0 {
+		return asPath
+	}
+	var segs []ASPathSegment
+	for _, s := range asPath.segs {
+		switch {
+		case s.isConfed():
+			segs = append(segs, s)
+			continue
+		case n == 0:
+		case s.typ == ASSegTypeSet:
+			segs = append(segs, s)
+			n--
+			continue
+		default:
+			k := min(n, len(s.asns))
+			segs = append(segs, ASPathSegment{typ: s.typ, asns: slices.Clone(s.asns[:k])})
+			n -= k
+			continue
+		}
+		break
+	}
+	// AS4_PATHはConfederationのSegmentを含んではならないため、取り除く
+	return ASPath{segs: append(segs, as4Path.withoutConfed().segs...)}
+}
@@ -0,0 +1,264 @@
+package pathattribute
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// AS_PATH
+// 経路が通過したASを、種類を持つSegmentの順序付きのリストで表す。
+// 経路集約やConfederation(RFC 5065)により、1つのAS_PATHが複数のSegmentを持つことがある。
+// Segmentを持たないAS_PATHは、自身のAS内の経路を表す。
+type ASPath struct {
+	segs []ASPathSegment
+}
+
+type ASPathSegmentType uint8
+
+//go:generate stringer -type=ASPathSegmentType aspath.go
+const (
+	ASSegTypeSet      ASPathSegmentType = 1
+	ASSegTypeSequence ASPathSegmentType = 2
+	// Confederation内のMember ASを表すSegment(RFC 5065)
+	ASSegTypeConfedSequence ASPathSegmentType = 3
+	ASSegTypeConfedSet      ASPathSegmentType = 4
+)
+
+// 1つのSegmentに含められるAS番号の最大数
+// Path Segment Lengthは1octetで表現する。
+const MaxASPathSegmentLen = 255
+
+// AS番号のOctet数
+// 4-octet AS Number Capabilityをネゴシエーションしていない対向機器とは2octetで送受信する。
+const (
+	twoOctetASLen  = 2
+	fourOctetASLen = 4
+)
+
+// AS_PATHのSegment
+// AS_SETも受信した順序を保持する。
+type ASPathSegment struct {
+	typ  ASPathSegmentType
+	asns []bgp.ASNumber
+}
+
+func NewASPathSegment(t ASPathSegmentType, as []bgp.ASNumber) (ASPathSegment, error) {
+	if t < ASSegTypeSet || t > ASSegTypeConfedSet {
+		return ASPathSegment{}, fmt.Errorf("invalid ASPathSegmentType: %d", t)
+	}
+	if len(as) == 0 || len(as) > MaxASPathSegmentLen {
+		return ASPathSegment{}, fmt.Errorf("invalid AS path segment length: %d", len(as))
+	}
+	return ASPathSegment{typ: t, asns: slices.Clone(as)}, nil
+}
+
+func (s ASPathSegment) Type() ASPathSegmentType {
+	return s.typ
+}
+
+func (s ASPathSegment) ASNumbers() []bgp.ASNumber {
+	return slices.Clone(s.asns)
+}
+
+// Confederation内のSegmentであるか
+func (s ASPathSegment) isConfed() bool {
+	return s.typ == ASSegTypeConfedSequence || s.typ == ASSegTypeConfedSet
+}
+
+// Sequenceは"64513 64514"、Setは"{64513,64514}"、
+// Confederationはそれぞれ"(64513 64514)"、"[64513,64514]"と表す。
+func (s ASPathSegment) String() string {
+	strs := make([]string, 0, len(s.asns))
+	for _, as := range s.asns {
+		strs = append(strs, fmt.Sprint(as))
+	}
+	switch s.typ {
+	case ASSegTypeSet:
+		return "{" + strings.Join(strs, ",") + "}"
+	case ASSegTypeConfedSequence:
+		return "(" + strings.Join(strs, " ") + ")"
+	case ASSegTypeConfedSet:
+		return "[" + strings.Join(strs, ",") + "]"
+	}
+	return strings.Join(strs, " ")
+}
+
+// 1種類のSegmentからなるAS_PATHを生成する
+// MaxASPathSegmentLenを超えるAS番号は、複数のSegmentに分割する。
+// asが空の場合は、Segmentを持たないAS_PATHを返す。
+func NewASPath(t ASPathSegmentType, as []bgp.ASNumber) (ASPath, error) {
+	var segs []ASPathSegment
+	for c := range slices.Chunk(as, MaxASPathSegmentLen) {
+		s, err := NewASPathSegment(t, c)
+		if err != nil {
+			return ASPath{}, err
+		}
+		segs = append(segs, s)
+	}
+	return ASPath{segs: segs}, nil
+}
+
+// Segmentを順に並べたAS_PATHを生成する
+func NewASPathFromSegments(segs ...ASPathSegment) ASPath {
+	return ASPath{segs: slices.Clone(segs)}
+}
+
+func (a ASPath) Segments() []ASPathSegment {
+	return slices.Clone(a.segs)
+}
+
+// すべてのSegmentのAS番号を、先頭から順に返す
+func (a ASPath) ASNumbers() []bgp.ASNumber {
+	var asns []bgp.ASNumber
+	for _, s := range a.segs {
+		asns = append(asns, s.asns...)
+	}
+	return asns
+}
+
+// いずれかのSegmentにAS番号が含まれるかを返す
+func (a ASPath) Contains(as bgp.ASNumber) bool {
+	for _, s := range a.segs {
+		if slices.Contains(s.asns, as) {
+			return true
+		}
+	}
+	return false
+}
+
+// ベストパスの選択に使用するAS_PATHの長さ(RFC 4271 9.1.2.2)
+// AS_SETは含まれるAS番号の数にかかわらず1として数え、
+// ConfederationのSegmentは数えない(RFC 5065 5.3)。
+func (a ASPath) Len() int {
+	l := 0
+	for _, s := range a.segs {
+		switch s.typ {
+		case ASSegTypeSequence:
+			l += len(s.asns)
+		case ASSegTypeSet:
+			l++
+		}
+	}
+	return l
+}
+
+// 経路を広告した隣接AS
+// ConfederationのSegmentを除いた、最初のSegmentがAS_SEQUENCEの場合はその先頭のAS番号を返す。
+// それ以外の場合は0を返す。
+func (a ASPath) NeighborAS() bgp.ASNumber {
+	for _, s := range a.segs {
+		if s.isConfed() {
+			continue
+		}
+		if s.typ == ASSegTypeSequence {
+			return s.asns[0]
+		}
+		return 0
+	}
+	return 0
+}
+
+// AS番号を先頭に追加したAS_PATHを返す(RFC 4271 5.1.2)
+// 先頭のSegmentがAS_SEQUENCEで空きがある場合はその先頭に追加し、
+// それ以外の場合は新しいAS_SEQUENCEのSegmentを先頭に追加する。
+// 元のAS_PATHは変更しない。
+func (a ASPath) Prepend(as bgp.ASNumber) ASPath {
+	segs := make([]ASPathSegment, 0, len(a.segs)+1)
+	if len(a.segs) > 0 && a.segs[0].typ == ASSegTypeSequence && len(a.segs[0].asns) < MaxASPathSegmentLen {
+		asns := make([]bgp.ASNumber, 0, len(a.segs[0].asns)+1)
+		asns = append(asns, as)
+		segs = append(segs, ASPathSegment{typ: ASSegTypeSequence, asns: append(asns, a.segs[0].asns...)})
+		return ASPath{segs: append(segs, a.segs[1:]...)}
+	}
+	segs = append(segs, ASPathSegment{typ: ASSegTypeSequence, asns: []bgp.ASNumber{as}})
+	return ASPath{segs: append(segs, a.segs...)}
+}
+
+// ConfederationのSegmentを取り除いたAS_PATHを返す
+func (a ASPath) withoutConfed() ASPath {
+	segs := make([]ASPathSegment, 0, len(a.segs))
+	for _, s := range a.segs {
+		if !s.isConfed() {
+			segs = append(segs, s)
+		}
+	}
+	return ASPath{segs: segs}
+}
+
+func (a ASPath) BytesLen() uint16 {
+	return bytesLen(asByteLen(a, fourOctetASLen))
+}
+
+func (a ASPath) Type() AttrType {
+	return ASP
+}
+
+func (a ASPath) MarshalBytes() ([]byte, error) {
+	return marshalASPath(flagTransitive, ASP, a, fourOctetASLen)
+}
+
+func (a ASPath) String() string {
+	strs := make([]string, 0, len(a.segs))
+	for _, s := range a.segs {
+		strs = append(strs, s.String())
+	}
+	return "[" + strings.Join(strs, " ") + "]"
+}
+
+// Attribute Valueの合計Octet数を返す
+// SegmentごとにSegment Typeを表すoctetとASの数を表すoctetが付く。
+func asByteLen(a ASPath, asLen int) uint16 {
+	l := uint16(0)
+	for _, s := range a.segs {
+		l += 1 + 1 + uint16(asLen*len(s.asns))
+	}
+	return l
+}
+
+// AS_PATH, AS4_PATHをbytesに変換する
+// AS番号はasLenのoctet数で表現する。
+func marshalASPath(af uint8, atc AttrType, a ASPath, asLen int) ([]byte, error) {
+	b := attrHeader(af, atc, asByteLen(a, asLen))
+	for _, s := range a.segs {
+		b = append(b, byte(s.typ), byte(len(s.asns)))
+		for _, as := range s.asns {
+			if asLen == twoOctetASLen {
+				b = append(b, byte(as.Uint16()>>8), byte(as.Uint16()))
+				continue
+			}
+			b = append(b, byte(as>>24), byte(as>>16), byte(as>>8), byte(as))
+		}
+	}
+	return b, nil
+}
+
+// AS_PATH, AS4_PATHのAttribute ValueからASPathを生成する
+// AS番号はasLenのoctet数で表現されている。
+func decodeASPath(av []byte, asLen int) (ASPath, error) {
+	// iBGPでは空のAS_PATHが使用される
+	var segs []ASPathSegment
+	for len(av) > 0 {
+		if len(av) < 2 {
+			return ASPath{}, fmt.Errorf("invalid AS path length: %d", len(av))
+		}
+		st := ASPathSegmentType(av[0])
+		sl := int(av[1])
+		if sl == 0 || len(av) < 2+asLen*sl {
+			return ASPath{}, fmt.Errorf("invalid AS path segment length: %d", sl)
+		}
+		sv := make([]bgp.ASNumber, sl)
+		for i := range sv {
+			sv[i] = decodeAS(av[2+i*asLen : 2+(i+1)*asLen])
+		}
+		s, err := NewASPathSegment(st, sv)
+		if err != nil {
+			return ASPath{}, err
+		}
+		segs = append(segs, s)
+		av = av[2+asLen*sl:]
+	}
+	return ASPath{segs: segs}, nil
+}
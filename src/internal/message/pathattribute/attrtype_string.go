@@ -11,16 +11,41 @@ func _() {
 	_ = x[ORG-1]
 	_ = x[ASP-2]
 	_ = x[NHP-3]
+	_ = x[MED-4]
+	_ = x[LPF-5]
+	_ = x[ATA-6]
+	_ = x[AGG-7]
+	_ = x[COM-8]
+	_ = x[MPR-14]
+	_ = x[MPU-15]
+	_ = x[EXC-16]
+	_ = x[AS4P-17]
+	_ = x[AS4A-18]
+	_ = x[LGC-32]
 }
 
-const _AttrType_name = "ORGASPNHP"
+const (
+	_AttrType_name_0 = "ORGASPNHPMEDLPFATAAGGCOM"
+	_AttrType_name_1 = "MPRMPUEXCAS4PAS4A"
+	_AttrType_name_2 = "LGC"
+)
 
-var _AttrType_index = [...]uint8{0, 3, 6, 9}
+var (
+	_AttrType_index_0 = [...]uint8{0, 3, 6, 9, 12, 15, 18, 21, 24}
+	_AttrType_index_1 = [...]uint8{0, 3, 6, 9, 13, 17}
+)
 
 func (i AttrType) String() string {
-	i -= 1
-	if i >= AttrType(len(_AttrType_index)-1) {
-		return "AttrType(" + strconv.FormatInt(int64(i+1), 10) + ")"
+	switch {
+	case 1 <= i && i <= 8:
+		i -= 1
+		return _AttrType_name_0[_AttrType_index_0[i]:_AttrType_index_0[i+1]]
+	case 14 <= i && i <= 18:
+		i -= 14
+		return _AttrType_name_1[_AttrType_index_1[i]:_AttrType_index_1[i+1]]
+	case i == 32:
+		return _AttrType_name_2
+	default:
+		return "AttrType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _AttrType_name[_AttrType_index[i]:_AttrType_index[i+1]]
 }
@@ -0,0 +1,119 @@
+package pathattribute
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// COMMUNITIES(RFC 1997)
+// 経路に付加するタグであり、トラフィックエンジニアリングやブラックホールルーティングなどの
+// ポリシーを対向機器と共有するために使用する。
+type Communities struct {
+	vals []Community
+}
+
+// 1つのCommunity
+// 上位2octetはAS番号、下位2octetはAS内で定義する値を表す。
+type Community uint32
+
+// Well-known Community
+const (
+	// AS(Confederationの場合はConfederation)の外に広告しない
+	NoExport Community = 0xFFFFFF01
+	// どの対向機器にも広告しない
+	NoAdvertise Community = 0xFFFFFF02
+	// 自身のAS(Confederationの場合はMember AS)の外に広告しない
+	NoExportSubconfed Community = 0xFFFFFF03
+	// Bilateral Peerに広告しない(RFC 3765)
+	NoPeer Community = 0xFFFFFF04
+)
+
+var wellKnownCommunities = map[Community]string{
+	NoExport:          "no-export",
+	NoAdvertise:       "no-advertise",
+	NoExportSubconfed: "no-export-subconfed",
+	NoPeer:            "no-peer",
+}
+
+// "ASN:value"形式、またはWell-known Communityの名前("no-export"など)の文字列をパースする
+func ParseCommunity(s string) (Community, error) {
+	for c, name := range wellKnownCommunities {
+		if s == name {
+			return c, nil
+		}
+	}
+	asn, v, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid community: %s", s)
+	}
+	hi, err := strconv.ParseUint(asn, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community: %s", s)
+	}
+	lo, err := strconv.ParseUint(v, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community: %s", s)
+	}
+	return Community(hi<<16 | lo), nil
+}
+
+func (c Community) String() string {
+	if name, ok := wellKnownCommunities[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d:%d", uint32(c)>>16, uint32(c)&0xffff)
+}
+
+func NewCommunities(cs []Community) Communities {
+	return Communities{vals: slices.Clone(cs)}
+}
+
+func (cs Communities) Values() []Community {
+	return slices.Clone(cs.vals)
+}
+
+func (cs Communities) Contains(c Community) bool {
+	return slices.Contains(cs.vals, c)
+}
+
+func (cs Communities) valueLen() uint16 {
+	return uint16(4 * len(cs.vals))
+}
+
+func (cs Communities) BytesLen() uint16 {
+	return bytesLen(cs.valueLen())
+}
+
+func (cs Communities) Type() AttrType {
+	return COM
+}
+
+func (cs Communities) MarshalBytes() ([]byte, error) {
+	b := attrHeader(flagOptional|flagTransitive, COM, cs.valueLen())
+	for _, c := range cs.vals {
+		b = append(b, byte(c>>24), byte(c>>16), byte(c>>8), byte(c))
+	}
+	return b, nil
+}
+
+func (cs Communities) String() string {
+	strs := make([]string, 0, len(cs.vals))
+	for _, c := range cs.vals {
+		strs = append(strs, c.String())
+	}
+	return "Communities[" + strings.Join(strs, " ") + "]"
+}
+
+// COMMUNITIESのAttribute ValueからCommunitiesを生成する
+func decodeCommunities(av []byte) (Communities, error) {
+	if len(av) == 0 || len(av)%4 != 0 {
+		return Communities{}, fmt.Errorf("invalid communities length: %d", len(av))
+	}
+	vals := make([]Community, 0, len(av)/4)
+	for ; len(av) > 0; av = av[4:] {
+		vals = append(vals, Community(decodeUint32(av)))
+	}
+	return Communities{vals: vals}, nil
+}
@@ -0,0 +1,70 @@
+package pathattribute
+
+import (
+	"fmt"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// UPDATE Message ErrorのSubcode
+// RFC 4271 6.3で定められている。
+// messageパッケージのErrorSubcodeと同じ値を使用する。
+const (
+	errMalformedAttributeList         uint8 = 1
+	errUnrecognizedWellKnownAttribute uint8 = 2
+	errAttributeFlagsError            uint8 = 4
+	errAttributeLengthError           uint8 = 5
+	errInvalidOriginAttribute         uint8 = 6
+	errInvalidNextHopAttribute        uint8 = 8
+	errOptionalAttributeError         uint8 = 9
+	errMalformedASPath                uint8 = 11
+)
+
+// 不正なPathAttributeを受信した場合の処理方法(RFC 7606 2章)
+// 値が大きいほど影響が大きい。1つのUPDATE Messageで複数のエラーが発生した場合は、
+// 最も影響が大きいものを適用する。
+type ErrAction uint8
+
+//go:generate stringer -type=ErrAction err.go
+const (
+	// 不正なPathAttributeのみを破棄し、ルートはそのまま処理する
+	AttributeDiscard ErrAction = iota + 1
+	// UPDATE MessageのNLRIを、取り下げられたルートとして処理する
+	TreatAsWithdraw
+	// AFI/SAFIのルートをすべて取り下げ、セッションの間はそのAFI/SAFIのルートを無視する(RFC 4760 7章)
+	AFISAFIDisable
+	// NOTIFICATION Messageを送信してセッションを切断する
+	SessionReset
+)
+
+// BytesからPathAttributeへの変換に失敗したことを表すエラー
+// NOTIFICATION Messageを生成できるように、
+// UPDATE Message ErrorのSubcodeとDataを保持する。
+type AttrErr struct {
+	Err     error
+	Subcode uint8
+	Data    []byte
+	// エラーの処理方法
+	// 0の場合はSessionResetとして扱う。
+	Action ErrAction
+	// AFI/SAFI disableの対象のAFI/SAFI
+	Family bgp.Family
+	// エラーとなったPathAttributeのByte列(Attribute Flagsから)
+	Attr []byte
+}
+
+func (e AttrErr) Error() string {
+	return e.Err.Error()
+}
+
+func (e AttrErr) Unwrap() error {
+	return e.Err
+}
+
+func newAttrErr(subcode uint8, data []byte, format string, a ...any) AttrErr {
+	return AttrErr{
+		Err:     fmt.Errorf(format, a...),
+		Subcode: subcode,
+		Data:    data,
+	}
+}
@@ -0,0 +1,243 @@
+package pathattribute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// EXTENDED_COMMUNITIES(RFC 4360)
+// Type, Sub-Typeで種類を表す、8octetのCommunityのリスト
+type ExtendedCommunities struct {
+	vals []ExtendedCommunity
+}
+
+// 1つのExtended Community
+// Type(1octet), Sub-Type(1octet), Value(6octet)からなる。
+type ExtendedCommunity [8]byte
+
+// Extended CommunityのType(上位octet)
+const (
+	// Global AdministratorがAS番号(2octet)、Local Administratorが4octet
+	ExtTypeTwoOctetAS uint8 = 0x00
+	// Global AdministratorがIPv4アドレス、Local Administratorが2octet
+	ExtTypeIPv4 uint8 = 0x01
+	// Global AdministratorがAS番号(4octet)、Local Administratorが2octet(RFC 5668)
+	ExtTypeFourOctetAS uint8 = 0x02
+	// このbitが1のExtended Communityは、ほかのASに送信しない(Non-transitive)
+	extTypeNonTransitive uint8 = 0x40
+)
+
+// Extended CommunityのSub-Type(下位octet)
+const (
+	ExtSubTypeRouteTarget   uint8 = 0x02
+	ExtSubTypeRouteOrigin   uint8 = 0x03
+	ExtSubTypeLinkBandwidth uint8 = 0x04
+)
+
+// 文字列表現の接頭辞
+var extSubTypeNames = map[uint8]string{
+	ExtSubTypeRouteTarget: "rt",
+	ExtSubTypeRouteOrigin: "soo",
+}
+
+// AS番号をGlobal Administratorとする、Route TargetまたはRoute OriginのExtended Communityを生成する
+// 2octetで表現できるAS番号はLocal Administratorを4octet、
+// それ以外のAS番号はLocal Administratorを2octetで表現する。
+func NewASSpecificExtCommunity(subType uint8, as bgp.ASNumber, v uint32) (ExtendedCommunity, error) {
+	var c ExtendedCommunity
+	if as.IsTwoOctet() {
+		c[0], c[1] = ExtTypeTwoOctetAS, subType
+		binary.BigEndian.PutUint16(c[2:4], as.Uint16())
+		binary.BigEndian.PutUint32(c[4:8], v)
+		return c, nil
+	}
+	if v > math.MaxUint16 {
+		return c, fmt.Errorf("local administrator must be 2 octets with 4-octet AS: %d", v)
+	}
+	c[0], c[1] = ExtTypeFourOctetAS, subType
+	binary.BigEndian.PutUint32(c[2:6], uint32(as))
+	binary.BigEndian.PutUint16(c[6:8], uint16(v))
+	return c, nil
+}
+
+// IPv4アドレスをGlobal Administratorとする、Route TargetまたはRoute OriginのExtended Communityを生成する
+func NewIPv4SpecificExtCommunity(subType uint8, ip net.IP, v uint16) (ExtendedCommunity, error) {
+	var c ExtendedCommunity
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return c, fmt.Errorf("invalid global administrator: %v", ip)
+	}
+	c[0], c[1] = ExtTypeIPv4, subType
+	copy(c[2:6], ipv4)
+	binary.BigEndian.PutUint16(c[6:8], v)
+	return c, nil
+}
+
+// Link BandwidthのExtended Communityを生成する
+// 帯域幅(bytes/sec)はIEEE浮動小数点数で表し、Non-transitiveである。
+func NewLinkBandwidth(as uint16, bw float32) ExtendedCommunity {
+	var c ExtendedCommunity
+	c[0], c[1] = ExtTypeTwoOctetAS|extTypeNonTransitive, ExtSubTypeLinkBandwidth
+	binary.BigEndian.PutUint16(c[2:4], as)
+	binary.BigEndian.PutUint32(c[4:8], math.Float32bits(bw))
+	return c
+}
+
+// "rt:ASN:value"、"rt:IPv4:value"、"soo:ASN:value"、"lb:ASN:bandwidth"形式の文字列をパースする
+// rtはRoute Target、sooはRoute Origin、lbはLink Bandwidth(bytes/sec)を表す。
+func ParseExtendedCommunity(s string) (ExtendedCommunity, error) {
+	fs := strings.Split(s, ":")
+	if len(fs) != 3 {
+		return ExtendedCommunity{}, fmt.Errorf("invalid extended community: %s", s)
+	}
+	if fs[0] == "lb" {
+		as, err := strconv.ParseUint(fs[1], 10, 16)
+		if err != nil {
+			return ExtendedCommunity{}, fmt.Errorf("invalid extended community: %s", s)
+		}
+		bw, err := strconv.ParseFloat(fs[2], 32)
+		if err != nil {
+			return ExtendedCommunity{}, fmt.Errorf("invalid extended community: %s", s)
+		}
+		return NewLinkBandwidth(uint16(as), float32(bw)), nil
+	}
+	var subType uint8
+	switch fs[0] {
+	case "rt":
+		subType = ExtSubTypeRouteTarget
+	case "soo":
+		subType = ExtSubTypeRouteOrigin
+	default:
+		return ExtendedCommunity{}, fmt.Errorf("unknown extended community type: %s", s)
+	}
+	if ip := net.ParseIP(fs[1]); ip != nil {
+		v, err := strconv.ParseUint(fs[2], 10, 16)
+		if err != nil {
+			return ExtendedCommunity{}, fmt.Errorf("invalid extended community: %s", s)
+		}
+		return NewIPv4SpecificExtCommunity(subType, ip, uint16(v))
+	}
+	as, err := bgp.ParseASNumber(fs[1])
+	if err != nil {
+		return ExtendedCommunity{}, fmt.Errorf("invalid extended community: %s", s)
+	}
+	v, err := strconv.ParseUint(fs[2], 10, 32)
+	if err != nil {
+		return ExtendedCommunity{}, fmt.Errorf("invalid extended community: %s", s)
+	}
+	return NewASSpecificExtCommunity(subType, as, uint32(v))
+}
+
+// Non-transitive bitを除いたType
+func (c ExtendedCommunity) Type() uint8 {
+	return c[0] &^ extTypeNonTransitive
+}
+
+func (c ExtendedCommunity) SubType() uint8 {
+	return c[1]
+}
+
+// ほかのASに送信するExtended Communityであるか
+func (c ExtendedCommunity) IsTransitive() bool {
+	return c[0]&extTypeNonTransitive == 0
+}
+
+// Link Bandwidthの帯域幅(bytes/sec)
+// Link BandwidthでないExtended Communityはfalseを返す。
+func (c ExtendedCommunity) LinkBandwidth() (float32, bool) {
+	if c.Type() != ExtTypeTwoOctetAS || c.SubType() != ExtSubTypeLinkBandwidth {
+		return 0, false
+	}
+	return math.Float32frombits(binary.BigEndian.Uint32(c[4:8])), true
+}
+
+func (c ExtendedCommunity) String() string {
+	if bw, ok := c.LinkBandwidth(); ok {
+		return fmt.Sprintf("lb:%d:%s", binary.BigEndian.Uint16(c[2:4]),
+			strconv.FormatFloat(float64(bw), 'f', -1, 32))
+	}
+	name, ok := extSubTypeNames[c.SubType()]
+	if !ok || !c.IsTransitive() {
+		return fmt.Sprintf("0x%x", c[:])
+	}
+	switch c.Type() {
+	case ExtTypeTwoOctetAS:
+		return fmt.Sprintf("%s:%d:%d", name, binary.BigEndian.Uint16(c[2:4]), binary.BigEndian.Uint32(c[4:8]))
+	case ExtTypeIPv4:
+		return fmt.Sprintf("%s:%v:%d", name, net.IP(c[2:6]), binary.BigEndian.Uint16(c[6:8]))
+	case ExtTypeFourOctetAS:
+		return fmt.Sprintf("%s:%d:%d", name, binary.BigEndian.Uint32(c[2:6]), binary.BigEndian.Uint16(c[6:8]))
+	}
+	return fmt.Sprintf("0x%x", c[:])
+}
+
+func NewExtendedCommunities(cs []ExtendedCommunity) ExtendedCommunities {
+	return ExtendedCommunities{vals: slices.Clone(cs)}
+}
+
+func (cs ExtendedCommunities) Values() []ExtendedCommunity {
+	return slices.Clone(cs.vals)
+}
+
+func (cs ExtendedCommunities) Contains(c ExtendedCommunity) bool {
+	return slices.Contains(cs.vals, c)
+}
+
+// Transitiveなもののみを残したExtendedCommunitiesを返す
+// eBGPの対向機器に送信する場合に使用する。
+func (cs ExtendedCommunities) Transitive() ExtendedCommunities {
+	vals := make([]ExtendedCommunity, 0, len(cs.vals))
+	for _, c := range cs.vals {
+		if c.IsTransitive() {
+			vals = append(vals, c)
+		}
+	}
+	return ExtendedCommunities{vals: vals}
+}
+
+func (cs ExtendedCommunities) valueLen() uint16 {
+	return uint16(8 * len(cs.vals))
+}
+
+func (cs ExtendedCommunities) BytesLen() uint16 {
+	return bytesLen(cs.valueLen())
+}
+
+func (cs ExtendedCommunities) Type() AttrType {
+	return EXC
+}
+
+func (cs ExtendedCommunities) MarshalBytes() ([]byte, error) {
+	b := attrHeader(flagOptional|flagTransitive, EXC, cs.valueLen())
+	for _, c := range cs.vals {
+		b = append(b, c[:]...)
+	}
+	return b, nil
+}
+
+func (cs ExtendedCommunities) String() string {
+	strs := make([]string, 0, len(cs.vals))
+	for _, c := range cs.vals {
+		strs = append(strs, c.String())
+	}
+	return "ExtendedCommunities[" + strings.Join(strs, " ") + "]"
+}
+
+// EXTENDED_COMMUNITIESのAttribute ValueからExtendedCommunitiesを生成する
+func decodeExtendedCommunities(av []byte) (ExtendedCommunities, error) {
+	if len(av) == 0 || len(av)%8 != 0 {
+		return ExtendedCommunities{}, fmt.Errorf("invalid extended communities length: %d", len(av))
+	}
+	vals := make([]ExtendedCommunity, 0, len(av)/8)
+	for ; len(av) > 0; av = av[8:] {
+		vals = append(vals, ExtendedCommunity(av[:8]))
+	}
+	return ExtendedCommunities{vals: vals}, nil
+}
@@ -0,0 +1,101 @@
+package pathattribute
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LARGE_COMMUNITY(RFC 8092)
+// 4octetのAS番号でもCommunityを表現できるように、12octetで1つのCommunityを表す。
+type LargeCommunities struct {
+	vals []LargeCommunity
+}
+
+// 1つのLarge Community
+// Global AdministratorはAS番号、Local Data Part 1, 2はAS内で定義する値を表す。
+type LargeCommunity struct {
+	GlobalAdmin uint32
+	LocalData1  uint32
+	LocalData2  uint32
+}
+
+// "ASN:function:parameter"形式の文字列をパースする
+func ParseLargeCommunity(s string) (LargeCommunity, error) {
+	fs := strings.Split(s, ":")
+	if len(fs) != 3 {
+		return LargeCommunity{}, fmt.Errorf("invalid large community: %s", s)
+	}
+	var vs [3]uint32
+	for i, f := range fs {
+		v, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return LargeCommunity{}, fmt.Errorf("invalid large community: %s", s)
+		}
+		vs[i] = uint32(v)
+	}
+	return LargeCommunity{GlobalAdmin: vs[0], LocalData1: vs[1], LocalData2: vs[2]}, nil
+}
+
+func (c LargeCommunity) String() string {
+	return fmt.Sprintf("%d:%d:%d", c.GlobalAdmin, c.LocalData1, c.LocalData2)
+}
+
+func NewLargeCommunities(cs []LargeCommunity) LargeCommunities {
+	return LargeCommunities{vals: slices.Clone(cs)}
+}
+
+func (cs LargeCommunities) Values() []LargeCommunity {
+	return slices.Clone(cs.vals)
+}
+
+func (cs LargeCommunities) Contains(c LargeCommunity) bool {
+	return slices.Contains(cs.vals, c)
+}
+
+func (cs LargeCommunities) valueLen() uint16 {
+	return uint16(12 * len(cs.vals))
+}
+
+func (cs LargeCommunities) BytesLen() uint16 {
+	return bytesLen(cs.valueLen())
+}
+
+func (cs LargeCommunities) Type() AttrType {
+	return LGC
+}
+
+func (cs LargeCommunities) MarshalBytes() ([]byte, error) {
+	b := attrHeader(flagOptional|flagTransitive, LGC, cs.valueLen())
+	for _, c := range cs.vals {
+		for _, v := range []uint32{c.GlobalAdmin, c.LocalData1, c.LocalData2} {
+			b = append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	return b, nil
+}
+
+func (cs LargeCommunities) String() string {
+	strs := make([]string, 0, len(cs.vals))
+	for _, c := range cs.vals {
+		strs = append(strs, c.String())
+	}
+	return "LargeCommunities[" + strings.Join(strs, " ") + "]"
+}
+
+// LARGE_COMMUNITYのAttribute ValueからLargeCommunitiesを生成する
+func decodeLargeCommunities(av []byte) (LargeCommunities, error) {
+	if len(av) == 0 || len(av)%12 != 0 {
+		return LargeCommunities{}, fmt.Errorf("invalid large communities length: %d", len(av))
+	}
+	vals := make([]LargeCommunity, 0, len(av)/12)
+	for ; len(av) > 0; av = av[12:] {
+		vals = append(vals, LargeCommunity{
+			GlobalAdmin: decodeUint32(av[0:4]),
+			LocalData1:  decodeUint32(av[4:8]),
+			LocalData2:  decodeUint32(av[8:12]),
+		})
+	}
+	return LargeCommunities{vals: vals}, nil
+}
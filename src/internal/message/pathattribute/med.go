@@ -0,0 +1,54 @@
+package pathattribute
+
+import "fmt"
+
+// MULTI_EXIT_DISC
+// 隣接ASに複数の接続点がある場合に、隣接ASがどの接続点を優先するかを表す。
+// 小さい値の経路を優先する。
+// Optional Non-transitiveであり、受信した値を別の隣接ASには送信しない。
+type MultiExitDisc uint32
+
+func (m MultiExitDisc) BytesLen() uint16 {
+	return bytesLen(4)
+}
+
+func (m MultiExitDisc) Type() AttrType {
+	return MED
+}
+
+func (m MultiExitDisc) MarshalBytes() ([]byte, error) {
+	b := attrHeader(flagOptional, MED, 4)
+	return append(b, byte(m>>24), byte(m>>16), byte(m>>8), byte(m)), nil
+}
+
+func (m MultiExitDisc) String() string {
+	return fmt.Sprintf("MED(%d)", uint32(m))
+}
+
+// LOCAL_PREF
+// 同じAS内のBGPスピーカーに、経路の優先度を伝える。
+// 大きい値の経路を優先する。
+// iBGPの対向機器にのみ送信する。
+type LocalPref uint32
+
+func (l LocalPref) BytesLen() uint16 {
+	return bytesLen(4)
+}
+
+func (l LocalPref) Type() AttrType {
+	return LPF
+}
+
+func (l LocalPref) MarshalBytes() ([]byte, error) {
+	b := attrHeader(flagTransitive, LPF, 4)
+	return append(b, byte(l>>24), byte(l>>16), byte(l>>8), byte(l)), nil
+}
+
+func (l LocalPref) String() string {
+	return fmt.Sprintf("LocalPref(%d)", uint32(l))
+}
+
+// 4octetのAttribute Valueを符号なし整数値に変換する
+func decodeUint32(av []byte) uint32 {
+	return uint32(av[0])<<24 | uint32(av[1])<<16 | uint32(av[2])<<8 | uint32(av[3])
+}
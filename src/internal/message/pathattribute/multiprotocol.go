@@ -0,0 +1,243 @@
+package pathattribute
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/ip"
+)
+
+// Multiprotocol Extensions(RFC 4760)で、IPv4 Unicast以外のNLRIを運ぶPathAttribute
+// 本実装はIPv4 UnicastとIPv6 Unicastに対応する。
+
+// MP_REACH_NLRI
+// 到達可能なNLRIと、そのNEXT_HOPを表す。
+type MPReachNLRI struct {
+	family bgp.Family
+	// IPv6の場合は、グローバルアドレスとリンクローカルアドレスの2つを持つことがある(RFC 2545)
+	nextHop []net.IP
+	nlri    []ip.Prefix
+}
+
+func NewMPReachNLRI(f bgp.Family, nh []net.IP, nlri []ip.Prefix) (MPReachNLRI, error) {
+	if err := checkFamily(f, nlri); err != nil {
+		return MPReachNLRI{}, err
+	}
+	var nhs []net.IP
+	switch f.AFI {
+	case bgp.AFIIPv4:
+		if len(nh) != 1 || nh[0].To4() == nil {
+			return MPReachNLRI{}, fmt.Errorf("invalid next hop: %v", nh)
+		}
+		nhs = []net.IP{slices.Clone(nh[0].To4())}
+	case bgp.AFIIPv6:
+		if len(nh) == 0 || len(nh) > 2 {
+			return MPReachNLRI{}, fmt.Errorf("invalid next hop: %v", nh)
+		}
+		for i, n := range nh {
+			if n.To4() != nil || n.To16() == nil {
+				return MPReachNLRI{}, fmt.Errorf("invalid next hop: %v", nh)
+			}
+			// 2つ目はリンクローカルアドレスでなければならない
+			if i == 1 && !n.IsLinkLocalUnicast() {
+				return MPReachNLRI{}, fmt.Errorf("invalid link-local next hop: %v", n)
+			}
+			nhs = append(nhs, slices.Clone(n.To16()))
+		}
+	}
+	return MPReachNLRI{family: f, nextHop: nhs, nlri: slices.Clone(nlri)}, nil
+}
+
+func (m MPReachNLRI) Family() bgp.Family {
+	return m.family
+}
+
+func (m MPReachNLRI) NextHops() []net.IP {
+	nhs := make([]net.IP, 0, len(m.nextHop))
+	for _, n := range m.nextHop {
+		nhs = append(nhs, slices.Clone(n))
+	}
+	return nhs
+}
+
+func (m MPReachNLRI) NLRI() []ip.Prefix {
+	return slices.Clone(m.nlri)
+}
+
+// NLRIを置き換えたMP_REACH_NLRIを返す
+// 元のMP_REACH_NLRIは変更しない。
+func (m MPReachNLRI) WithNLRI(nlri []ip.Prefix) MPReachNLRI {
+	m.nlri = slices.Clone(nlri)
+	return m
+}
+
+func (m MPReachNLRI) nextHopLen() int {
+	if m.family.AFI == bgp.AFIIPv4 {
+		return net.IPv4len * len(m.nextHop)
+	}
+	return net.IPv6len * len(m.nextHop)
+}
+
+// AFI(2octet) + SAFI(1octet) + Next Hopの長さ(1octet) + Next Hop +
+// Reserved(1octet) + NLRI
+func (m MPReachNLRI) valueLen() uint16 {
+	return 2 + 1 + 1 + uint16(m.nextHopLen()) + 1 + prefixesLen(m.nlri)
+}
+
+func (m MPReachNLRI) BytesLen() uint16 {
+	return bytesLen(m.valueLen())
+}
+
+func (m MPReachNLRI) Type() AttrType {
+	return MPR
+}
+
+func (m MPReachNLRI) MarshalBytes() ([]byte, error) {
+	b := attrHeader(flagOptional, MPR, m.valueLen())
+	b = append(b, byte(m.family.AFI>>8), byte(m.family.AFI), byte(m.family.SAFI))
+	b = append(b, byte(m.nextHopLen()))
+	for _, n := range m.nextHop {
+		if m.family.AFI == bgp.AFIIPv4 {
+			b = append(b, n.To4()...)
+			continue
+		}
+		b = append(b, n.To16()...)
+	}
+	// Reserved
+	b = append(b, 0)
+	return appendPrefixes(b, m.nlri)
+}
+
+func (m MPReachNLRI) String() string {
+	return fmt.Sprintf("MPReachNLRI{family: %v, nextHop: %v, nlri: %v}",
+		m.family, m.nextHop, m.nlri)
+}
+
+// MP_UNREACH_NLRI
+// 到達不能になったNLRIを表す。
+type MPUnreachNLRI struct {
+	family    bgp.Family
+	withdrawn []ip.Prefix
+}
+
+func NewMPUnreachNLRI(f bgp.Family, wr []ip.Prefix) (MPUnreachNLRI, error) {
+	if err := checkFamily(f, wr); err != nil {
+		return MPUnreachNLRI{}, err
+	}
+	return MPUnreachNLRI{family: f, withdrawn: slices.Clone(wr)}, nil
+}
+
+func (m MPUnreachNLRI) Family() bgp.Family {
+	return m.family
+}
+
+func (m MPUnreachNLRI) Withdrawn() []ip.Prefix {
+	return slices.Clone(m.withdrawn)
+}
+
+// AFI(2octet) + SAFI(1octet) + Withdrawn Routes
+func (m MPUnreachNLRI) valueLen() uint16 {
+	return 2 + 1 + prefixesLen(m.withdrawn)
+}
+
+func (m MPUnreachNLRI) BytesLen() uint16 {
+	return bytesLen(m.valueLen())
+}
+
+func (m MPUnreachNLRI) Type() AttrType {
+	return MPU
+}
+
+func (m MPUnreachNLRI) MarshalBytes() ([]byte, error) {
+	b := attrHeader(flagOptional, MPU, m.valueLen())
+	b = append(b, byte(m.family.AFI>>8), byte(m.family.AFI), byte(m.family.SAFI))
+	return appendPrefixes(b, m.withdrawn)
+}
+
+func (m MPUnreachNLRI) String() string {
+	return fmt.Sprintf("MPUnreachNLRI{family: %v, withdrawn: %v}", m.family, m.withdrawn)
+}
+
+// 対応しているAFI/SAFIであり、PrefixがAFIと一致しているかを確認する
+func checkFamily(f bgp.Family, ps []ip.Prefix) error {
+	if f != bgp.IPv4Unicast && f != bgp.IPv6Unicast {
+		return fmt.Errorf("unsupported AFI/SAFI: %v", f)
+	}
+	for _, p := range ps {
+		if p.AFI() != f.AFI {
+			return fmt.Errorf("prefix does not match AFI: %v, %v", f, p)
+		}
+	}
+	return nil
+}
+
+func prefixesLen(ps []ip.Prefix) uint16 {
+	l := uint16(0)
+	for _, p := range ps {
+		l += uint16(p.Len())
+	}
+	return l
+}
+
+func appendPrefixes(b []byte, ps []ip.Prefix) ([]byte, error) {
+	for _, p := range ps {
+		pb, err := p.MarshalBytes()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, pb...)
+	}
+	return b, nil
+}
+
+// MP_REACH_NLRIのAttribute ValueからMPReachNLRIを生成する
+func decodeMPReachNLRI(av []byte) (MPReachNLRI, error) {
+	if len(av) < 5 {
+		return MPReachNLRI{}, fmt.Errorf("invalid MP_REACH_NLRI length: %d", len(av))
+	}
+	f := bgp.Family{
+		AFI:  bgp.AFI(uint16(av[0])<<8 | uint16(av[1])),
+		SAFI: bgp.SAFI(av[2]),
+	}
+	nhl := int(av[3])
+	// Next Hopの後ろにReserved(1octet)が続く
+	if len(av) < 4+nhl+1 {
+		return MPReachNLRI{}, fmt.Errorf("invalid next hop length: %d", nhl)
+	}
+	nhb := av[4 : 4+nhl]
+	var nh []net.IP
+	switch {
+	case f.AFI == bgp.AFIIPv4 && nhl == net.IPv4len:
+		nh = []net.IP{net.IP(append([]byte{}, nhb...))}
+	case f.AFI == bgp.AFIIPv6 && (nhl == net.IPv6len || nhl == 2*net.IPv6len):
+		for len(nhb) > 0 {
+			nh = append(nh, net.IP(append([]byte{}, nhb[:net.IPv6len]...)))
+			nhb = nhb[net.IPv6len:]
+		}
+	default:
+		return MPReachNLRI{}, fmt.Errorf("invalid next hop length: %v, %d", f, nhl)
+	}
+	nlri, err := ip.NewPrefixesFromBytes(f.AFI, av[4+nhl+1:])
+	if err != nil {
+		return MPReachNLRI{}, err
+	}
+	return NewMPReachNLRI(f, nh, nlri)
+}
+
+// MP_UNREACH_NLRIのAttribute ValueからMPUnreachNLRIを生成する
+func decodeMPUnreachNLRI(av []byte) (MPUnreachNLRI, error) {
+	if len(av) < 3 {
+		return MPUnreachNLRI{}, fmt.Errorf("invalid MP_UNREACH_NLRI length: %d", len(av))
+	}
+	f := bgp.Family{
+		AFI:  bgp.AFI(uint16(av[0])<<8 | uint16(av[1])),
+		SAFI: bgp.SAFI(av[2]),
+	}
+	wr, err := ip.NewPrefixesFromBytes(f.AFI, av[3:])
+	if err != nil {
+		return MPUnreachNLRI{}, err
+	}
+	return NewMPUnreachNLRI(f, wr)
+}
@@ -3,82 +3,336 @@ package pathattribute
 import (
 	"fmt"
 	"net"
+	"slices"
 
 	"github.com/SotaUeda/usbgp/internal/bgp"
 )
 
+// UPDATE MessageのPath Attribute
+// PathAttributeの値は、生成した後に変更しない(immutable)。
+// 受信したPathAttributeは複数のRIBや対向機器に送信するUPDATE Messageで共有されるため、
+// 値を変更する場合は、元の値を変更せずに新しい値を生成する。
+// 内部にスライスを持つPathAttributeは、生成時と取得時にスライスをコピーする。
 type PathAttribute interface {
+	// Attribute Type Code
+	Type() AttrType
 	BytesLen() uint16
 	MarshalBytes() ([]byte, error)
 }
 
-func NewPathAttributesFromBytes(b []byte) ([]PathAttribute, error) {
+// Attribute Flags
+const (
+	flagOptional   uint8 = 0b10000000
+	flagTransitive uint8 = 0b01000000
+	flagPartial    uint8 = 0b00100000
+	flagExtLen     uint8 = 0b00010000
+)
+
+// Byte列からPathAttributeへの変換に必要な、ネゴシエーションしたCapabilityの情報
+type DecodeOptions struct {
+	// 4-octet AS Number Capabilityをネゴシエーションしているか
+	FourOctetAS bool
+}
+
+// Byte列からPathAttributeに変換する
+// RFC 7606に従い、不正なPathAttributeはErrActionに応じて処理する。
+// セッションを切断するエラー(SessionReset)の場合はerrorを返し、
+// それ以外のエラーは変換できたPathAttributeとともに[]AttrErrとして返す。
+// エラーとなったPathAttributeは、返すPathAttributeに含めない。
+func NewPathAttributesFromBytes(b []byte, opts DecodeOptions) ([]PathAttribute, []AttrErr, error) {
 	pas := make([]PathAttribute, 0)
+	var errs []AttrErr
+	seen := make(map[AttrType]struct{})
 	for len(b) > 0 {
+		// 以降のPathAttributeを区切れない場合は、どのNLRIを取り下げるべきか判断できないため、
+		// セッションを切断する
 		if len(b) < 3 {
-			return nil, fmt.Errorf("invalid path attribute length: %d", len(b))
+			return nil, nil, newAttrErr(errMalformedAttributeList, nil,
+				"invalid path attribute length: %d", len(b))
 		}
 		// Attribute Flags
 		af := b[0]
 		// Attribute Type Code
-		atc := b[1]
+		atc := AttrType(b[1])
 		// Attribute Length
 		// Attribute FlagsのExtended Length bitが立っているかを判定
 		// bitが立っている場合は、Attribute Lengthを表すoctetが2byteで表現される
-		al := uint16(b[2])
-		if af&0b00010000 != 0 {
-			al = uint16(b[2])<<8 + uint16(b[3])
-		}
-
 		i := 3
-		j := i + int(al)
+		al := int(b[2])
+		if af&flagExtLen != 0 {
+			if len(b) < 4 {
+				return nil, nil, newAttrErr(errMalformedAttributeList, nil,
+					"invalid path attribute length: %d", len(b))
+			}
+			al = int(b[2])<<8 + int(b[3])
+			i = 4
+		}
+		j := i + al
 		if len(b) < j {
-			return nil, fmt.Errorf("PathAttributeのByte列が短すぎます length: %v", len(b))
+			return nil, nil, newAttrErr(errMalformedAttributeList, nil,
+				"PathAttributeのByte列が短すぎます length: %v", len(b))
 		}
+		// エラー時にNOTIFICATION MessageのDataとして使用する
+		// Attribute Type, Attribute Length, Attribute Valueを含むByte列
+		ab := b[:j]
 		// Attribute Value
-		av := b[3 : 3+al]
-		switch AttrType(atc) {
-		case ORG:
-			if len(av) != 1 {
-				return nil, fmt.Errorf("invalid origin length: %d", len(av))
+		av := b[i:j]
+		b = b[j:]
+		// 同じPathAttributeが複数含まれている場合は、最初のもの以外を破棄する
+		// MP_REACH_NLRI, MP_UNREACH_NLRIはどのNLRIを処理すべきか判断できないため、
+		// セッションを切断する(RFC 7606 3章 g)。
+		if _, ok := seen[atc]; ok {
+			e := newAttrErr(errMalformedAttributeList, nil, "duplicate path attribute: %v", atc)
+			e.Attr = slices.Clone(ab)
+			if atc == MPR || atc == MPU {
+				e.Action = SessionReset
+				return nil, nil, e
 			}
-			o, err := NewOrigin(av[0])
-			if err != nil {
-				return nil, err
-			}
-			pas = append(pas, o)
-		case ASP:
-			if len(av) < 3 {
-				return nil, fmt.Errorf("invalid AS path length: %d", len(av))
-			}
-			st := ASPathSegmentType(av[0])
-			sl := int(av[1])
-			idx := 2
-			sv := make([]bgp.ASNumber, sl)
-			for i := 0; i < sl; i++ {
-				sv[i] = bgp.ASNumber(av[idx])<<8 + bgp.ASNumber(av[idx+1])
-				idx += 2
-			}
-			p, err := NewASPath(st, sv)
-			if err != nil {
-				return nil, err
-			}
-			pas = append(pas, p)
-		case NHP:
-			if len(av) != 4 {
-				return nil, fmt.Errorf("invalid next hop length: %d", len(av))
+			e.Action = AttributeDiscard
+			errs = append(errs, e)
+			continue
+		}
+		seen[atc] = struct{}{}
+		pa, err := decodeAttr(af, atc, ab, av, opts)
+		if err != nil {
+			e, ok := err.(AttrErr)
+			if !ok {
+				e = newAttrErr(errMalformedAttributeList, nil, "%v", err)
 			}
-			nh, err := NewNextHop(av)
-			if err != nil {
-				return nil, err
+			e.Action, e.Family = errAction(atc, e.Subcode, av)
+			e.Attr = slices.Clone(ab)
+			if e.Action == SessionReset {
+				return nil, nil, e
 			}
-			pas = append(pas, nh)
-		default:
-			pas = append(pas, DontKnow(b))
+			errs = append(errs, e)
+			continue
 		}
-		b = b[3+al:]
+		if pa != nil {
+			pas = append(pas, pa)
+		}
+	}
+	if !opts.FourOctetAS {
+		pas = mergeAS4(pas)
 	}
-	return pas, nil
+	return pas, errs, nil
+}
+
+// 1つのPathAttributeのAttribute ValueからPathAttributeを生成する
+// 破棄するPathAttributeの場合は、nilを返す。
+func decodeAttr(af uint8, atc AttrType, ab, av []byte, opts DecodeOptions) (PathAttribute, error) {
+	asLen := twoOctetASLen
+	if opts.FourOctetAS {
+		asLen = fourOctetASLen
+	}
+	switch atc {
+	case ORG, ASP, NHP, LPF, ATA:
+		// Well-knownなPathAttributeは
+		// Optional bitが0、Transitive bitが1でなければならない
+		if af&(flagOptional|flagTransitive) != flagTransitive {
+			return nil, newAttrErr(errAttributeFlagsError, ab,
+				"invalid attribute flags: %08b, type: %v", af, atc)
+		}
+	}
+	switch atc {
+	case ORG:
+		if len(av) != 1 {
+			return nil, newAttrErr(errAttributeLengthError, ab,
+				"invalid origin length: %d", len(av))
+		}
+		o, err := NewOrigin(av[0])
+		if err != nil {
+			return nil, newAttrErr(errInvalidOriginAttribute, ab, "%v", err)
+		}
+		return o, nil
+	case ASP:
+		p, err := decodeASPath(av, asLen)
+		if err != nil {
+			return nil, newAttrErr(errMalformedASPath, nil, "%v", err)
+		}
+		return p, nil
+	case NHP:
+		if len(av) != 4 {
+			return nil, newAttrErr(errAttributeLengthError, ab,
+				"invalid next hop length: %d", len(av))
+		}
+		nh, err := NewNextHop(av)
+		if err != nil {
+			return nil, newAttrErr(errInvalidNextHopAttribute, ab, "%v", err)
+		}
+		// 0.0.0.0やマルチキャストアドレスはNEXT_HOPとして使用できない
+		ip := nh.Val()
+		if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			return nil, newAttrErr(errInvalidNextHopAttribute, ab,
+				"invalid next hop: %v", ip)
+		}
+		return nh, nil
+	case MED:
+		// Optional Non-transitiveでなければならない
+		if af&(flagOptional|flagTransitive) != flagOptional {
+			return nil, newAttrErr(errAttributeFlagsError, ab,
+				"invalid attribute flags: %08b, type: %v", af, atc)
+		}
+		if len(av) != 4 {
+			return nil, newAttrErr(errAttributeLengthError, ab,
+				"invalid multi exit disc length: %d", len(av))
+		}
+		return MultiExitDisc(decodeUint32(av)), nil
+	case LPF:
+		if len(av) != 4 {
+			return nil, newAttrErr(errAttributeLengthError, ab,
+				"invalid local pref length: %d", len(av))
+		}
+		return LocalPref(decodeUint32(av)), nil
+	case ATA:
+		if len(av) != 0 {
+			return nil, newAttrErr(errAttributeLengthError, ab,
+				"invalid atomic aggregate length: %d", len(av))
+		}
+		return AtomicAggregate{}, nil
+	case AGG:
+		if af&(flagOptional|flagTransitive) != flagOptional|flagTransitive {
+			return nil, newAttrErr(errAttributeFlagsError, ab,
+				"invalid attribute flags: %08b, type: %v", af, atc)
+		}
+		if len(av) != 4+asLen {
+			return nil, newAttrErr(errAttributeLengthError, ab,
+				"invalid aggregator length: %d", len(av))
+		}
+		return decodeAggregator(av, asLen), nil
+	case COM, EXC, LGC:
+		if af&(flagOptional|flagTransitive) != flagOptional|flagTransitive {
+			return nil, newAttrErr(errAttributeFlagsError, ab,
+				"invalid attribute flags: %08b, type: %v", af, atc)
+		}
+		var (
+			pa  PathAttribute
+			err error
+		)
+		switch atc {
+		case COM:
+			pa, err = decodeCommunities(av)
+		case EXC:
+			pa, err = decodeExtendedCommunities(av)
+		case LGC:
+			pa, err = decodeLargeCommunities(av)
+		}
+		if err != nil {
+			return nil, newAttrErr(errOptionalAttributeError, ab, "%v", err)
+		}
+		return pa, nil
+	case MPR, MPU:
+		// Optional bitが1でなければならない
+		if af&flagOptional == 0 {
+			return nil, newAttrErr(errAttributeFlagsError, ab,
+				"invalid attribute flags: %08b, type: %v", af, atc)
+		}
+		var (
+			pa  PathAttribute
+			err error
+		)
+		if atc == MPR {
+			pa, err = decodeMPReachNLRI(av)
+		} else {
+			pa, err = decodeMPUnreachNLRI(av)
+		}
+		if err != nil {
+			return nil, newAttrErr(errOptionalAttributeError, ab, "%v", err)
+		}
+		return pa, nil
+	case AS4P:
+		// 4-octet AS Number Capabilityをネゴシエーションしている対向機器からの
+		// AS4_PATH、および不正なAS4_PATHは破棄する(RFC 6793 6章)。
+		if opts.FourOctetAS || af&flagOptional == 0 {
+			return nil, nil
+		}
+		p, err := decodeASPath(av, fourOctetASLen)
+		if err != nil {
+			return nil, nil
+		}
+		return AS4Path{path: p}, nil
+	case AS4A:
+		// AS4_PATHと同様に、破棄する場合がある
+		if opts.FourOctetAS || af&flagOptional == 0 || len(av) != 8 {
+			return nil, nil
+		}
+		return AS4Aggregator(decodeAggregator(av, fourOctetASLen)), nil
+	}
+	// 認識できないWell-knownなPathAttributeはエラーとする
+	if af&flagOptional == 0 {
+		return nil, newAttrErr(errUnrecognizedWellKnownAttribute, ab,
+			"unrecognized well-known attribute: %v", atc)
+	}
+	// 認識できないOptional Non-transitiveなPathAttributeは破棄し、
+	// Optional Transitiveなものは、Partial bitを立てて対向機器に引き継ぐ(RFC 4271 5章)。
+	if af&flagTransitive == 0 {
+		return nil, nil
+	}
+	return newDontKnow(af|flagPartial, atc, av), nil
+}
+
+// 不正なPathAttributeの種類から、RFC 7606 7章で定められたErrActionを返す
+// AFI/SAFI disableの場合は、対象のAFI/SAFIも返す。
+func errAction(atc AttrType, subcode uint8, av []byte) (ErrAction, bgp.Family) {
+	// RFC 7606は認識できないWell-knownなPathAttributeの処理を変更しないため、
+	// RFC 4271 6.3の通りセッションを切断する
+	if subcode == errUnrecognizedWellKnownAttribute {
+		return SessionReset, bgp.Family{}
+	}
+	switch atc {
+	case ATA, AGG:
+		return AttributeDiscard, bgp.Family{}
+	case MPR, MPU:
+		// AFI/SAFIを判断できない、または対応していないAFI/SAFIの場合は、セッションを切断する
+		if len(av) < 3 {
+			return SessionReset, bgp.Family{}
+		}
+		f := bgp.Family{
+			AFI:  bgp.AFI(uint16(av[0])<<8 | uint16(av[1])),
+			SAFI: bgp.SAFI(av[2]),
+		}
+		if f != bgp.IPv4Unicast && f != bgp.IPv6Unicast {
+			return SessionReset, bgp.Family{}
+		}
+		return AFISAFIDisable, f
+	}
+	return TreatAsWithdraw, bgp.Family{}
+}
+
+// 2octetまたは4octetのAS番号を変換する
+func decodeAS(b []byte) bgp.ASNumber {
+	var as bgp.ASNumber
+	for _, v := range b {
+		as = as<<8 | bgp.ASNumber(v)
+	}
+	return as
+}
+
+// UPDATE MessageにNLRIが含まれる場合、必ず含まれていなければならない
+// Well-knownなPathAttributeが揃っているかを確認する。
+// NEXT_HOPはIPv4のNLRIが含まれる場合(nextHopがtrue)のみ必要で、
+// MP_REACH_NLRIのNLRIのみの場合は不要である(RFC 4760 3章)。
+// 揃っていない場合は、不足しているAttrTypeとfalseを返す。
+func MissingWellKnown(pas []PathAttribute, nextHop bool) (AttrType, bool) {
+	has := make(map[AttrType]bool)
+	for _, pa := range pas {
+		switch pa.(type) {
+		case Origin:
+			has[ORG] = true
+		case ASPath:
+			has[ASP] = true
+		case NextHop:
+			has[NHP] = true
+		}
+	}
+	if !nextHop {
+		has[NHP] = true
+	}
+	for _, t := range []AttrType{ORG, ASP, NHP} {
+		if !has[t] {
+			return t, false
+		}
+	}
+	return 0, true
 }
 
 func bytesLen(i uint16) uint16 {
@@ -94,13 +348,33 @@ func bytesLen(i uint16) uint16 {
 	return len
 }
 
+// Attribute Flags, Attribute Type Code, Attribute Lengthのbytesを返す
+// Attribute Lengthが1byteで表現できない場合は、Extended Length bitを立てる。
+func attrHeader(af uint8, atc AttrType, al uint16) []byte {
+	if al > 255 {
+		return []byte{af | flagExtLen, byte(atc), byte(al >> 8), byte(al)}
+	}
+	return []byte{af, byte(atc), byte(al)}
+}
+
 type AttrType uint8
 
 //go:generate stringer -type=AttrType pathattribute.go
 const (
-	ORG AttrType = 1
-	ASP AttrType = 2
-	NHP AttrType = 3
+	ORG  AttrType = 1
+	ASP  AttrType = 2
+	NHP  AttrType = 3
+	MED  AttrType = 4
+	LPF  AttrType = 5
+	ATA  AttrType = 6
+	AGG  AttrType = 7
+	COM  AttrType = 8
+	MPR  AttrType = 14
+	MPU  AttrType = 15
+	EXC  AttrType = 16
+	AS4P AttrType = 17
+	AS4A AttrType = 18
+	LGC  AttrType = 32
 )
 
 type Origin uint8
@@ -128,6 +402,10 @@ func (o Origin) BytesLen() uint16 {
 	return bytesLen(1)
 }
 
+func (o Origin) Type() AttrType {
+	return ORG
+}
+
 func (o Origin) MarshalBytes() ([]byte, error) {
 	aFlg := 0b01000000 // Attribute Flags
 	aTC := ORG         // Attribute Type Code
@@ -136,195 +414,13 @@ func (o Origin) MarshalBytes() ([]byte, error) {
 	return []byte{byte(aFlg), byte(aTC), byte(al), byte(av)}, nil
 }
 
-type ASPath interface {
-	PathAttribute
-	asMarshalBytes() ([]byte, error)
-	SegType() ASPathSegmentType
-	SegLen() uint8 // ASの数を返す
-	Contains(bgp.ASNumber) bool
-}
-
-type ASPathSegmentType uint8
-
-//go:generate stringer -type=ASPathSegmentType pathattribute.go
-const (
-	ASSegTypeSet      ASPathSegmentType = 1
-	ASSegTypeSequence ASPathSegmentType = 2
-)
-
-// Type, Length, Valueの合計Octet数を返す
-func asByteLen(a ASPath) uint16 {
-	// ASSetかASSequenceかを表すoctet + ASの数を表すoctet + ASのbytesの値
-	l := uint16(2 * a.SegLen())
-	return l + 1 + 1
-}
-
-func AppendASPath(ap ASPath, as bgp.ASNumber) (ASPath, error) {
-	switch a := (ap).(type) {
-	case ASSequence:
-		// appendは新しいスライス(構造体)を返す
-		a = append(a, as)
-		return a, nil
-	case ASSet:
-		a[as] = struct{}{}
-		return a, nil
-	}
-	return nil, fmt.Errorf("invalid ASPath type: %T", ap)
-}
-
-type ASSequence []bgp.ASNumber
-
-func (seq ASSequence) BytesLen() uint16 {
-	bl := asByteLen(seq)
-
-	return bytesLen(bl)
-}
-
-func (seq ASSequence) SegType() ASPathSegmentType {
-	return ASSegTypeSequence
-}
-
-func (seq ASSequence) SegLen() uint8 {
-	return uint8(len(seq))
-}
-
-func (seq ASSequence) asMarshalBytes() ([]byte, error) {
-	if len(seq) == 0 {
-		return nil, fmt.Errorf("ASPathSegment is empty")
-	}
-
-	b := make([]byte, asByteLen(seq))
-
-	b[0] = byte(seq.SegType())
-	b[1] = byte(seq.SegLen())
-	idx := 2
-	for _, as := range seq {
-		b[idx] = byte(as >> 8)
-		b[idx+1] = byte(as)
-		idx += 2
-	}
-	return b, nil
-}
-
-func (seq ASSequence) MarshalBytes() ([]byte, error) {
-	af := 0b01000000     // Attribute Flags
-	atc := ASP           // Attribute Type Code
-	al := asByteLen(seq) // Attribute Length
-	av, err := seq.asMarshalBytes()
-	if err != nil {
-		return nil, err
-	}
-	b := make([]byte, seq.BytesLen())
-	if al > 255 {
-		af += 0b00010000
-		b[0] = byte(af)
-		b[1] = byte(atc)
-		b[2] = byte(al >> 8)
-		b[3] = byte(al)
-		copy(b[4:], av)
-	} else {
-		b[0] = byte(af)
-		b[1] = byte(atc)
-		b[2] = byte(al)
-		copy(b[3:], av)
-	}
-	return b, nil
-}
-
-func (seq ASSequence) Contains(as bgp.ASNumber) bool {
-	for _, a := range seq {
-		if a == as {
-			return true
-		}
-	}
-	return false
-}
-
-type ASSet map[bgp.ASNumber]struct{}
-
-func (set ASSet) BytesLen() uint16 {
-	bl := asByteLen(set)
-
-	return bytesLen(bl)
-}
-
-func (set ASSet) SegType() ASPathSegmentType {
-	return ASSegTypeSet
-}
-
-func (set ASSet) SegLen() uint8 {
-	return uint8(len(set))
-}
-
-func (set ASSet) asMarshalBytes() ([]byte, error) {
-	if len(set) == 0 {
-		return nil, fmt.Errorf("ASPathSegment is empty")
-	}
-
-	b := make([]byte, asByteLen(set))
-
-	b[0] = byte(set.SegType())
-	b[1] = byte(set.SegLen())
-	idx := 2
-	for as := range set {
-		b[idx] = byte(as >> 8)
-		b[idx+1] = byte(as)
-		idx += 2
-	}
-	return b, nil
-}
-
-func (set ASSet) MarshalBytes() ([]byte, error) {
-	af := 0b01000000     // Attribute Flags
-	atc := ASP           // Attribute Type Code
-	al := asByteLen(set) // Attribute Length
-	av, err := set.asMarshalBytes()
-	if err != nil {
-		return nil, err
-	}
-	b := make([]byte, set.BytesLen())
-	if al > 255 {
-		af += 0b00010000
-		b[0] = byte(af)
-		b[1] = byte(atc)
-		b[2] = byte(al >> 8)
-		b[3] = byte(al)
-		copy(b[4:], av)
-	} else {
-		b[0] = byte(af)
-		b[1] = byte(atc)
-		b[2] = byte(al)
-		copy(b[3:], av)
-	}
-	return b, nil
-}
-
-func (set ASSet) Contains(as bgp.ASNumber) bool {
-	_, ok := set[as]
-	return ok
-}
-
-func NewASPath(t ASPathSegmentType, as []bgp.ASNumber) (ASPath, error) {
-	switch t {
-	case ASSegTypeSequence:
-		return ASSequence(as), nil
-	case ASSegTypeSet:
-		set := make(map[bgp.ASNumber]struct{})
-		for _, a := range as {
-			set[a] = struct{}{}
-		}
-		return ASSet(set), nil
-	}
-	return nil, fmt.Errorf("invalid ASPathSegmentType: %d", t)
-}
-
 type NextHop []byte
 
 func NewNextHop(n []byte) (NextHop, error) {
 	if len(n) != 4 {
 		return nil, fmt.Errorf("invalid next hop length: %d", len(n))
 	}
-	return NextHop(n), nil
+	return NextHop(slices.Clone(n)), nil
 }
 
 func (n NextHop) BytesLen() uint16 {
@@ -333,11 +429,15 @@ func (n NextHop) BytesLen() uint16 {
 
 func (n NextHop) Val() net.IP {
 	if len(n) == 4 {
-		return net.IP(n)
+		return net.IP(slices.Clone(n))
 	}
 	return nil
 }
 
+func (n NextHop) Type() AttrType {
+	return NHP
+}
+
 func (n NextHop) MarshalBytes() ([]byte, error) {
 	if len(n) != 4 {
 		return nil, fmt.Errorf("invalid next hop length: %d", len(n))
@@ -348,12 +448,40 @@ func (n NextHop) MarshalBytes() ([]byte, error) {
 	return []byte{byte(af), byte(atc), byte(al), n[0], n[1], n[2], n[3]}, nil
 }
 
-type DontKnow []byte
+// 認識できないOptional TransitiveなPathAttribute
+// 受信したAttribute Flags, Attribute Type Code, Attribute Valueをそのまま保持し、
+// 対向機器に送信する際に使用する。
+type DontKnow struct {
+	flags uint8
+	typ   AttrType
+	val   []byte
+}
+
+// Extended Length bitは、送信する際のAttribute Lengthから決める
+func newDontKnow(af uint8, atc AttrType, av []byte) DontKnow {
+	return DontKnow{flags: af &^ flagExtLen, typ: atc, val: slices.Clone(av)}
+}
+
+func (d DontKnow) Flags() uint8 {
+	return d.flags
+}
+
+func (d DontKnow) Type() AttrType {
+	return d.typ
+}
+
+func (d DontKnow) Value() []byte {
+	return slices.Clone(d.val)
+}
 
 func (d DontKnow) BytesLen() uint16 {
-	return bytesLen(uint16(len(d)))
+	return bytesLen(uint16(len(d.val)))
 }
 
 func (d DontKnow) MarshalBytes() ([]byte, error) {
-	return d, nil
+	return append(attrHeader(d.flags, d.typ, uint16(len(d.val))), d.val...), nil
+}
+
+func (d DontKnow) String() string {
+	return fmt.Sprintf("DontKnow{flags: %08b, type: %d, value: %x}", d.flags, d.typ, d.val)
 }
@@ -0,0 +1,127 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+// ROUTE-REFRESH MessageのMessage Subtype
+// RFC 2918ではReservedとされていたフィールドで、RFC 7313で定められている。
+type RouteRefreshSubtype uint8
+
+const (
+	// 通常のRoute Refreshの要求
+	NormalRequest RouteRefreshSubtype = 0
+	// Beginning of Route Refresh
+	BoRR RouteRefreshSubtype = 1
+	// End of Route Refresh
+	EoRR RouteRefreshSubtype = 2
+)
+
+// ROUTE-REFRESH Message
+// (https://datatracker.ietf.org/doc/html/rfc2918#section-3)
+type RouteRefreshMessage struct {
+	header  *Header
+	afi     bgp.AFI
+	subtype RouteRefreshSubtype
+	safi    bgp.SAFI
+}
+
+func (*RouteRefreshMessage) Type() Type {
+	return RouteRefresh
+}
+
+func NewRouteRefreshMsg(
+	afi bgp.AFI,
+	safi bgp.SAFI,
+	st RouteRefreshSubtype,
+) (*RouteRefreshMessage, error) {
+	h, err := newHeader(23, RouteRefresh)
+	if err != nil {
+		return nil, err
+	}
+	return &RouteRefreshMessage{
+		header:  h,
+		afi:     afi,
+		subtype: st,
+		safi:    safi,
+	}, nil
+}
+
+func (r *RouteRefreshMessage) AFI() bgp.AFI {
+	return r.afi
+}
+
+func (r *RouteRefreshMessage) SAFI() bgp.SAFI {
+	return r.safi
+}
+
+func (r *RouteRefreshMessage) Subtype() RouteRefreshSubtype {
+	return r.subtype
+}
+
+func (r *RouteRefreshMessage) marshalBytes() ([]byte, error) {
+	b := make([]byte, 23)
+	// Header
+	h, err := r.header.marshalBytes()
+	if err != nil {
+		return nil, err
+	}
+	copy(b, h)
+	// AFI
+	b[19] = uint8(r.afi >> 8)
+	b[20] = uint8(r.afi)
+	// Message Subtype
+	b[21] = uint8(r.subtype)
+	// SAFI
+	b[22] = uint8(r.safi)
+	return b, nil
+}
+
+func (r *RouteRefreshMessage) unMarshalBytes(b []byte) error {
+	hLen := 19
+	// Header
+	// message.goから利用する場合、Headerは作成済
+	if r.header == nil {
+		h := &Header{}
+		if len(b) < hLen {
+			return NewConvMsgErr(
+				MessageHeaderError, BadMessageLength, nil,
+				fmt.Sprintf("Byte列が短すぎます: %d", len(b)),
+			)
+		}
+		err := h.unMarshalBytes(b[:hLen])
+		if err != nil {
+			return err
+		}
+		r.header = h
+		b = b[hLen:]
+	}
+	// ROUTE-REFRESH Messageの長さは23byte固定
+	// 長さが異なる場合は、Message全体をDataとして通知する(RFC 7313 5章)。
+	if len(b) != 4 {
+		h, err := r.header.marshalBytes()
+		if err != nil {
+			return err
+		}
+		return NewConvMsgErr(
+			RouteRefreshMessageError, InvalidMessageLength, append(h, b...),
+			fmt.Sprintf("ROUTE-REFRESH MessageのByte列が不正です: %d", len(b)),
+		)
+	}
+	// AFI
+	r.afi = bgp.AFI(uint16(b[0])<<8 | uint16(b[1]))
+	// Message Subtype
+	r.subtype = RouteRefreshSubtype(b[2])
+	// SAFI
+	r.safi = bgp.SAFI(b[3])
+	return nil
+}
+
+func (r *RouteRefreshMessage) String() string {
+	return fmt.Sprintf(
+		"RouteRefreshMessage{header: %v, afi: %d, subtype: %d, safi: %d}",
+		r.header, r.afi, r.subtype, r.safi,
+	)
+}
@@ -0,0 +1,45 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+)
+
+func TestRouteRefreshMessageMarshalAndUnmarshal(t *testing.T) {
+	for _, st := range []RouteRefreshSubtype{NormalRequest, BoRR, EoRR} {
+		r, err := NewRouteRefreshMsg(bgp.AFIIPv4, bgp.SAFIUnicast, st)
+		if err != nil {
+			t.Error(err)
+		}
+		b, err := Marshal(r)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(b) != 23 {
+			t.Errorf("route refresh message length = %d, want 23", len(b))
+		}
+		r2, err := UnMarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !routeRefreshMsgEqual(r, r2.(*RouteRefreshMessage), t) {
+			t.Errorf("route refresh message not equal: %v, %v", r, r2)
+		}
+	}
+}
+
+func routeRefreshMsgEqual(r1, r2 *RouteRefreshMessage, t *testing.T) bool {
+	if !headerEqual(r1.header, r2.header, t) {
+		return false
+	}
+	if r1.afi != r2.afi || r1.safi != r2.safi {
+		t.Errorf("route refresh message afi/safi not equal: %v, %v", r1, r2)
+		return false
+	}
+	if r1.subtype != r2.subtype {
+		t.Errorf("route refresh message subtype not equal: %v, %v", r1.subtype, r2.subtype)
+		return false
+	}
+	return true
+}
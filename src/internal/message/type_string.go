@@ -10,26 +10,19 @@ func _() {
 	var x [1]struct{}
 	_ = x[Open-1]
 	_ = x[Update-2]
+	_ = x[Notification-3]
 	_ = x[Keepalive-4]
+	_ = x[RouteRefresh-5]
 }
 
-const (
-	_Type_name_0 = "OpenUpdate"
-	_Type_name_1 = "Keepalive"
-)
+const _Type_name = "OpenUpdateNotificationKeepaliveRouteRefresh"
 
-var (
-	_Type_index_0 = [...]uint8{0, 4, 10}
-)
+var _Type_index = [...]uint8{0, 4, 10, 22, 31, 43}
 
 func (i Type) String() string {
-	switch {
-	case 1 <= i && i <= 2:
-		i -= 1
-		return _Type_name_0[_Type_index_0[i]:_Type_index_0[i+1]]
-	case i == 4:
-		return _Type_name_1
-	default:
-		return "Type(" + strconv.FormatInt(int64(i), 10) + ")"
+	i -= 1
+	if i >= Type(len(_Type_index)-1) {
+		return "Type(" + strconv.FormatInt(int64(i+1), 10) + ")"
 	}
+	return _Type_name[_Type_index[i]:_Type_index[i+1]]
 }
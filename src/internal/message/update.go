@@ -14,6 +14,8 @@ type UpdateMessage struct {
 	pathAttrBytesLen uint16 // bytesにしたときのオクテット数
 	pathAttributes   []pathattribute.PathAttribute
 	nlri             []*ip.IPv4Net
+	// 受信したUPDATE Messageの、セッションを切断しないPathAttributeのエラー(RFC 7606)
+	attrErrs []pathattribute.AttrErr
 	// NLRIのオクテット数はBGP UpdateMessageに含めず、
 	// Headerのサイズを計算することにしか使用しないため、
 	// メンバに含めていない。
@@ -31,6 +33,25 @@ func (u *UpdateMessage) NLRI() []*ip.IPv4Net {
 	return u.nlri
 }
 
+func (u *UpdateMessage) WithdrawnRoutes() []*ip.IPv4Net {
+	return u.withdrawnRoutes
+}
+
+// 受信したUPDATE Messageで発生した、セッションを切断しないエラー
+func (u *UpdateMessage) AttrErrors() []pathattribute.AttrErr {
+	return u.attrErrs
+}
+
+// 受信したUPDATE Messageに適用する、最も影響の大きいErrAction
+// エラーがない場合は0を返す。
+func (u *UpdateMessage) ErrAction() pathattribute.ErrAction {
+	var a pathattribute.ErrAction
+	for _, e := range u.attrErrs {
+		a = max(a, e.Action)
+	}
+	return a
+}
+
 func NewUpdateMsg(
 	pas []pathattribute.PathAttribute,
 	nlri []*ip.IPv4Net,
@@ -127,6 +148,11 @@ func (u *UpdateMessage) marshalBytes() ([]byte, error) {
 }
 
 func (u *UpdateMessage) unMarshalBytes(b []byte) error {
+	return u.unMarshal(b, pathattribute.DecodeOptions{})
+}
+
+// ネゴシエーションしたCapabilityに応じて、Byte列をUpdateMessageに変換する
+func (u *UpdateMessage) unMarshal(b []byte, opts pathattribute.DecodeOptions) error {
 	// Header
 	// message.goから利用する場合、Headerは作成済
 	if u.header == nil {
@@ -142,7 +168,10 @@ func (u *UpdateMessage) unMarshalBytes(b []byte) error {
 
 	// Withdrawn Routes Length
 	if len(b) < 2 {
-		return NewConvMsgErr(fmt.Sprintf("UpdateMessageのByte列が短すぎます length: %v", len(b)))
+		return NewConvMsgErr(
+			UpdateMessageError, MalformedAttributeList, nil,
+			fmt.Sprintf("UpdateMessageのByte列が短すぎます length: %v", len(b)),
+		)
 	}
 	u.wrBytesLen = uint16(b[0])<<8 | uint16(b[1])
 
@@ -150,12 +179,17 @@ func (u *UpdateMessage) unMarshalBytes(b []byte) error {
 	i := 2
 	j := i + int(u.wrBytesLen)
 	if len(b) < j {
-		return NewConvMsgErr(fmt.Sprintf("UpdateMessageのByte列が短すぎます length: %v", len(b)))
+		return NewConvMsgErr(
+			UpdateMessageError, MalformedAttributeList, nil,
+			fmt.Sprintf("UpdateMessageのByte列が短すぎます length: %v", len(b)),
+		)
 	}
 	wr, err := ip.NewIPv4NetsFromBytes(b[i:j])
 	if err != nil {
-		err := ConvMsgErr{Err: err}
-		return err
+		return NewConvMsgErr(
+			UpdateMessageError, InvalidNetworkField, nil,
+			fmt.Sprintf("Withdrawn Routesが不正です: %v", err),
+		)
 	}
 	u.withdrawnRoutes = wr
 
@@ -163,7 +197,10 @@ func (u *UpdateMessage) unMarshalBytes(b []byte) error {
 	i = j
 	j = i + 2
 	if len(b) < j {
-		return NewConvMsgErr(fmt.Sprintf("UpdateMessageのByte列が短すぎます length: %v", len(b)))
+		return NewConvMsgErr(
+			UpdateMessageError, MalformedAttributeList, nil,
+			fmt.Sprintf("UpdateMessageのByte列が短すぎます length: %v", len(b)),
+		)
 	}
 	u.pathAttrBytesLen = uint16(b[i])<<8 | uint16(b[i+1])
 
@@ -171,27 +208,56 @@ func (u *UpdateMessage) unMarshalBytes(b []byte) error {
 	i = j
 	j = i + int(u.pathAttrBytesLen)
 	if len(b) < j {
-		return NewConvMsgErr(fmt.Sprintf("UpdateMessageのByte列が短すぎます length: %v", len(b)))
+		return NewConvMsgErr(
+			UpdateMessageError, MalformedAttributeList, nil,
+			fmt.Sprintf("UpdateMessageのByte列が短すぎます length: %v", len(b)),
+		)
 	}
-	pas, err := pathattribute.NewPathAttributesFromBytes(b[i:j])
+	pas, errs, err := pathattribute.NewPathAttributesFromBytes(b[i:j], opts)
 	if err != nil {
-		err := ConvMsgErr{Err: err}
-		return err
+		return newUpdateAttrErr(err)
 	}
 	u.pathAttributes = pas
+	u.attrErrs = errs
 
 	// NLRI
 	i = j
 	nlri, err := ip.NewIPv4NetsFromBytes(b[i:])
 	if err != nil {
-		err := ConvMsgErr{Err: err}
-		return err
+		return NewConvMsgErr(
+			UpdateMessageError, InvalidNetworkField, nil,
+			fmt.Sprintf("NLRIが不正です: %v", err),
+		)
 	}
 	u.nlri = nlri
 
+	// NLRIが存在する場合、Well-knownなPathAttributeが揃っていなければならない
+	// 揃っていない場合は、NLRIを取り下げられたルートとして処理する(RFC 7606 3章 d)。
+	// 不正なPathAttributeによって、すでに取り下げる場合は確認しない。
+	if (len(u.nlri) > 0 || u.hasMPReachNLRI()) && u.ErrAction() < pathattribute.TreatAsWithdraw {
+		if t, ok := pathattribute.MissingWellKnown(u.pathAttributes, len(u.nlri) > 0); !ok {
+			u.attrErrs = append(u.attrErrs, pathattribute.AttrErr{
+				Err:     fmt.Errorf("Well-knownなPathAttributeがありません: %v", t),
+				Subcode: uint8(MissingWellKnownAttribute),
+				Data:    []byte{uint8(t)},
+				Action:  pathattribute.TreatAsWithdraw,
+			})
+		}
+	}
+
 	return nil
 }
 
+// NLRIを含むMP_REACH_NLRIを持っているかを返す
+func (u *UpdateMessage) hasMPReachNLRI() bool {
+	for _, pa := range u.pathAttributes {
+		if r, ok := pa.(pathattribute.MPReachNLRI); ok && len(r.NLRI()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *UpdateMessage) String() string {
 	return fmt.Sprintf(
 		"UpdateMessage{header: %v, wrBytesLen: %v, withdrawnRoutes: %v, "+
@@ -2,6 +2,7 @@ package message
 
 import (
 	"net"
+	"slices"
 	"testing"
 
 	"github.com/SotaUeda/usbgp/internal/bgp"
@@ -20,10 +21,23 @@ func TestUpdateMessageMarshalAndUnmarshal(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	ag, err := pathattribute.NewAggregator(localAS, localIP)
+	if err != nil {
+		t.Error(err)
+	}
 	pas := []pathattribute.PathAttribute{
 		pathattribute.Igp,
 		ap,
 		pathattribute.NextHop(localIP),
+		pathattribute.MultiExitDisc(50),
+		pathattribute.LocalPref(200),
+		pathattribute.AtomicAggregate{},
+		ag,
+		pathattribute.NewCommunities([]pathattribute.Community{64513<<16 | 100, pathattribute.NoExport}),
+		pathattribute.NewExtendedCommunities([]pathattribute.ExtendedCommunity{
+			pathattribute.NewLinkBandwidth(64513, 1250000),
+		}),
+		pathattribute.NewLargeCommunities([]pathattribute.LargeCommunity{{GlobalAdmin: 4200000001, LocalData1: 1, LocalData2: 2}}),
 	}
 
 	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
@@ -41,13 +55,353 @@ func TestUpdateMessageMarshalAndUnmarshal(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	u2, err := UnMarshal(b)
+	u2, err := UnMarshal(b, WithFourOctetAS(true))
 	if err != nil {
 		t.Error(err)
 	}
 	if !updateMsgeEqual(u, u2.(*UpdateMessage), t) {
 		t.Errorf("update message not equal:\n%v\n%v", u, u2)
 	}
+	// Type()は、バイト列のAttribute Type Codeと一致する
+	for _, pa := range u2.(*UpdateMessage).PathAttributes() {
+		pab, err := pa.MarshalBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pathattribute.AttrType(pab[1]); pa.Type() != got {
+			t.Errorf("%T.Type() = %v, want %v", pa, pa.Type(), got)
+		}
+	}
+}
+
+// 4-octet AS Number Capabilityをネゴシエーションしていない対向機器とは、
+// AS_TRANSとAS4_PATH, AS4_AGGREGATORを使って4octetのAS番号を交換する
+func TestUpdateMessageWithTwoOctetAS(t *testing.T) {
+	someAS := bgp.ASNumber(4200000001)
+	localAS := bgp.ASNumber(64514)
+	localIP := net.ParseIP("10.200.100.3").To4()
+
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{someAS, localAS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag, err := pathattribute.NewAggregator(someAS, net.ParseIP("10.0.100.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pas := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		pathattribute.NextHop(localIP),
+		ag,
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewUpdateMsg(
+		pathattribute.ToTwoOctetAS(pas),
+		[]*ip.IPv4Net{ipv4nw},
+		[]*ip.IPv4Net{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4-octet AS Number Capabilityに対応していない実装は、AS_TRANSを受信する
+	u2, err := UnMarshal(b, WithFourOctetAS(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// AS_PATH, AGGREGATORは4octetのAS番号に復元される
+	if !test.PathAttributesEqual(pas, u2.(*UpdateMessage).PathAttributes(), t) {
+		t.Errorf("path attributes not equal:\n%v\n%v", pas, u2.(*UpdateMessage).PathAttributes())
+	}
+}
+
+// 複数のSegmentを持つAS_PATHは、Segmentの順序とAS_SETの順序を保持して送受信する
+func TestUpdateMessageWithMultiSegmentASPath(t *testing.T) {
+	segment := func(st pathattribute.ASPathSegmentType, as ...bgp.ASNumber) pathattribute.ASPathSegment {
+		s, err := pathattribute.NewASPathSegment(st, as)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	ap := pathattribute.NewASPathFromSegments(
+		segment(pathattribute.ASSegTypeConfedSequence, 65001),
+		segment(pathattribute.ASSegTypeSequence, 64513, 4200000001),
+		segment(pathattribute.ASSegTypeSet, 64601, 64600),
+	)
+	if got := ap.String(); got != "[(65001) 64513 4200000001 {64601,64600}]" {
+		t.Errorf("String() = %v", got)
+	}
+	// AS_SETは1、ConfederationのSegmentは0として数える
+	if ap.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", ap.Len())
+	}
+	if !ap.Contains(64600) || ap.NeighborAS() != 64513 {
+		t.Errorf("Contains() = %v, NeighborAS() = %v", ap.Contains(64600), ap.NeighborAS())
+	}
+	pas := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		pathattribute.NextHop(net.ParseIP("10.200.100.3").To4()),
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fourOctetAS := range []bool{true, false} {
+		attrs := pas
+		if !fourOctetAS {
+			attrs = pathattribute.ToTwoOctetAS(pas)
+		}
+		u, err := NewUpdateMsg(attrs, []*ip.IPv4Net{ipv4nw}, []*ip.IPv4Net{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Marshal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u2, err := UnMarshal(b, WithFourOctetAS(fourOctetAS))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.PathAttributesEqual(pas, u2.(*UpdateMessage).PathAttributes(), t) {
+			t.Errorf("path attributes not equal (four octet AS: %v):\n%v\n%v",
+				fourOctetAS, pas, u2.(*UpdateMessage).PathAttributes())
+		}
+	}
+}
+
+// 認識できないOptional TransitiveなPathAttributeは、Partial bitを立てて1つずつ保持し、
+// Optional Non-transitiveなものは破棄する
+func TestUnknownPathAttributes(t *testing.T) {
+	b := []byte{
+		0x40, 0x01, 0x01, 0x00, // ORIGIN
+		0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfc, 0x01, // AS_PATH
+		0xc0, 0xc8, 0x02, 0xab, 0xcd, // Optional Transitive
+		0x80, 0xc9, 0x01, 0x01, // Optional Non-transitive
+		0xd0, 0xca, 0x00, 0x01, 0xff, // Optional Transitive(Extended Length)
+	}
+	pas, errs, err := pathattribute.NewPathAttributesFromBytes(b, pathattribute.DecodeOptions{FourOctetAS: true})
+	if err != nil || len(errs) > 0 {
+		t.Fatal(err, errs)
+	}
+	want := [][]byte{
+		{0xe0, 0xc8, 0x02, 0xab, 0xcd},
+		{0xe0, 0xca, 0x01, 0xff},
+	}
+	var got [][]byte
+	for _, pa := range pas {
+		if _, ok := pa.(pathattribute.DontKnow); !ok {
+			continue
+		}
+		b, err := pa.MarshalBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(pa.BytesLen()) != len(b) {
+			t.Errorf("BytesLen() = %d, want %d", pa.BytesLen(), len(b))
+		}
+		got = append(got, b)
+	}
+	if len(pas) != 4 || !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("unknown attributes = %x, want %x", got, want)
+	}
+}
+
+// Segmentに含められるAS番号は255までであり、先頭に追加するAS番号が入らない場合は新しいSegmentを追加する
+func TestPrependASPath(t *testing.T) {
+	as := make([]bgp.ASNumber, pathattribute.MaxASPathSegmentLen)
+	for i := range as {
+		as[i] = bgp.ASNumber(64600 + i)
+	}
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, as[:pathattribute.MaxASPathSegmentLen-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap = ap.Prepend(64513)
+	if segs := ap.Segments(); len(segs) != 1 || len(segs[0].ASNumbers()) != pathattribute.MaxASPathSegmentLen {
+		t.Fatalf("Segments() = %v, want 1 full segment", segs)
+	}
+	ap2 := ap.Prepend(64514)
+	segs := ap2.Segments()
+	if len(segs) != 2 || !slices.Equal(segs[0].ASNumbers(), []bgp.ASNumber{64514}) {
+		t.Fatalf("Segments() = %v, want new segment", segs)
+	}
+	if ap2.Len() != pathattribute.MaxASPathSegmentLen+1 || ap.Len() != pathattribute.MaxASPathSegmentLen {
+		t.Errorf("Len() = %d, %d", ap2.Len(), ap.Len())
+	}
+	// AS_SETの前にはAS_SEQUENCEのSegmentを追加する
+	set, err := pathattribute.NewASPath(pathattribute.ASSegTypeSet, []bgp.ASNumber{64600, 64601})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := set.Prepend(64513).String(); got != "[64513 {64600,64601}]" {
+		t.Errorf("Prepend() = %v", got)
+	}
+}
+
+// Communityは"ASN:value"形式、またはWell-known Communityの名前で表す
+func TestParseCommunity(t *testing.T) {
+	tests := []struct {
+		s     string
+		want  pathattribute.Community
+		isErr bool
+	}{
+		{s: "64512:100", want: 64512<<16 | 100},
+		{s: "0:0", want: 0},
+		{s: "no-export", want: pathattribute.NoExport},
+		{s: "no-advertise", want: pathattribute.NoAdvertise},
+		{s: "no-export-subconfed", want: pathattribute.NoExportSubconfed},
+		{s: "no-peer", want: pathattribute.NoPeer},
+		{s: "65536:1", isErr: true},
+		{s: "64512", isErr: true},
+		{s: "foo:bar", isErr: true},
+	}
+	for _, tt := range tests {
+		c, err := pathattribute.ParseCommunity(tt.s)
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("ParseCommunity(%q) = %v, want error", tt.s, c)
+			}
+			continue
+		}
+		if err != nil || c != tt.want {
+			t.Errorf("ParseCommunity(%q) = %v, %v, want %v", tt.s, c, err, tt.want)
+		}
+		if c.String() != tt.s {
+			t.Errorf("String() = %v, want %v", c.String(), tt.s)
+		}
+	}
+}
+
+// Large Communityは"ASN:function:parameter"形式で表す
+func TestParseLargeCommunity(t *testing.T) {
+	tests := []struct {
+		s     string
+		want  pathattribute.LargeCommunity
+		isErr bool
+	}{
+		{s: "4200000001:100:200", want: pathattribute.LargeCommunity{GlobalAdmin: 4200000001, LocalData1: 100, LocalData2: 200}},
+		{s: "64512:0:0", want: pathattribute.LargeCommunity{GlobalAdmin: 64512}},
+		{s: "64512:100", isErr: true},
+		{s: "4294967296:1:1", isErr: true},
+	}
+	for _, tt := range tests {
+		c, err := pathattribute.ParseLargeCommunity(tt.s)
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("ParseLargeCommunity(%q) = %v, want error", tt.s, c)
+			}
+			continue
+		}
+		if err != nil || c != tt.want {
+			t.Errorf("ParseLargeCommunity(%q) = %v, %v, want %v", tt.s, c, err, tt.want)
+		}
+		if c.String() != tt.s {
+			t.Errorf("String() = %v, want %v", c.String(), tt.s)
+		}
+	}
+}
+
+// Extended CommunityはSub-Typeの名前とGlobal Administrator、Local Administratorで表す
+func TestParseExtendedCommunity(t *testing.T) {
+	tests := []struct {
+		s          string
+		typ        uint8
+		subType    uint8
+		transitive bool
+		isErr      bool
+	}{
+		{s: "rt:64512:100", typ: pathattribute.ExtTypeTwoOctetAS, subType: pathattribute.ExtSubTypeRouteTarget, transitive: true},
+		{s: "rt:4200000001:100", typ: pathattribute.ExtTypeFourOctetAS, subType: pathattribute.ExtSubTypeRouteTarget, transitive: true},
+		{s: "rt:192.0.2.1:100", typ: pathattribute.ExtTypeIPv4, subType: pathattribute.ExtSubTypeRouteTarget, transitive: true},
+		{s: "soo:64512:100", typ: pathattribute.ExtTypeTwoOctetAS, subType: pathattribute.ExtSubTypeRouteOrigin, transitive: true},
+		{s: "lb:64512:1250000", typ: pathattribute.ExtTypeTwoOctetAS, subType: pathattribute.ExtSubTypeLinkBandwidth, transitive: false},
+		{s: "rt:4200000001:65536", isErr: true},
+		{s: "rt:192.0.2.1:65536", isErr: true},
+		{s: "foo:64512:100", isErr: true},
+		{s: "rt:64512", isErr: true},
+	}
+	for _, tt := range tests {
+		c, err := pathattribute.ParseExtendedCommunity(tt.s)
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("ParseExtendedCommunity(%q) = %v, want error", tt.s, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseExtendedCommunity(%q): %v", tt.s, err)
+			continue
+		}
+		if c.Type() != tt.typ || c.SubType() != tt.subType || c.IsTransitive() != tt.transitive {
+			t.Errorf("ParseExtendedCommunity(%q) = %x", tt.s, c[:])
+		}
+		if c.String() != tt.s {
+			t.Errorf("String() = %v, want %v", c.String(), tt.s)
+		}
+	}
+}
+
+// IPv6のNLRIはMP_REACH_NLRI, MP_UNREACH_NLRIで運ばれ、NEXT_HOPは含まれない
+func TestUpdateMessageWithMPReachNLRI(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("2001:db8:1::/48")
+	ipv6nw, err := ip.NewIPv6Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wnw, _ := net.ParseCIDR("2001:db8:2::/64")
+	wipv6nw, err := ip.NewIPv6Net(wnw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reach, err := pathattribute.NewMPReachNLRI(
+		bgp.IPv6Unicast,
+		[]net.IP{net.ParseIP("2001:db8::3"), net.ParseIP("fe80::3")},
+		[]ip.Prefix{ipv6nw},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreach, err := pathattribute.NewMPUnreachNLRI(bgp.IPv6Unicast, []ip.Prefix{wipv6nw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pas := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		reach,
+		unreach,
+	}
+	u, err := NewUpdateMsg(pas, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := UnMarshal(b, WithFourOctetAS(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updateMsgeEqual(u, u2.(*UpdateMessage), t) {
+		t.Errorf("update message not equal:\n%v\n%v", u, u2)
+	}
 }
 
 func updateMsgeEqual(u1, u2 *UpdateMessage, t *testing.T) bool {
@@ -0,0 +1,276 @@
+package rib
+
+import (
+	"log"
+	"slices"
+
+	"github.com/SotaUeda/usbgp/config"
+	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/ip"
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
+)
+
+// 経路集約(RFC 4271 9.2.2.2)
+// LocRIBのベストパスのうち、集約するPrefixより長いPrefixのルート(集約されるルート)が
+// 1つ以上存在する場合に、集約ルートを自身が広告するルートとしてLocRIBに追加する。
+// 集約されるルートがなくなった場合は、集約ルートを取り下げる。
+
+// 集約ルートの設定と、生成した集約ルート
+type aggregate struct {
+	cfg config.Aggregate
+	// 自身が広告するルートのPathAttribute
+	// 集約ルートのNEXT_HOP(MP_REACH_NLRI)として使用する。
+	local []pathattribute.PathAttribute
+	// 集約ルートに付加するAGGREGATOR
+	aggregator pathattribute.Aggregator
+	// 生成した集約ルート
+	// 集約されるルートが存在しない場合はnil
+	entry *RIBEntry
+}
+
+// 集約ルートの設定を追加し、集約ルートを生成する
+// 呼び出し元でLockを取得している必要がある。
+func (l *LocRIB) addAggregate(c *config.Config, cfg config.Aggregate) error {
+	local, err := localAttrs(c, cfg.Prefix.AFI())
+	if err != nil {
+		return err
+	}
+	ag, err := pathattribute.NewAggregator(c.LocalAS(), c.RouterID())
+	if err != nil {
+		return err
+	}
+	a := &aggregate{cfg: cfg, local: local, aggregator: ag}
+	f := familyOf(cfg.Prefix)
+	t, ok := l.aggs[f]
+	if !ok {
+		t = newTrie[*aggregate]()
+		l.aggs[f] = t
+	}
+	t.Put(cfg.Prefix, a)
+	if changed, _ := l.aggregate(a); changed {
+		l.reaggregate([]ip.Prefix{cfg.Prefix})
+	}
+	return nil
+}
+
+// 変更されたPrefix(nws)を含む集約ルートを生成し直す
+// 集約ルート自身も、より短いPrefixの集約ルートに集約される場合があるため、
+// Prefixが長い集約ルートから順に生成し、変更された場合はそれを含む集約ルートも生成し直す。
+// Summary-onlyの集約ルートが生成された、または取り下げられた場合は、
+// AdjRIBOutで広告するかどうかが変わる、集約されるルートのPrefixを返す。
+// 呼び出し元でLockを取得している必要がある。
+func (l *LocRIB) reaggregate(nws []ip.Prefix) []ip.Prefix {
+	dirty := map[*aggregate]struct{}{}
+	mark := func(nw ip.Prefix) {
+		t, ok := l.aggs[familyOf(nw)]
+		if !ok {
+			return
+		}
+		t.WalkLessSpecifics(nw, func(_ ip.Prefix, a *aggregate) bool {
+			dirty[a] = struct{}{}
+			return true
+		})
+	}
+	for _, nw := range nws {
+		mark(nw)
+	}
+	var suppressed []ip.Prefix
+	for len(dirty) > 0 {
+		var next *aggregate
+		for a := range dirty {
+			if next == nil || prefixLen(a.cfg.Prefix) > prefixLen(next.cfg.Prefix) {
+				next = a
+			}
+		}
+		delete(dirty, next)
+		changed, toggled := l.aggregate(next)
+		if changed {
+			mark(next.cfg.Prefix)
+		}
+		if toggled && next.cfg.SummaryOnly {
+			suppressed = append(suppressed, l.contributorPrefixes(next)...)
+		}
+	}
+	return suppressed
+}
+
+func prefixLen(nw ip.Prefix) int {
+	ones, _ := nw.Net().Mask.Size()
+	return ones
+}
+
+// 集約されるルート
+// 集約するPrefixより長いPrefixのベストパスである。
+func (l *LocRIB) contributors(a *aggregate) []*RIBEntry {
+	var es []*RIBEntry
+	r, ok := l.tables[familyOf(a.cfg.Prefix)]
+	if !ok {
+		return nil
+	}
+	r.routes.WalkMoreSpecifics(a.cfg.Prefix, func(_ ip.Prefix, rs []*RIBEntry) bool {
+		if len(rs) > 0 {
+			es = append(es, rs[0])
+		}
+		return true
+	})
+	return es
+}
+
+func (l *LocRIB) contributorPrefixes(a *aggregate) []ip.Prefix {
+	var nws []ip.Prefix
+	for _, e := range l.contributors(a) {
+		nws = append(nws, e.nw)
+	}
+	return nws
+}
+
+// 集約されるルートから集約ルートを生成し直し、候補に反映する
+// 集約ルートが変わった場合はchangedを、
+// 集約ルートが生成された、または取り下げられた場合はtoggledをtrueで返す。
+func (l *LocRIB) aggregate(a *aggregate) (changed, toggled bool) {
+	cs := l.contributors(a)
+	if len(cs) == 0 {
+		if a.entry == nil {
+			return false, false
+		}
+		l.removePath(a.entry)
+		a.entry.release()
+		a.entry = nil
+		l.decide(a.cfg.Prefix)
+		return true, true
+	}
+	s := attrSets.intern(a.attrs(cs))
+	if a.entry != nil && a.entry.attrs == s {
+		attrSets.release(s)
+		return false, false
+	}
+	toggled = a.entry == nil
+	if a.entry != nil {
+		l.removePath(a.entry)
+		a.entry.release()
+	}
+	a.entry = newRIBEntry(a.cfg.Prefix, s)
+	l.addPath(a.entry)
+	l.decide(a.cfg.Prefix)
+	return true, toggled
+}
+
+// 集約されるルート(cs)から、集約ルートのPathAttributeを生成する
+// ORIGINは集約されるルートの中で最も大きい値を使用する。
+// AS_SETを生成しない場合は、AS_PATHを空にしてATOMIC_AGGREGATEを付加する。
+// AS_SETを生成する場合は、集約されるルートのAS番号をすべて含むAS_PATH(aggregateASPath)を使用し、
+// 集約されるルートがATOMIC_AGGREGATEを持つ場合のみ付加する。
+func (a *aggregate) attrs(cs []*RIBEntry) []pathattribute.PathAttribute {
+	origin := pathattribute.Igp
+	var (
+		paths  []pathattribute.ASPath
+		atomic = !a.cfg.ASSet
+	)
+	for _, e := range cs {
+		origin = max(origin, e.origin())
+		for _, pa := range e.PathAttributes() {
+			switch pa := pa.(type) {
+			case pathattribute.ASPath:
+				paths = append(paths, pa)
+			case pathattribute.AtomicAggregate:
+				atomic = true
+			}
+		}
+	}
+	attrs := make([]pathattribute.PathAttribute, 0, len(a.local)+2)
+	for _, pa := range a.local {
+		switch pa.(type) {
+		case pathattribute.Origin:
+			attrs = append(attrs, origin)
+		case pathattribute.ASPath:
+			if !a.cfg.ASSet {
+				attrs = append(attrs, pa)
+				continue
+			}
+			ap, err := aggregateASPath(paths)
+			if err != nil {
+				log.Printf("failed to create AS_SET: %v", err)
+				attrs = append(attrs, pa)
+				continue
+			}
+			attrs = append(attrs, ap)
+		default:
+			attrs = append(attrs, pa)
+		}
+	}
+	if atomic {
+		attrs = append(attrs, pathattribute.AtomicAggregate{})
+	}
+	return append(attrs, a.aggregator)
+}
+
+// 集約されるルートのAS_PATH(paths)から、集約ルートのAS_PATHを生成する(RFC 4271 9.2.2.2)
+// すべてのAS_PATHの先頭に共通するAS_SEQUENCEはそのまま残し、
+// それ以外のAS番号は、共通するAS_SEQUENCEに含まれるものを除いてAS_SETにまとめる。
+// 同じ集約されるルートから同じAS_SETを生成するように、AS_SETは重複を除いて昇順に並べる。
+func aggregateASPath(paths []pathattribute.ASPath) (pathattribute.ASPath, error) {
+	if len(paths) == 0 {
+		return pathattribute.ASPath{}, nil
+	}
+	common := leadingSequence(paths[0])
+	for _, p := range paths[1:] {
+		seq := leadingSequence(p)
+		n := 0
+		for n < len(common) && n < len(seq) && common[n] == seq[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	var rest []bgp.ASNumber
+	for _, p := range paths {
+		// 共通するAS_SEQUENCEは、AS_PATHの先頭のAS番号である
+		for _, as := range p.ASNumbers()[len(common):] {
+			if !slices.Contains(common, as) {
+				rest = append(rest, as)
+			}
+		}
+	}
+	slices.Sort(rest)
+	rest = slices.Compact(rest)
+	var segs []pathattribute.ASPathSegment
+	for _, s := range []struct {
+		t   pathattribute.ASPathSegmentType
+		asn []bgp.ASNumber
+	}{
+		{pathattribute.ASSegTypeSequence, common},
+		{pathattribute.ASSegTypeSet, rest},
+	} {
+		ap, err := pathattribute.NewASPath(s.t, s.asn)
+		if err != nil {
+			return pathattribute.ASPath{}, err
+		}
+		segs = append(segs, ap.Segments()...)
+	}
+	return pathattribute.NewASPathFromSegments(segs...), nil
+}
+
+// AS_PATHの先頭のAS_SEQUENCEのAS番号
+// 先頭のSegmentがAS_SEQUENCEでない場合は空を返す。
+func leadingSequence(p pathattribute.ASPath) []bgp.ASNumber {
+	segs := p.Segments()
+	if len(segs) == 0 || segs[0].Type() != pathattribute.ASSegTypeSequence {
+		return nil
+	}
+	return segs[0].ASNumbers()
+}
+
+// Prefixのルートが、生成されているSummary-onlyの集約ルートに集約されるかを返す
+// 集約されるルートは、対向機器に広告しない。
+// 呼び出し元でLockを取得している必要がある。
+func (l *LocRIB) suppressed(nw ip.Prefix) bool {
+	t, ok := l.aggs[familyOf(nw)]
+	if !ok {
+		return false
+	}
+	found := false
+	t.WalkLessSpecifics(nw, func(_ ip.Prefix, a *aggregate) bool {
+		found = a.cfg.SummaryOnly && a.entry != nil
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,101 @@
+package rib
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
+)
+
+// RIBEntryで共有する、インターンされたPathAttributeの集まり
+// 1つのUPDATE Messageで受信したルートや、異なるPeerから受信した同じPathAttributeのルートは、
+// 同じattrSetを参照する。
+// PathAttributeは変更しないため、attrSetもLockなしで読み出せる。
+type attrSet struct {
+	attrs []pathattribute.PathAttribute
+	// attrsKeyで生成したバイト列
+	// バイト列に変換できず、共有しないattrSetは空
+	key string
+	// 参照の数
+	// attrSetを共有するRIBEntryを保持しているRIBごとに、参照を取得する。
+	// attrTableのLockを取得して変更する。
+	refs int
+}
+
+// PathAttributeのバイト列をキーに、attrSetを重複なく保持するテーブル
+// いずれのRIBからも参照されなくなったattrSetは削除する。
+type attrTable struct {
+	mu   sync.Mutex
+	sets map[string]*attrSet
+}
+
+// すべてのRIBで共有するattrTable
+var attrSets = newAttrTable()
+
+func newAttrTable() *attrTable {
+	return &attrTable{sets: map[string]*attrSet{}}
+}
+
+// PathAttributeの集まりと同じバイト列のattrSetを返す
+// 存在しない場合は新しく登録する。返したattrSetの参照数は1増える。
+func (t *attrTable) intern(pas []pathattribute.PathAttribute) *attrSet {
+	k, err := attrsKey(pas)
+	if err != nil {
+		// バイト列に変換できないPathAttributeは共有しない
+		return &attrSet{attrs: pas, refs: 1}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.sets[k]; ok {
+		s.refs++
+		return s
+	}
+	s := &attrSet{attrs: pas, key: k, refs: 1}
+	t.sets[k] = s
+	return s
+}
+
+// attrSetの参照数を1増やす
+func (t *attrTable) retain(s *attrSet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.refs++
+}
+
+// attrSetの参照数を1減らし、参照がなくなった場合はテーブルから削除する
+// 削除した後もattrSetの値は変わらないため、保持しているRIBEntryはそのまま読み出せる。
+func (t *attrTable) release(s *attrSet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.refs--
+	if s.refs == 0 && t.sets[s.key] == s {
+		delete(t.sets, s.key)
+	}
+}
+
+// テーブルに登録されているattrSetの数
+func (t *attrTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sets)
+}
+
+// PathAttributeの集まりを比較するためのKeyを返す
+// 各PathAttributeのバイト列をAttribute Type Codeの順に並べて連結する。
+// PathAttributeの順序が異なっていても、同じ内容であれば同じKeyになる。
+func attrsKey(pas []pathattribute.PathAttribute) (string, error) {
+	bs := make([][]byte, 0, len(pas))
+	for _, pa := range pas {
+		b, err := pa.MarshalBytes()
+		if err != nil {
+			return "", err
+		}
+		bs = append(bs, b)
+	}
+	// Attribute Type Codeは2octet目
+	sort.SliceStable(bs, func(i, j int) bool {
+		return bs[i][1] < bs[j][1]
+	})
+	return string(bytes.Join(bs, nil)), nil
+}
@@ -0,0 +1,271 @@
+package rib
+
+import (
+	"bytes"
+	"math"
+	"net"
+
+	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
+	"github.com/vishvananda/netlink"
+)
+
+// ルートを受信したPeerの情報
+// ベストパスの選択(RFC 4271 9.1.2)のタイブレークに使用する。
+// 自身が広告するルートはSourceを持たない(nil)。
+type Source struct {
+	// 対向機器のアドレス
+	Address net.IP
+	// 対向機器のBGP Identifier
+	// OPEN Messageを受信するまではnil
+	RouterID net.IP
+	AS       bgp.ASNumber
+	// 自身と同じASのPeer(iBGP)であるか
+	IBGP bool
+	// Import Policyで受信したルートに設定するLOCAL_PREF
+	// nilの場合は、iBGPで受信したLOCAL_PREFを使用する。
+	LocalPref *uint32
+}
+
+// ベストパスが選択された理由
+// 候補を1つに絞り込んだ、Decision Processのステップを表す。
+type Reason int
+
+//go:generate stringer -type=Reason decision.go
+const (
+	// 候補が1つしかない
+	OnlyPath Reason = iota
+	// LOCAL_PREFが大きい
+	HigherLocalPref
+	// AS_PATHが短い
+	ShorterASPath
+	// 自身が広告するルート
+	LocallyOriginated
+	// ORIGINが小さい
+	LowerOrigin
+	// 同じ隣接ASから受信したルートのうち、MEDが小さい
+	LowerMED
+	// iBGPよりeBGPで受信したルート
+	EBGPOverIBGP
+	// NEXT_HOPまでのIGPコストが小さい
+	LowerIGPCost
+	// 対向機器のBGP Identifierが小さい
+	LowerRouterID
+	// 対向機器のアドレスが小さい
+	LowerPeerAddress
+)
+
+// LOCAL_PREFを持たないルートの値
+const defaultLocalPref uint32 = 100
+
+// ルートのLOCAL_PREF
+// LOCAL_PREFを持たないルートはdefaultLocalPrefとして扱う。
+func (e *RIBEntry) localPref() uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, a := range e.attrs.attrs {
+		if lp, ok := a.(pathattribute.LocalPref); ok {
+			return uint32(lp)
+		}
+	}
+	return defaultLocalPref
+}
+
+// ルートのMULTI_EXIT_DISC
+// MEDを持たないルートは0として扱う。
+func (e *RIBEntry) med() uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, a := range e.attrs.attrs {
+		if m, ok := a.(pathattribute.MultiExitDisc); ok {
+			return uint32(m)
+		}
+	}
+	return 0
+}
+
+// AS_PATHの長さ
+// AS_SETは含まれるAS番号の数にかかわらず1として数え、ConfederationのSegmentは数えない。
+func (e *RIBEntry) asPathLen() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, a := range e.attrs.attrs {
+		if ap, ok := a.(pathattribute.ASPath); ok {
+			return ap.Len()
+		}
+	}
+	return 0
+}
+
+func (e *RIBEntry) origin() pathattribute.Origin {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, a := range e.attrs.attrs {
+		if o, ok := a.(pathattribute.Origin); ok {
+			return o
+		}
+	}
+	return pathattribute.Incomplete
+}
+
+// ルートを広告した隣接AS
+// AS_PATHの先頭のAS番号であり、AS_PATHが空の場合は自身のAS内のルートとして0を返す。
+func (e *RIBEntry) neighborAS() bgp.ASNumber {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, a := range e.attrs.attrs {
+		if ap, ok := a.(pathattribute.ASPath); ok {
+			return ap.NeighborAS()
+		}
+	}
+	return 0
+}
+
+// NEXT_HOPまでのIGPコストを返す関数
+// 到達できない場合はfalseを返す。
+type igpCostFunc func(nh net.IP) (uint32, bool)
+
+// カーネルのルーティングテーブルから、NEXT_HOPに到達するルートのメトリックを返す
+func kernelIGPCost(nh net.IP) (uint32, bool) {
+	rts, err := netlink.RouteGet(nh)
+	if err != nil || len(rts) == 0 {
+		return 0, false
+	}
+	return uint32(rts[0].Priority), true
+}
+
+// 同じPrefixの候補から、RFC 4271 9.1.2.2のDecision Processでベストパスを選択する
+// 候補が1つに絞り込まれたステップを、選択された理由として返す。
+// 候補がない場合はnilを返す。
+func selectBest(paths []*RIBEntry, cost igpCostFunc) (*RIBEntry, Reason) {
+	if len(paths) == 0 {
+		return nil, OnlyPath
+	}
+	if len(paths) == 1 {
+		return paths[0], OnlyPath
+	}
+	steps := []struct {
+		reason Reason
+		filter func([]*RIBEntry) []*RIBEntry
+	}{
+		{HigherLocalPref, func(c []*RIBEntry) []*RIBEntry {
+			return keepMin(c, func(e *RIBEntry) int64 { return -int64(e.localPref()) })
+		}},
+		{ShorterASPath, func(c []*RIBEntry) []*RIBEntry {
+			return keepMin(c, func(e *RIBEntry) int64 { return int64(e.asPathLen()) })
+		}},
+		// 自身が広告するルートもLOCAL_PREFを持つルートとして比較し、
+		// LOCAL_PREFとAS_PATHが同じ場合のみ優先する
+		{LocallyOriginated, func(c []*RIBEntry) []*RIBEntry {
+			return keepMin(c, func(e *RIBEntry) int64 {
+				if e.src == nil {
+					return 0
+				}
+				return 1
+			})
+		}},
+		{LowerOrigin, func(c []*RIBEntry) []*RIBEntry {
+			return keepMin(c, func(e *RIBEntry) int64 { return int64(e.origin()) })
+		}},
+		{LowerMED, keepLowestMED},
+		{EBGPOverIBGP, func(c []*RIBEntry) []*RIBEntry {
+			return keepMin(c, func(e *RIBEntry) int64 {
+				if e.src != nil && e.src.IBGP {
+					return 1
+				}
+				return 0
+			})
+		}},
+		{LowerIGPCost, func(c []*RIBEntry) []*RIBEntry {
+			if cost == nil {
+				return c
+			}
+			// 到達できないNEXT_HOPは最大のコストとして扱う
+			return keepMin(c, func(e *RIBEntry) int64 {
+				gw := e.gateway()
+				if gw == nil {
+					return math.MaxInt64
+				}
+				m, ok := cost(gw)
+				if !ok {
+					return math.MaxInt64
+				}
+				return int64(m)
+			})
+		}},
+		{LowerRouterID, func(c []*RIBEntry) []*RIBEntry {
+			return keepLowestIP(c, func(s *Source) net.IP { return s.RouterID.To4() })
+		}},
+		{LowerPeerAddress, func(c []*RIBEntry) []*RIBEntry {
+			return keepLowestIP(c, func(s *Source) net.IP { return s.Address.To16() })
+		}},
+	}
+	cands := paths
+	for _, s := range steps {
+		cands = s.filter(cands)
+		if len(cands) == 1 {
+			return cands[0], s.reason
+		}
+	}
+	// すべてのステップで同じ値の場合は、最初の候補を選択する
+	return cands[0], LowerPeerAddress
+}
+
+// keyが最小の候補のみを残す
+func keepMin(c []*RIBEntry, key func(*RIBEntry) int64) []*RIBEntry {
+	var kept []*RIBEntry
+	min := int64(math.MaxInt64)
+	for _, e := range c {
+		k := key(e)
+		switch {
+		case len(kept) == 0 || k < min:
+			kept = []*RIBEntry{e}
+			min = k
+		case k == min:
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// 同じ隣接ASから受信した候補の中で、MEDが最小でない候補を取り除く
+// MEDは隣接ASごとに比較し、異なる隣接ASのルート同士では比較しない。
+func keepLowestMED(c []*RIBEntry) []*RIBEntry {
+	min := map[bgp.ASNumber]uint32{}
+	for _, e := range c {
+		as := e.neighborAS()
+		if m, ok := min[as]; !ok || e.med() < m {
+			min[as] = e.med()
+		}
+	}
+	var kept []*RIBEntry
+	for _, e := range c {
+		if e.med() == min[e.neighborAS()] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// Sourceのアドレスが最小の候補のみを残す
+// アドレスを持たない候補は最小として扱う。
+func keepLowestIP(c []*RIBEntry, addr func(*Source) net.IP) []*RIBEntry {
+	var (
+		kept   []*RIBEntry
+		lowest net.IP
+	)
+	for _, e := range c {
+		var a net.IP
+		if e.src != nil {
+			a = addr(e.src)
+		}
+		switch cmp := bytes.Compare(a, lowest); {
+		case len(kept) == 0 || cmp < 0:
+			kept = []*RIBEntry{e}
+			lowest = a
+		case cmp == 0:
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/SotaUeda/usbgp/config"
 	"github.com/SotaUeda/usbgp/internal/bgp"
@@ -15,39 +17,95 @@ import (
 )
 
 // 各種RIBの処理の際、以前に処理したエントリは再度処理する必要がない。
-// その判別のためのステータス
+// そのため、各RIBは次のRIBに反映していない変更をキューに記録する。
+// Statusは、キューに記録する変更の種類
 type Status int
 
 //go:generate stringer -type=Status rib.go
 const (
+	// インストールされたエントリ
 	New Status = iota
-	UnChanged
+	// 取り下げられたエントリ
+	Withdrawn
 )
 
 type RIBEntry struct {
-	mu    sync.RWMutex
-	nw    *ip.IPv4Net
-	attrs []pathattribute.PathAttribute
+	mu sync.RWMutex
+	nw ip.Prefix
+	// 同じPathAttributeのエントリと共有する
+	attrs *attrSet
+	// ルートを受信したPeer
+	// 自身が広告するルートはnil
+	src *Source
+	// attrsの参照を解放したか
+	released bool
 }
 
-func NewRIBEntry(nw *ip.IPv4Net, attrs []pathattribute.PathAttribute) *RIBEntry {
+func NewRIBEntry(nw ip.Prefix, attrs []pathattribute.PathAttribute) *RIBEntry {
+	return newRIBEntry(nw, attrSets.intern(attrs))
+}
+
+// attrSetを共有するRIBEntryを生成する
+// RIBEntryを保持するRIBが、それぞれattrSetの参照を取得する。
+func newRIBEntry(nw ip.Prefix, s *attrSet) *RIBEntry {
 	return &RIBEntry{
 		mu:    sync.RWMutex{},
 		nw:    nw,
-		attrs: attrs,
+		attrs: s,
+	}
+}
+
+// RIBEntryを生成したときに取得した、attrSetの参照を解放する
+// 生成した集約ルートを取り下げたときなどに呼び出す。
+func (re *RIBEntry) release() {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if re.released {
+		return
 	}
+	re.released = true
+	attrSets.release(re.attrs)
 }
 
 func (re *RIBEntry) String() string {
 	re.mu.RLock()
 	defer re.mu.RUnlock()
-	return fmt.Sprintf("RIBEntry{nw: %s, attrs: %v}", re.nw, re.attrs)
+	return fmt.Sprintf("RIBEntry{nw: %s, attrs: %v}", re.nw, re.attrs.attrs)
+}
+
+func (re *RIBEntry) Prefix() ip.Prefix {
+	return re.nw
+}
+
+// エントリのPathAttributeを返す
+// 同じPathAttributeのエントリと共有しているため、返したスライスは変更してはならない。
+func (re *RIBEntry) PathAttributes() []pathattribute.PathAttribute {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	return re.attrs.attrs
+}
+
+// ルートを受信したPeerを返す
+// 自身が広告するルートはnilを返す。
+func (re *RIBEntry) Source() *Source {
+	return re.src
+}
+
+// エントリを保持するテーブルのAFI/SAFI
+func (re *RIBEntry) Family() bgp.Family {
+	return familyOf(re.nw)
+}
+
+// Prefixを保持するテーブルのAFI/SAFI
+// 本実装はUnicastのみに対応している。
+func familyOf(nw ip.Prefix) bgp.Family {
+	return bgp.Family{AFI: nw.AFI(), SAFI: bgp.SAFIUnicast}
 }
 
 func (re *RIBEntry) containAS(as bgp.ASNumber) bool {
 	re.mu.RLock()
 	defer re.mu.RUnlock()
-	for _, attr := range re.attrs {
+	for _, attr := range re.attrs.attrs {
 		switch a := attr.(type) {
 		case pathattribute.ASPath:
 			return a.Contains(as)
@@ -56,49 +114,387 @@ func (re *RIBEntry) containAS(as bgp.ASNumber) bool {
 	return false
 }
 
+// ルートのCOMMUNITIES
+// COMMUNITIESを持たないルートは、空のCommunitiesを返す。
+func (re *RIBEntry) communities() pathattribute.Communities {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	for _, attr := range re.attrs.attrs {
+		if cs, ok := attr.(pathattribute.Communities); ok {
+			return cs
+		}
+	}
+	return pathattribute.Communities{}
+}
+
+// 以下は、Policyでルートを照合するための問い合わせ
+
+// ルートがCommunityを持つかを返す
+func (re *RIBEntry) HasCommunity(c pathattribute.Community) bool {
+	return re.communities().Contains(c)
+}
+
+// ルートがLarge Communityを持つかを返す
+func (re *RIBEntry) HasLargeCommunity(c pathattribute.LargeCommunity) bool {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	for _, attr := range re.attrs.attrs {
+		if cs, ok := attr.(pathattribute.LargeCommunities); ok {
+			return cs.Contains(c)
+		}
+	}
+	return false
+}
+
+// ルートがExtended Communityを持つかを返す
+func (re *RIBEntry) HasExtendedCommunity(c pathattribute.ExtendedCommunity) bool {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	for _, attr := range re.attrs.attrs {
+		if cs, ok := attr.(pathattribute.ExtendedCommunities); ok {
+			return cs.Contains(c)
+		}
+	}
+	return false
+}
+
 // AdjRIBIn / LocRIB / AdjRIBOutで同じようなデータ構造・処理をもつため、
 // 共通の処理はribオブジェクトに実装し、これらの3つの構造体のメンバにribを埋め込む。
 //
 // RIBEntryは、3つのribを渡りながら処理される。
-type rib map[*RIBEntry]Status
+// ribはPrefixをキーとするトライでPrefixごとのエントリを保持し、
+// 次のRIBに反映していない変更をchangesに記録する。
+// 保持している間は、エントリのattrSetの参照を取得する。
+type rib struct {
+	routes  *trie[[]*RIBEntry]
+	changes []change
+}
+
+// 次のRIBに反映していない変更
+type change struct {
+	e *RIBEntry
+	s Status
+}
+
+func newRIB() *rib {
+	return &rib{routes: newTrie[[]*RIBEntry]()}
+}
 
 // RIB内にentryが存在しなければInsert
-func (r rib) Insert(ent *RIBEntry) {
-	if _, ok := r[ent]; !ok {
-		r[ent] = New
+func (r *rib) Insert(ent *RIBEntry) {
+	es, _ := r.routes.Get(ent.nw)
+	if slices.Contains(es, ent) {
+		return
+	}
+	r.routes.Put(ent.nw, append(slices.Clip(es), ent))
+	attrSets.retain(ent.attrs)
+	r.changes = append(r.changes, change{e: ent, s: New})
+}
+
+func (r *rib) Routes() []*RIBEntry {
+	if r == nil {
+		return nil
+	}
+	rts := make([]*RIBEntry, 0, r.routes.Len())
+	r.routes.Walk(func(_ ip.Prefix, es []*RIBEntry) bool {
+		rts = append(rts, es...)
+		return true
+	})
+	return rts
+}
+
+// エントリが存在するPrefixを返す
+func (r *rib) prefixes() []ip.Prefix {
+	if r == nil {
+		return nil
+	}
+	nws := make([]ip.Prefix, 0, r.routes.Len())
+	r.routes.Walk(func(nw ip.Prefix, _ []*RIBEntry) bool {
+		nws = append(nws, nw)
+		return true
+	})
+	return nws
+}
+
+// Prefixのエントリを返す
+func (r *rib) entries(nw ip.Prefix) []*RIBEntry {
+	if r == nil {
+		return nil
+	}
+	es, _ := r.routes.Get(nw)
+	return es
+}
+
+// 次のRIBに反映した変更をキューから削除する
+func (r *rib) AllUnchanged() {
+	if r == nil {
+		return
+	}
+	r.changes = nil
+}
+
+// 同じPrefixのエントリを削除し、削除したエントリを返す
+func (r *rib) withdraw(nw ip.Prefix) []*RIBEntry {
+	es, ok := r.routes.Get(nw)
+	if !ok {
+		return nil
+	}
+	r.routes.Delete(nw)
+	for _, e := range es {
+		attrSets.release(e.attrs)
+		r.changes = append(r.changes, change{e: e, s: Withdrawn})
 	}
+	return es
+}
+
+// エントリを削除する
+// エントリが存在しない場合はfalseを返す。
+func (r *rib) remove(ent *RIBEntry) bool {
+	es, _ := r.routes.Get(ent.nw)
+	if !slices.Contains(es, ent) {
+		return false
+	}
+	rest := make([]*RIBEntry, 0, len(es)-1)
+	for _, e := range es {
+		if e != ent {
+			rest = append(rest, e)
+		}
+	}
+	if len(rest) == 0 {
+		r.routes.Delete(ent.nw)
+	} else {
+		r.routes.Put(ent.nw, rest)
+	}
+	attrSets.release(ent.attrs)
+	r.changes = append(r.changes, change{e: ent, s: Withdrawn})
+	return true
+}
+
+// 次のRIBに反映していない変更が存在するかを返す
+func (r *rib) ContainChanged() bool {
+	return r != nil && len(r.changes) > 0
+}
+
+// 変更があったPrefixを、最初に変更された順に重複なく返す
+func (r *rib) changedPrefixes() []ip.Prefix {
+	if r == nil {
+		return nil
+	}
+	seen := map[string]struct{}{}
+	var nws []ip.Prefix
+	for _, c := range r.changes {
+		k := c.e.nw.Net().String()
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		nws = append(nws, c.e.nw)
+	}
+	return nws
+}
+
+// AFI/SAFIごとのrib
+// AdjRIBIn / LocRIB / AdjRIBOutはtablesを埋め込み、
+// RIBEntryはPrefixのAFI/SAFIに対応するribで処理される。
+type tables map[bgp.Family]*rib
+
+func (t tables) table(f bgp.Family) *rib {
+	r, ok := t[f]
+	if !ok {
+		r = newRIB()
+		t[f] = r
+	}
+	return r
+}
+
+func (t tables) Insert(ent *RIBEntry) {
+	t.table(ent.Family()).Insert(ent)
 }
 
-func (r rib) Routes() []*RIBEntry {
-	rts := make([]*RIBEntry, 0, len(r))
-	for e := range r {
-		rts = append(rts, e)
+// すべてのAFI/SAFIのエントリを返す
+func (t tables) Routes() []*RIBEntry {
+	var rts []*RIBEntry
+	for _, r := range t {
+		rts = append(rts, r.Routes()...)
 	}
 	return rts
 }
 
-func (r rib) AllUnchanged() {
-	for e := range r {
-		r[e] = UnChanged
+// AFI/SAFIのエントリを返す
+func (t tables) RoutesOf(f bgp.Family) []*RIBEntry {
+	return t[f].Routes()
+}
+
+func (t tables) AllUnchanged() {
+	for _, r := range t {
+		r.AllUnchanged()
 	}
 }
 
-func (r rib) ContainNew() bool {
-	for _, s := range r {
-		if s == New {
+// AFI/SAFIの変更をキューから削除する
+func (t tables) AllUnchangedOf(f bgp.Family) {
+	t[f].AllUnchanged()
+}
+
+func (t tables) withdraw(nw ip.Prefix) []*RIBEntry {
+	return t.table(familyOf(nw)).withdraw(nw)
+}
+
+func (t tables) ContainChanged() bool {
+	for _, r := range t {
+		if r.ContainChanged() {
 			return true
 		}
 	}
 	return false
 }
 
+// すべてのAFI/SAFIの、変更があったPrefixを返す
+func (t tables) changedPrefixes() []ip.Prefix {
+	var nws []ip.Prefix
+	for _, r := range t {
+		nws = append(nws, r.changedPrefixes()...)
+	}
+	return nws
+}
+
+// 以下はRIBの調査のための問い合わせ
+// 戻り値のRIBEntryから、PathAttributeとルートを受信したPeerを取得できる。
+
+// Prefixと一致するエントリを返す
+func (t tables) Lookup(nw ip.Prefix) []*RIBEntry {
+	return slices.Clone(t[familyOf(nw)].entries(nw))
+}
+
+// アドレスを含む最も長いPrefixのエントリを返す
+func (t tables) LongestMatch(a net.IP) []*RIBEntry {
+	f, k := bgp.IPv4Unicast, a.To4()
+	if k == nil {
+		f, k = bgp.IPv6Unicast, a.To16()
+	}
+	r, ok := t[f]
+	if !ok || k == nil {
+		return nil
+	}
+	_, es, _ := r.routes.LongestMatch(k)
+	return slices.Clone(es)
+}
+
+// Prefixに含まれる、より長いPrefixのエントリを返す
+// Prefixと一致するエントリは含まない。
+func (t tables) MoreSpecifics(nw ip.Prefix) []*RIBEntry {
+	var rts []*RIBEntry
+	if r, ok := t[familyOf(nw)]; ok {
+		r.routes.WalkMoreSpecifics(nw, func(_ ip.Prefix, es []*RIBEntry) bool {
+			rts = append(rts, es...)
+			return true
+		})
+	}
+	return rts
+}
+
+// Prefixを含む、より短いPrefixのエントリを短い順に返す
+// Prefixと一致するエントリは含まない。
+func (t tables) LessSpecifics(nw ip.Prefix) []*RIBEntry {
+	var rts []*RIBEntry
+	if r, ok := t[familyOf(nw)]; ok {
+		r.routes.WalkLessSpecifics(nw, func(_ ip.Prefix, es []*RIBEntry) bool {
+			rts = append(rts, es...)
+			return true
+		})
+	}
+	return rts
+}
+
+// Prefixごとの候補となるルートと、選択されたベストパス
+type destination struct {
+	paths  []*RIBEntry
+	best   *RIBEntry
+	reason Reason
+}
+
+// ベストパスと、選択された理由
+type Selection struct {
+	Best   *RIBEntry
+	Reason Reason
+	// ベストパスを含む候補の数
+	Candidates int
+}
+
+// LocRIBのtablesは、Prefixごとに選択されたベストパスのみを保持する。
+// ベストパスが取り下げられた場合に次の候補を選択するため、
+// すべての候補はdestsで保持する。
 type LocRIB struct {
-	rib
+	tables
+	// AFI/SAFIごとの、Prefixをキーとする候補
+	dests   map[bgp.Family]*trie[*destination]
 	localAS bgp.ASNumber
-	mu      sync.RWMutex
+	// NEXT_HOPまでのIGPコスト
+	// nilの場合はIGPコストを比較しない。
+	igpCost igpCostFunc
+	// 自身が広告するルートのNEXT_HOP
+	localIPs []net.IP
+	// カーネルのルーティングテーブルに書き込んだベストパス
+	// Prefixの文字列をキーとし、ベストパスが変わった場合に以前のルートを削除するために使用する。
+	fib map[string]*RIBEntry
+	// カーネルのルーティングテーブルを変更する関数
+	// テストでは、カーネルを変更しない関数に置き換える。
+	routeReplace, routeDel func(*netlink.Route) error
+	// AFI/SAFIごとの、Prefixをキーとする集約ルート
+	aggs map[bgp.Family]*trie[*aggregate]
+	mu   sync.RWMutex
+	// LocRIBが変更されたときに、変更されたPrefixを渡して呼び出す関数
+	subscribers []func([]ip.Prefix)
 }
 
 func NewLocRIB(c *config.Config) (*LocRIB, error) {
+	l := newLocRIB(c.LocalAS())
+	l.igpCost = kernelIGPCost
+	for _, afi := range []bgp.AFI{bgp.AFIIPv4, bgp.AFIIPv6} {
+		if nh := c.NextHop(afi); nh != nil {
+			l.localIPs = append(l.localIPs, nh)
+		}
+	}
+
+	for _, nw := range c.Networks() {
+		pas, err := localAttrs(c, nw.AFI())
+		if err != nil {
+			return nil, err
+		}
+		if cs := c.Communities(nw); len(cs) > 0 {
+			pas = append(pas, pathattribute.NewCommunities(cs))
+		}
+		rts := l.LookupRT(nw)
+		for _, rt := range rts {
+			l.addPath(NewRIBEntry(rt, pas))
+			l.decide(rt)
+		}
+	}
+	for _, a := range c.Aggregates() {
+		if err := l.addAggregate(c, a); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func newLocRIB(as bgp.ASNumber) *LocRIB {
+	return &LocRIB{
+		tables:  tables{},
+		dests:   map[bgp.Family]*trie[*destination]{},
+		localAS: as,
+		fib:     map[string]*RIBEntry{},
+		aggs:    map[bgp.Family]*trie[*aggregate]{},
+
+		routeReplace: netlink.RouteReplace,
+		routeDel:     netlink.RouteDel,
+	}
+}
+
+// 自身が広告するルートのPathAttribute
+// IPv6のルートは、NEXT_HOPの代わりにNLRIを持たないMP_REACH_NLRIでNext Hopを表す。
+func localAttrs(c *config.Config, afi bgp.AFI) ([]pathattribute.PathAttribute, error) {
 	// AS Pathは、ほかのピアから受信したルートと統一的に扱うために、
 	// LocRib -> AdjRIBOutにルートを送るときに、自分のAS番号を
 	// 追加するので、ここでは空にしておく。
@@ -106,41 +502,50 @@ func NewLocRIB(c *config.Config) (*LocRIB, error) {
 	if err != nil {
 		return nil, err
 	}
+	nh := c.NextHop(afi)
+	if nh == nil {
+		return nil, fmt.Errorf("next hop is not configured: AFI %d", afi)
+	}
 	pas := []pathattribute.PathAttribute{
 		pathattribute.Igp,
 		ap,
-		pathattribute.NextHop(c.LocalIP().To4()),
-	}
-	rib := rib{}
-
-	l := &LocRIB{
-		rib:     rib,
-		localAS: c.LocalAS(),
 	}
-
-	for _, nw := range c.Networks() {
-		rts := l.LookupRT(nw)
-		for _, rt := range rts {
-			l.Insert(NewRIBEntry(rt, pas))
+	if afi == bgp.AFIIPv4 {
+		n, err := pathattribute.NewNextHop(nh.To4())
+		if err != nil {
+			return nil, err
 		}
+		return append(pas, n), nil
 	}
-
-	return l, nil
+	r, err := pathattribute.NewMPReachNLRI(bgp.IPv6Unicast, []net.IP{nh}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(pas, r), nil
 }
 
-func (l *LocRIB) LookupRT(nw *ip.IPv4Net) []*ip.IPv4Net {
+func (l *LocRIB) LookupRT(nw ip.Prefix) []ip.Prefix {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	family := netlink.FAMILY_V4
+	if nw.AFI() == bgp.AFIIPv6 {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteList(nil, family)
 	if err != nil {
 		return nil
 	}
-	var r []*ip.IPv4Net
-	p, _ := nw.Mask.Size()
+	var r []ip.Prefix
+	n := nw.Net()
+	p, _ := n.Mask.Size()
 	for _, route := range routes {
+		// デフォルトルートはDstを持たない
+		if route.Dst == nil {
+			continue
+		}
 		dp, _ := route.Dst.Mask.Size()
-		if nw.IP.Equal(route.Dst.IP) && p == dp {
-			dst, err := ip.NewIPv4Net(route.Dst)
+		if n.IP.Equal(route.Dst.IP) && p == dp {
+			dst, err := ip.NewPrefix(route.Dst)
 			if err != nil {
 				continue
 			}
@@ -150,145 +555,636 @@ func (l *LocRIB) LookupRT(nw *ip.IPv4Net) []*ip.IPv4Net {
 	return r
 }
 
-func (l *LocRIB) WriteRT() {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	for _, e := range l.Routes() {
-		l.writeRT(e)
+// ベストパスが変更されたPrefixについて、新しいベストパスをカーネルのルーティングテーブルに書き込み、
+// ベストパスがなくなった、または書き込まないベストパスに変わったPrefixは、以前に書き込んだルートを削除する。
+// Route Refreshなどで同じPrefixのルートを再度受信した場合は、上書きする。
+// 集約ルートは、ベストパスが変わらなくても生成・取り下げによって書き込むかどうかが変わるため、
+// 集約するPrefixも確認する。
+// 呼び出し元でLockを取得している必要がある。
+func (l *LocRIB) writeRTs() {
+	nws := l.changedPrefixes()
+	for _, t := range l.aggs {
+		t.Walk(func(nw ip.Prefix, _ *aggregate) bool {
+			nws = append(nws, nw)
+			return true
+		})
+	}
+	seen := map[string]struct{}{}
+	for _, nw := range nws {
+		k := nw.Net().String()
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		if es := l.tables[familyOf(nw)].entries(nw); len(es) > 0 && l.installable(es[0]) {
+			// 同じルートを書き込み済みの場合は、ベストパスが変わっていない
+			if l.fib[k] == es[0] {
+				continue
+			}
+			if l.writeRT(es[0]) {
+				l.fib[k] = es[0]
+				continue
+			}
+		}
+		if e, ok := l.fib[k]; ok {
+			l.deleteRT(e)
+			delete(l.fib, k)
+		}
+	}
+}
+
+// ベストパスをカーネルのルーティングテーブルに書き込むかを返す
+// 自身が広告するルートが候補にあるPrefixは、ホストがすでにルートを持つため、
+// 対向機器から受信したルートがベストパスであっても書き込まない。
+// 書き込むと、ホストが持つConnectedなどのルートを置き換えてしまう。
+func (l *LocRIB) installable(e *RIBEntry) bool {
+	if e.src == nil {
+		return false
 	}
+	if d := l.dest(e.nw, false); d != nil && slices.ContainsFunc(d.paths, func(o *RIBEntry) bool {
+		return o.src == nil
+	}) {
+		return false
+	}
+	gw := e.gateway()
+	if gw == nil || slices.ContainsFunc(l.localIPs, gw.Equal) {
+		return false
+	}
+	// リンクローカルアドレスはインターフェースを指定しなければ使用できない
+	if gw.IsLinkLocalUnicast() {
+		log.Printf("link-local next hop is not supported: %v", e.nw)
+		return false
+	}
+	return true
 }
-func (l *LocRIB) writeRT(e *RIBEntry) {
+
+// RIBEntryのNEXT_HOPを返す
+// IPv6のルートはMP_REACH_NLRIのグローバルアドレスを使用する。
+func (e *RIBEntry) gateway() net.IP {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
-	for _, a := range e.attrs {
+	var gw net.IP
+	for _, a := range e.attrs.attrs {
 		switch a := a.(type) {
 		case pathattribute.NextHop:
-			nw := &net.IPNet{
-				IP:   e.nw.IP,
-				Mask: e.nw.Mask,
-			}
-			gw := net.IP(a).To4()
-			if err := netlink.RouteAdd(&netlink.Route{
-				Dst: nw,
-				Gw:  gw,
-			}); err != nil {
-				log.Fatal(err)
+			gw = net.IP(a).To4()
+		case pathattribute.MPReachNLRI:
+			if nhs := a.NextHops(); len(nhs) > 0 {
+				gw = nhs[0]
 			}
 		}
 	}
+	return gw
 }
 
-// AdjRIBInから必要なルートをLocRIBにインストールする
-func (l *LocRIB) Update(ri *AdjRIBIn) {
+// ルートをカーネルのルーティングテーブルに書き込み、書き込めたかを返す
+func (l *LocRIB) writeRT(e *RIBEntry) bool {
+	// カーネルが受け付けないルートは書き込まずに、ほかのルートの処理を続ける
+	if err := l.routeReplace(kernelRoute(e)); err != nil {
+		log.Printf("failed to write route: %v, %v", e.nw, err)
+		return false
+	}
+	return true
+}
+
+// 書き込んだルートをカーネルのルーティングテーブルから削除する
+func (l *LocRIB) deleteRT(e *RIBEntry) {
+	if err := l.routeDel(kernelRoute(e)); err != nil {
+		log.Printf("failed to delete route: %v, %v", e.nw, err)
+	}
+}
+
+// RIBEntryに対応する、カーネルのルーティングテーブルのルート
+func kernelRoute(e *RIBEntry) *netlink.Route {
+	return &netlink.Route{
+		Dst: &net.IPNet{
+			IP:   e.nw.Net().IP,
+			Mask: e.nw.Net().Mask,
+		},
+		Gw: e.gateway(),
+	}
+}
+
+// LocRIBが変更されたときに呼び出される関数を登録する
+// 各Peerは、変更されたPrefixを保持し、LocRIBChanged Eventを発生させてAdjRIBOutを更新する。
+func (l *LocRIB) Subscribe(f func([]ip.Prefix)) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.subscribers = append(l.subscribers, f)
+}
+
+// Prefixの候補を返す
+// 存在しない場合、createがtrueであれば作成する。
+func (l *LocRIB) dest(nw ip.Prefix, create bool) *destination {
+	f := familyOf(nw)
+	t, ok := l.dests[f]
+	if !ok {
+		if !create {
+			return nil
+		}
+		t = newTrie[*destination]()
+		l.dests[f] = t
+	}
+	d, ok := t.Get(nw)
+	if !ok && create {
+		d = &destination{}
+		t.Put(nw, d)
+	}
+	return d
+}
+
+// 候補となるルートを追加する
+func (l *LocRIB) addPath(e *RIBEntry) {
+	d := l.dest(e.nw, true)
+	d.paths = append(d.paths, e)
+	attrSets.retain(e.attrs)
+}
+
+// 候補となるルートを削除する
+// 候補に含まれていない場合はfalseを返す。
+func (l *LocRIB) removePath(e *RIBEntry) bool {
+	d := l.dest(e.nw, false)
+	if d == nil || !slices.Contains(d.paths, e) {
+		return false
+	}
+	d.paths = slices.DeleteFunc(d.paths, func(o *RIBEntry) bool { return o == e })
+	attrSets.release(e.attrs)
+	return true
+}
+
+// Prefixのベストパスを選択し直し、tablesに反映する
+// 以前のベストパスは取り下げ、新しいベストパスをインストールする。
+// ベストパスが変わった場合はtrueを返す。
+func (l *LocRIB) decide(nw ip.Prefix) bool {
+	d := l.dest(nw, false)
+	if d == nil {
+		return false
+	}
+	best, reason := selectBest(d.paths, l.igpCost)
+	d.reason = reason
+	if len(d.paths) == 0 {
+		l.dests[familyOf(nw)].Delete(nw)
+	}
+	if best == d.best {
+		return false
+	}
+	if d.best != nil {
+		l.table(d.best.Family()).remove(d.best)
+	}
+	if best != nil {
+		l.Insert(best)
+		log.Printf("best path selected: %v, reason: %v", best, reason)
+	}
+	d.best = best
+	return true
+}
+
+// LocRIBは、ほかのPeerのgoroutineから更新されるため、Lockを取得して問い合わせる
+
+func (l *LocRIB) Lookup(nw ip.Prefix) []*RIBEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tables.Lookup(nw)
+}
+
+func (l *LocRIB) LongestMatch(a net.IP) []*RIBEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tables.LongestMatch(a)
+}
+
+func (l *LocRIB) MoreSpecifics(nw ip.Prefix) []*RIBEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tables.MoreSpecifics(nw)
+}
+
+func (l *LocRIB) LessSpecifics(nw ip.Prefix) []*RIBEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tables.LessSpecifics(nw)
+}
+
+// Prefixのベストパスと、選択された理由を返す
+// ベストパスが存在しない場合はfalseを返す。
+func (l *LocRIB) BestPath(nw ip.Prefix) (Selection, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	d := l.dest(nw, false)
+	if d == nil || d.best == nil {
+		return Selection{}, false
+	}
+	return Selection{
+		Best:       d.best,
+		Reason:     d.reason,
+		Candidates: len(d.paths),
+	}, true
+}
+
+// AdjRIBInの変更を候補に反映し、変更があったPrefixのベストパスを選択し直す
+// ベストパスが変わった場合は、カーネルのルーティングテーブルに反映し、
+// 変更されたPrefixを渡して登録された関数を呼び出す。
+func (l *LocRIB) Update(ri *AdjRIBIn) {
+	l.mu.Lock()
 	la := l.localAS
-	for _, rt := range ri.Routes() {
-		// 自ASが含まれているルートはインストールしない
-		if rt.containAS(la) {
-			continue
+	var changed []ip.Prefix
+	for _, r := range ri.tables {
+		for _, c := range r.changes {
+			switch c.s {
+			case New:
+				// 自ASが含まれているルートはインストールしない
+				if c.e.containAS(la) {
+					continue
+				}
+				l.addPath(c.e)
+				changed = append(changed, c.e.nw)
+			case Withdrawn:
+				if l.removePath(c.e) {
+					changed = append(changed, c.e.nw)
+				}
+			}
 		}
-		l.Insert(rt)
+	}
+	for _, nw := range changed {
+		l.decide(nw)
+	}
+	suppressed := l.reaggregate(changed)
+	updated := l.changedPrefixes()
+	// Summary-onlyの集約ルートの生成・取り下げにより、
+	// ベストパスは変わらないが広告するかどうかが変わったPrefixも渡す
+	for _, nw := range suppressed {
+		if !slices.ContainsFunc(updated, nw.Equal) {
+			updated = append(updated, nw)
+		}
+	}
+	if len(updated) > 0 {
+		l.writeRTs()
+		l.AllUnchanged()
+	}
+	subs := l.subscribers
+	l.mu.Unlock()
+	if len(updated) == 0 {
+		return
+	}
+	for _, f := range subs {
+		f(updated)
 	}
 }
 
 type AdjRIBOut struct {
-	rib
+	tables
 }
 
 func NewAdjRIBOut() *AdjRIBOut {
 	return &AdjRIBOut{
-		rib: rib{},
+		tables: tables{},
 	}
 }
 
-// LocRIBから必要なルートをインストールする
-// この時、Remote AS番号が含まれているルートはインストールしない。
-func (ro *AdjRIBOut) Update(lr *LocRIB, c *config.Config) {
+// LocRIBから、ネゴシエーションしたAFI/SAFI(fs)のすべてのPrefixのルートを同期する
+// Established Stateへの遷移時など、AdjRIBOutとLocRIBを一致させる必要がある場合に使用する。
+func (ro *AdjRIBOut) Update(lr *LocRIB, c *config.Config, fs ...bgp.Family) {
 	lr.mu.RLock()
 	defer lr.mu.RUnlock()
-	for _, rt := range lr.Routes() {
-		if rt.containAS(c.RemoteAS()) {
-			continue
+	for _, f := range fs {
+		nws := append(lr.tables[f].prefixes(), ro.tables[f].prefixes()...)
+		for _, nw := range nws {
+			ro.sync(lr, c, nw)
 		}
-		ro.Insert(rt)
-	}
-}
-
-// AdjRIBOutからUpadateMessageを生成する
-// PathAttributeごとにUpdateMessageが分かれるため、
-// []*message.UpdateMessageを戻り値にしている。
-func (ro *AdjRIBOut) ToUpdateMessage(locIP net.IP, locAS bgp.ASNumber) ([]*message.UpdateMessage, error) {
-	// IPv4のみ対応
-	locIP = locIP.To4()
-	if locIP == nil {
-		return nil, fmt.Errorf("support IPv4 only")
-	}
-	// 書籍のRustによる実装では、
-	// PathAttributeをKeyに、Vec<IPv4Network>をValueのHashMapを使って、
-	// 同じPathAttributeのNLRIは同じVec<IPv4Network>にまとめている。
-	// ここで同じPathAttributeとされた経路は1つのUpdateMessageにまとめられる。
-	hashMap := map[*[]pathattribute.PathAttribute][]*ip.IPv4Net{}
-	for _, e := range ro.Routes() {
-		e.mu.Lock()
-		defer e.mu.Unlock()
-		// Hashとしてポインタを使っているが、
-		// "同じPathAttribute"とは、PathAttributeの中身が同じであることを指す?
-		h := &e.attrs
-		if _, ok := hashMap[h]; !ok {
-			hashMap[h] = append(hashMap[h], e.nw)
-		} else {
-			hashMap[h] = []*ip.IPv4Net{e.nw}
-		}
-	}
-
-	// UpdateMessageを生成する
-	var ums []*message.UpdateMessage
-	for pas, nws := range hashMap {
-		// PathAttributeのうちNexthopまたはASPathを変更する
-		// Nexthopはlocal ipに変更、
-		// ASPathはlocal asを追加
-		for i, p := range *pas {
-			switch p := p.(type) {
-			case pathattribute.NextHop:
-				n, err := pathattribute.NewNextHop(locIP)
-				if err != nil {
-					return nil, err
-				}
-				copy(p, n)
-			case pathattribute.ASPath:
-				a, err := pathattribute.AppendASPath(p, locAS)
-				if err != nil {
-					return nil, err
-				}
-				(*pas)[i] = a
-			}
+	}
+}
+
+// LocRIBで変更されたPrefix(nws)のうち、AFI/SAFI(fs)のルートのみを同期する
+func (ro *AdjRIBOut) Sync(lr *LocRIB, c *config.Config, nws []ip.Prefix, fs ...bgp.Family) {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+	for _, nw := range nws {
+		if slices.Contains(fs, familyOf(nw)) {
+			ro.sync(lr, c, nw)
 		}
-		um, err := message.NewUpdateMsg(*pas, nws, nil)
-		if err != nil {
-			return nil, err
+	}
+}
+
+// PrefixのルートをLocRIBのベストパスに置き換える
+// この時、Remote AS番号が含まれているルートと、
+// iBGPの対向機器に対してiBGPで受信したルート(RFC 4271 9.2)、
+// Well-known Communityで広告が制限されたルート、
+// Summary-onlyの集約ルートに集約されるルートはインストールしない。
+// LocRIBにベストパスが存在しなくなったルートは取り下げる。
+// 呼び出し元でLocRIBのLockを取得している必要がある。
+func (ro *AdjRIBOut) sync(lr *LocRIB, c *config.Config, nw ip.Prefix) {
+	f := familyOf(nw)
+	var best *RIBEntry
+	if es := lr.tables[f].entries(nw); len(es) > 0 && exportable(es[0], c) && !lr.suppressed(nw) {
+		best = es[0]
+	}
+	r := ro.table(f)
+	cur := r.entries(nw)
+	if best == nil && len(cur) == 0 || len(cur) == 1 && cur[0] == best {
+		return
+	}
+	r.withdraw(nw)
+	if best != nil {
+		r.Insert(best)
+	}
+}
+
+// ルートを対向機器(c)に広告できるかを返す
+// Well-known Community(RFC 1997, RFC 3765)を持つルートは、その意味に従って広告を制限する。
+func exportable(e *RIBEntry, c *config.Config) bool {
+	if e.containAS(c.RemoteAS()) {
+		return false
+	}
+	if c.IBGP() && e.src != nil && e.src.IBGP {
+		return false
+	}
+	cs := e.communities()
+	switch {
+	case cs.Contains(pathattribute.NoAdvertise):
+		return false
+	// Confederationには対応していないため、eBGPの対向機器はすべて自身のASの外にある
+	case !c.IBGP() && (cs.Contains(pathattribute.NoExport) || cs.Contains(pathattribute.NoExportSubconfed)):
+		return false
+	case c.BilateralPeer() && cs.Contains(pathattribute.NoPeer):
+		return false
+	}
+	return true
+}
+
+// AFI/SAFI(f)のすべてのルートを、変更として再度キューに記録する
+// ROUTE-REFRESH Messageを受信した場合に、すべてのルートを再送するために使用する。
+func (ro *AdjRIBOut) Readvertise(f bgp.Family) {
+	r, ok := ro.tables[f]
+	if !ok {
+		return
+	}
+	r.routes.Walk(func(_ ip.Prefix, es []*RIBEntry) bool {
+		for _, e := range es {
+			r.changes = append(r.changes, change{e: e, s: New})
+		}
+		return true
+	})
+}
+
+// セッションがEstablishedから離れたときに、すべてのエントリを取り下げる
+// 取り下げたエントリのattrSetの参照を解放する。
+func (ro *AdjRIBOut) WithdrawAll() {
+	for _, r := range ro.tables {
+		for _, nw := range r.prefixes() {
+			r.withdraw(nw)
 		}
-		ums = append(ums, um)
 	}
-	return ums, nil
 }
 
 type AdjRIBIn struct {
-	rib
+	tables
+	// ルートを受信したPeer
+	src *Source
+	// Enhanced Route Refresh(RFC 7313)の実行中に、
+	// 対向機器から再送されていないエントリ
+	stale map[*RIBEntry]struct{}
+	// AFI/SAFI disable(RFC 7606)によって、ルートを無視するAFI/SAFI
+	disabled map[bgp.Family]struct{}
+	// セッションを切断せずに処理した、UPDATE Messageのエラー
+	incidents []Incident
+}
+
+// 保持するIncidentの最大数
+// 超えた場合は古いものから削除する。
+const maxIncidents = 100
+
+// RFC 7606によって、セッションを切断せずに処理したUPDATE Messageのエラー
+type Incident struct {
+	Time time.Time
+	// 処理方法と、エラーとなったPathAttributeのByte列を含む
+	Err pathattribute.AttrErr
+}
+
+func (i Incident) String() string {
+	return fmt.Sprintf("%v: %v (%v), attr: %x",
+		i.Time.Format(time.RFC3339), i.Err.Action, i.Err, i.Err.Attr)
 }
 
-func NewAdjRIBIn() *AdjRIBIn {
+func NewAdjRIBIn(src *Source) *AdjRIBIn {
 	return &AdjRIBIn{
-		rib: rib{},
+		tables:   tables{},
+		src:      src,
+		stale:    map[*RIBEntry]struct{}{},
+		disabled: map[bgp.Family]struct{}{},
+	}
+}
+
+// すべてのAFI/SAFIで受信しているPrefixの数
+func (ri *AdjRIBIn) PrefixCount() int {
+	n := 0
+	for _, r := range ri.tables {
+		n += r.routes.Len()
+	}
+	return n
+}
+
+// 記録したUPDATE Messageのエラーを、古い順に返す
+func (ri *AdjRIBIn) Incidents() []Incident {
+	return slices.Clone(ri.incidents)
+}
+
+// AFI/SAFI disableによって、ルートを無視しているAFI/SAFIであるか
+func (ri *AdjRIBIn) Disabled(f bgp.Family) bool {
+	_, ok := ri.disabled[f]
+	return ok
+}
+
+// UPDATE Messageのエラーを記録し、AFI/SAFI disableの場合はそのAFI/SAFIのルートを取り下げる
+// Treat-as-withdrawのエラーを含む場合はtrueを返す。
+func (ri *AdjRIBIn) handleErrs(um *message.UpdateMessage) bool {
+	withdraw := false
+	for _, e := range um.AttrErrors() {
+		log.Printf("malformed update message, %v: %v, attr: %x", e.Action, e, e.Attr)
+		ri.incidents = append(ri.incidents, Incident{Time: time.Now(), Err: e})
+		switch e.Action {
+		case pathattribute.TreatAsWithdraw:
+			withdraw = true
+		case pathattribute.AFISAFIDisable:
+			if ri.Disabled(e.Family) {
+				continue
+			}
+			ri.disabled[e.Family] = struct{}{}
+			if r, ok := ri.tables[e.Family]; ok {
+				for _, nw := range r.prefixes() {
+					ri.withdraw(nw)
+				}
+			}
+		}
+	}
+	if len(ri.incidents) > maxIncidents {
+		ri.incidents = slices.Clone(ri.incidents[len(ri.incidents)-maxIncidents:])
+	}
+	return withdraw
+}
+
+// 同じPrefixのエントリを取り下げる
+func (ri *AdjRIBIn) withdraw(nw ip.Prefix) {
+	for _, e := range ri.tables.withdraw(nw) {
+		delete(ri.stale, e)
 	}
 }
 
+// 受信したルートを、PathAttributeの集まり(s)を共有するRIBEntryとしてインストールする
+// 同じPrefixのエントリがすでに存在する場合は、取り下げて置き換える。
+func (ri *AdjRIBIn) install(nw ip.Prefix, s *attrSet) {
+	ri.withdraw(nw)
+	e := newRIBEntry(nw, s)
+	e.src = ri.src
+	ri.Insert(e)
+}
+
 // UpdateMessageを受信したときに、AdjRIBInを更新する
+// 取り下げられたPrefixのエントリは削除し、変更として記録する。
+// 同じPrefixのエントリがすでに存在する場合は、取り下げて新しいエントリで置き換える。
+// MP_REACH_NLRI, MP_UNREACH_NLRIのNLRIは、AFI/SAFIに対応するテーブルで処理する。
+// 不正なPathAttributeを含む場合は、RFC 7606に従ってNLRIを取り下げられたルートとして処理する。
+// AFI/SAFI disableとなったAFI/SAFIのNLRIは無視する。
 func (ri *AdjRIBIn) Update(um *message.UpdateMessage) {
-	// TODO: withdrawnに対応
-	for _, nw := range um.NLRI() {
-		// TODO: Pathattributeが同じであれば、同じRIBEntryにまとめなければならない
-		// 実装を見直す必要がある？
-		ri.Insert(NewRIBEntry(nw, um.PathAttributes()))
+	treatAsWithdraw := ri.handleErrs(um)
+	for _, nw := range um.WithdrawnRoutes() {
+		ri.withdraw(nw)
+	}
+	pas := um.PathAttributes()
+	for _, pa := range pas {
+		if u, ok := pa.(pathattribute.MPUnreachNLRI); ok {
+			for _, nw := range u.Withdrawn() {
+				ri.withdraw(nw)
+			}
+		}
+	}
+	// 同じUPDATE MessageのNLRIのエントリは、同じattrSetを共有する
+	if nlri := um.NLRI(); len(nlri) > 0 && !ri.Disabled(bgp.IPv4Unicast) {
+		if treatAsWithdraw {
+			for _, nw := range nlri {
+				ri.withdraw(nw)
+			}
+		} else {
+			s := attrSets.intern(ri.importAttrs(ipv4Attrs(pas)))
+			for _, nw := range nlri {
+				ri.install(nw, s)
+			}
+			attrSets.release(s)
+		}
+	}
+	for _, pa := range pas {
+		r, ok := pa.(pathattribute.MPReachNLRI)
+		if !ok || ri.Disabled(r.Family()) {
+			continue
+		}
+		if treatAsWithdraw {
+			for _, nw := range r.NLRI() {
+				ri.withdraw(nw)
+			}
+			continue
+		}
+		attrs, err := mpAttrs(pas, r)
+		if err != nil {
+			log.Printf("invalid MP_REACH_NLRI, ignore: %v", err)
+			continue
+		}
+		s := attrSets.intern(ri.importAttrs(attrs))
+		for _, nw := range r.NLRI() {
+			ri.install(nw, s)
+		}
+		attrSets.release(s)
+	}
+}
+
+// 受信したルートのPathAttributeに、Import Policyを適用する
+// eBGPの対向機器から受信したLOCAL_PREFは無視する(RFC 4271 5.1.5)。
+// SourceにLOCAL_PREFが設定されている場合は、その値で置き換える。
+// pasは変更せず、新しいスライスを返す。
+func (ri *AdjRIBIn) importAttrs(pas []pathattribute.PathAttribute) []pathattribute.PathAttribute {
+	attrs := make([]pathattribute.PathAttribute, 0, len(pas)+1)
+	for _, pa := range pas {
+		if _, ok := pa.(pathattribute.LocalPref); ok && (ri.src == nil || !ri.src.IBGP || ri.src.LocalPref != nil) {
+			continue
+		}
+		attrs = append(attrs, pa)
+	}
+	if ri.src != nil && ri.src.LocalPref != nil {
+		attrs = append(attrs, pathattribute.LocalPref(*ri.src.LocalPref))
+	}
+	return attrs
+}
+
+// UPDATE MessageのNLRIのエントリが持つPathAttribute
+// MP_REACH_NLRI, MP_UNREACH_NLRIは含めない。
+func ipv4Attrs(pas []pathattribute.PathAttribute) []pathattribute.PathAttribute {
+	attrs := make([]pathattribute.PathAttribute, 0, len(pas))
+	for _, pa := range pas {
+		switch pa.(type) {
+		case pathattribute.MPReachNLRI, pathattribute.MPUnreachNLRI:
+			continue
+		}
+		attrs = append(attrs, pa)
+	}
+	return attrs
+}
+
+// MP_REACH_NLRIのNLRIのエントリが持つPathAttribute
+// NEXT_HOP, MP_UNREACH_NLRIは含めず、MP_REACH_NLRIはNLRIを除いたものに置き換える。
+// IPv4 Unicastの場合は、UPDATE MessageのNLRIと同様にNEXT_HOPで表す。
+func mpAttrs(
+	pas []pathattribute.PathAttribute,
+	r pathattribute.MPReachNLRI,
+) ([]pathattribute.PathAttribute, error) {
+	attrs := make([]pathattribute.PathAttribute, 0, len(pas))
+	for _, pa := range pas {
+		switch pa.(type) {
+		case pathattribute.NextHop, pathattribute.MPUnreachNLRI:
+			continue
+		case pathattribute.MPReachNLRI:
+			if r.Family() != bgp.IPv4Unicast {
+				attrs = append(attrs, r.WithNLRI(nil))
+				continue
+			}
+			nh, err := pathattribute.NewNextHop(r.NextHops()[0].To4())
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, nh)
+			continue
+		}
+		attrs = append(attrs, pa)
+	}
+	return attrs, nil
+}
+
+// BoRRを受信したときに、AFI/SAFI(f)のすべてのエントリをStaleにする
+// 対向機器から再送されたエントリはUpdateによって置き換えられる。
+func (ri *AdjRIBIn) MarkStale(f bgp.Family) {
+	for _, e := range ri.RoutesOf(f) {
+		ri.stale[e] = struct{}{}
+	}
+}
+
+// EoRRを受信したときに、AFI/SAFI(f)のStaleのまま残っているエントリを取り下げる
+// 取り下げたエントリを返す。
+func (ri *AdjRIBIn) PurgeStale(f bgp.Family) []*RIBEntry {
+	var purged []*RIBEntry
+	for e := range ri.stale {
+		if e.Family() != f {
+			continue
+		}
+		ri.table(f).remove(e)
+		delete(ri.stale, e)
+		purged = append(purged, e)
+	}
+	return purged
+}
+
+// セッションがEstablishedから離れたときに、すべてのエントリを取り下げる
+// LocRIB.Updateに渡すことで、このPeerから学習したルートがLocRIBとカーネルから削除される。
+func (ri *AdjRIBIn) WithdrawAll() {
+	for _, r := range ri.tables {
+		for _, nw := range r.prefixes() {
+			ri.withdraw(nw)
+		}
 	}
 }
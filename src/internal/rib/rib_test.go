@@ -1,7 +1,10 @@
 package rib
 
 import (
+	"fmt"
 	"net"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/SotaUeda/usbgp/config"
@@ -9,6 +12,7 @@ import (
 	"github.com/SotaUeda/usbgp/internal/ip"
 	"github.com/SotaUeda/usbgp/internal/message"
 	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
+	"github.com/vishvananda/netlink"
 )
 
 func TestLocRIBCanLookupRoutingTable(t *testing.T) {
@@ -27,7 +31,7 @@ func TestLocRIBCanLookupRoutingTable(t *testing.T) {
 	if len(get) == 0 {
 		t.Fatal("lookupRT() = 0, want 1")
 	}
-	want := []*ip.IPv4Net{nw}
+	want := []ip.Prefix{nw}
 	for i, got := range get {
 		if (got.String() != want[i].String()) && (got.Len() != want[i].Len()) {
 			t.Errorf("lookupRT() = %v, want %v", got, want[i])
@@ -62,7 +66,7 @@ func TestLocRibToAdjRIBOut(t *testing.T) {
 		t.Fatal(err)
 	}
 	get := NewAdjRIBOut()
-	get.Update(lr, c)
+	get.Update(lr, c, bgp.IPv4Unicast)
 
 	ipn, err := ip.NewIPv4Net(nw)
 	if err != nil {
@@ -89,28 +93,22 @@ func TestLocRibToAdjRIBOut(t *testing.T) {
 }
 
 func adjRIBOutEqual(get, want *AdjRIBOut, t *testing.T) bool {
-	return ribEqual(get.rib, want.rib, t)
+	return ribEqual(get.tables, want.tables, t)
 }
 
-func ribEqual(get, want rib, t *testing.T) bool {
-	// get, wantそれぞれのRIBEntry(*IPv4Net, []PathAttribute)とStatusを比較する必要がある
-	// RIBはmap[*RIBEntry]Statusであるため、mapの順番は保証されないかつポインタのため比較ができない
+func ribEqual(get, want tables, t *testing.T) bool {
+	// get, wantそれぞれのRIBEntry(*IPv4Net, []PathAttribute)と変更を比較する必要がある
+	// RIBEntryはポインタのため比較ができない
 	// それぞれのRIBEntryを文字列として取得し、それをkeyとして新しいmapを作成し、それを比較する
-	getMap := make(map[string]Status)
-	for k, v := range get {
-		getMap[k.String()] = v
-	}
-	wantMap := make(map[string]Status)
-	for k, v := range want {
-		wantMap[k.String()] = v
-	}
+	getMap := ribStrings(get)
+	wantMap := ribStrings(want)
 	if len(getMap) != len(wantMap) {
 		t.Errorf("len(get) = %d, len(want) = %d", len(getMap), len(wantMap))
 		return false
 	}
 	for k, v := range getMap {
-		if wantMap[k] != v {
-			t.Errorf("get[%s] = %v, want[%s] = %v", k, v, k, wantMap[k])
+		if wv, ok := wantMap[k]; !ok || wv != v {
+			t.Errorf("get[%s] = %v, want[%s] = %v", k, v, k, wv)
 			return false
 		}
 	}
@@ -118,6 +116,21 @@ func ribEqual(get, want rib, t *testing.T) bool {
 	return true
 }
 
+// RIBEntryの文字列と、最後に記録された変更の組を返す
+// 変更が記録されていないエントリは空文字列とする。
+func ribStrings(ts tables) map[string]string {
+	m := make(map[string]string)
+	for _, r := range ts {
+		for _, e := range r.Routes() {
+			m[e.String()] = ""
+		}
+		for _, c := range r.changes {
+			m[c.e.String()] = c.s.String()
+		}
+	}
+	return m
+}
+
 func TestUpdateMessageFromAdjRIBOut(t *testing.T) {
 	// 本テストの値は環境によって異なる。
 	// 本実装では開発機、テスト実施機に
@@ -129,6 +142,10 @@ func TestUpdateMessageFromAdjRIBOut(t *testing.T) {
 
 	locAS := bgp.ASNumber(64514)
 	locIP := net.ParseIP("10.200.100.3").To4()
+	c, err := config.New(locAS, locIP.String(), someAS, "10.200.100.2", config.Passive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	rap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{someAS})
 	if err != nil {
@@ -147,12 +164,12 @@ func TestUpdateMessageFromAdjRIBOut(t *testing.T) {
 	}
 	re := NewRIBEntry(ipv4nw, ribPas)
 	aro.Insert(re)
-	get, err := aro.ToUpdateMessage(locIP, locAS)
+	get, err := aro.ToUpdateMessage(bgp.IPv4Unicast, c, UpdateOptions{FourOctetAS: true})
 	if err != nil {
 		t.Error(err)
 	}
 
-	uap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{someAS, locAS})
+	uap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{locAS, someAS})
 	if err != nil {
 		t.Error(err)
 	}
@@ -178,3 +195,1550 @@ func TestUpdateMessageFromAdjRIBOut(t *testing.T) {
 func updateMsgeEqual(u1, u2 *message.UpdateMessage) bool {
 	return u1.String() == u2.String()
 }
+
+func TestAdjRIBInPurgeStale(t *testing.T) {
+	someAS := bgp.ASNumber(64513)
+	someIP := net.ParseIP("10.0.100.3").To4()
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{someAS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pas := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		pathattribute.NextHop(someIP),
+	}
+	nws := []*ip.IPv4Net{}
+	for _, s := range []string{"10.100.220.0/24", "10.100.221.0/24"} {
+		_, nw, _ := net.ParseCIDR(s)
+		ipv4nw, err := ip.NewIPv4Net(nw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nws = append(nws, ipv4nw)
+	}
+	um, err := message.NewUpdateMsg(pas, nws, []*ip.IPv4Net{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari.Update(um)
+	ari.AllUnchanged()
+
+	// BoRRを受信した後、1つ目のPrefixだけが再送される
+	ari.MarkStale(bgp.IPv4Unicast)
+	um, err = message.NewUpdateMsg(pas, nws[:1], []*ip.IPv4Net{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ari.Update(um)
+	purged := ari.PurgeStale(bgp.IPv4Unicast)
+
+	if len(purged) != 1 || !purged[0].nw.Equal(nws[1]) {
+		t.Errorf("PurgeStale() = %v, want %v", purged, nws[1])
+	}
+	// Withdrawnのエントリは、LocRIBに反映した後に削除される
+	ari.AllUnchanged()
+	rts := ari.Routes()
+	if len(rts) != 1 || !rts[0].nw.Equal(nws[0]) {
+		t.Errorf("Routes() = %v, want %v", rts, nws[0])
+	}
+}
+
+// Withdrawn Routes, MP_UNREACH_NLRIで取り下げられたルートは削除され、
+// Withdrawnの変更として記録される
+func TestAdjRIBInWithdrawnRoutes(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw6, _ := net.ParseCIDR("2001:db8:1::/48")
+	ipv6nw, err := ip.NewIPv6Net(nw6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reach, err := pathattribute.NewMPReachNLRI(
+		bgp.IPv6Unicast, []net.IP{net.ParseIP("2001:db8::2")}, []ip.Prefix{ipv6nw},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pas := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		pathattribute.NextHop(net.ParseIP("10.0.100.3").To4()),
+		reach,
+	}
+	um, err := message.NewUpdateMsg(pas, []*ip.IPv4Net{ipv4nw}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari.Update(um)
+	ari.AllUnchanged()
+
+	unreach, err := pathattribute.NewMPUnreachNLRI(bgp.IPv6Unicast, []ip.Prefix{ipv6nw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	um, err = message.NewUpdateMsg(
+		[]pathattribute.PathAttribute{unreach}, nil, []*ip.IPv4Net{ipv4nw},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ari.Update(um)
+	if !ari.ContainChanged() {
+		t.Errorf("ContainChanged() = false, want true")
+	}
+	if rts := ari.Routes(); len(rts) != 0 {
+		t.Errorf("Routes() = %v, want none", rts)
+	}
+	for f, r := range ari.tables {
+		if len(r.changes) != 1 || r.changes[0].s != Withdrawn {
+			t.Errorf("%v: changes = %v, want 1 Withdrawn", f, r.changes)
+		}
+	}
+}
+
+// LocRIBから削除されたルートは、AdjRIBOutから取り下げられ、
+// Withdrawn RoutesとしてUpdateMessageに含まれる
+func TestAdjRIBOutWithdrawnRoutes(t *testing.T) {
+	someAS := bgp.ASNumber(64513)
+	locAS := bgp.ASNumber(64514)
+	c, err := config.New(locAS, "10.200.100.3", someAS, "10.200.100.2", config.Passive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64515})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := NewRIBEntry(ipv4nw, []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		pathattribute.NextHop(net.ParseIP("10.0.100.3").To4()),
+	})
+	lr := newLocRIB(locAS)
+	lr.Insert(re)
+	aro := NewAdjRIBOut()
+	aro.Update(lr, c, bgp.IPv4Unicast)
+	aro.AllUnchanged()
+
+	lr.tables[bgp.IPv4Unicast].remove(re)
+	aro.Update(lr, c, bgp.IPv4Unicast)
+	if rts := aro.Routes(); len(rts) != 0 {
+		t.Fatalf("Routes() = %v, want none", rts)
+	}
+	get, err := aro.ToUpdateMessage(bgp.IPv4Unicast, c, UpdateOptions{FourOctetAS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := message.NewUpdateMsg(nil, nil, []*ip.IPv4Net{ipv4nw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(get) != 1 || !updateMsgeEqual(want, get[0]) {
+		t.Errorf("update message not equal:\n%v\n%v", want, get)
+	}
+	aro.AllUnchangedOf(bgp.IPv4Unicast)
+	if rts := aro.Routes(); len(rts) != 0 {
+		t.Errorf("Routes() = %v, want none", rts)
+	}
+}
+
+// セッションが切断されたPeerのAdjRIBInのルートは、WithdrawAllによって
+// LocRIBから削除され、LocRIBの変更が通知される
+func TestAdjRIBInWithdrawAll(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NEXT_HOPを持たないルートは、カーネルのルーティングテーブルに書き込まれない
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari.Insert(NewRIBEntry(ipv4nw, []pathattribute.PathAttribute{pathattribute.Igp, ap}))
+	lr := newLocRIB(64514)
+	notified := 0
+	lr.Subscribe(func([]ip.Prefix) { notified++ })
+	lr.Update(ari)
+	ari.AllUnchanged()
+	if rts := lr.Routes(); len(rts) != 1 {
+		t.Fatalf("Routes() = %v, want 1 route", rts)
+	}
+
+	ari.WithdrawAll()
+	lr.Update(ari)
+	if rts := lr.Routes(); len(rts) != 0 {
+		t.Errorf("Routes() = %v, want none", rts)
+	}
+	if notified != 2 {
+		t.Errorf("notified = %d, want 2", notified)
+	}
+}
+
+// MP_REACH_NLRIで受信したIPv6のルートは、IPv6 Unicastのテーブルで処理され、
+// MP_REACH_NLRIのNext Hopを自身のアドレスに置き換えて広告される
+func TestIPv6RouteToUpdateMessage(t *testing.T) {
+	someAS := bgp.ASNumber(64513)
+	locAS := bgp.ASNumber(64514)
+	locIPv6 := net.ParseIP("2001:db8::3")
+	c, err := config.New(
+		locAS, "10.200.100.3", someAS, "10.200.100.2", config.Passive, nil,
+		config.WithNextHop(locIPv6.String()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{someAS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("2001:db8:1::/48")
+	ipv6nw, err := ip.NewIPv6Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reach, err := pathattribute.NewMPReachNLRI(
+		bgp.IPv6Unicast, []net.IP{net.ParseIP("2001:db8::2")}, []ip.Prefix{ipv6nw},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um, err := message.NewUpdateMsg(
+		[]pathattribute.PathAttribute{pathattribute.Igp, ap, reach}, nil, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari.Update(um)
+	if rts := ari.RoutesOf(bgp.IPv4Unicast); len(rts) != 0 {
+		t.Errorf("RoutesOf(IPv4 Unicast) = %v, want none", rts)
+	}
+	rts := ari.RoutesOf(bgp.IPv6Unicast)
+	if len(rts) != 1 || !rts[0].nw.Equal(ipv6nw) {
+		t.Fatalf("RoutesOf(IPv6 Unicast) = %v, want %v", rts, ipv6nw)
+	}
+
+	aro := NewAdjRIBOut()
+	aro.Insert(rts[0])
+	// ネゴシエーションしていないAFI/SAFIのルートは生成しない
+	if ums, err := aro.ToUpdateMessage(bgp.IPv4Unicast, c, UpdateOptions{FourOctetAS: true}); err != nil || len(ums) != 0 {
+		t.Errorf("ToUpdateMessage(IPv4 Unicast) = %v, %v, want none", ums, err)
+	}
+	get, err := aro.ToUpdateMessage(bgp.IPv6Unicast, c, UpdateOptions{FourOctetAS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{locAS, someAS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ureach, err := pathattribute.NewMPReachNLRI(
+		bgp.IPv6Unicast, []net.IP{locIPv6}, []ip.Prefix{ipv6nw},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := message.NewUpdateMsg(
+		[]pathattribute.PathAttribute{pathattribute.Igp, uap, ureach}, nil, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(get) != 1 || !updateMsgeEqual(want, get[0]) {
+		t.Errorf("update message not equal:\n%v\n%v", want, get)
+	}
+	// RIBEntryのMP_REACH_NLRIはNLRIを持たない
+	if ents := aro.RoutesOf(bgp.IPv6Unicast); !strings.Contains(ents[0].String(), "nlri: []") {
+		t.Errorf("RIBEntry has NLRI: %v", ents[0])
+	}
+}
+
+func TestSelectBestPath(t *testing.T) {
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(o pathattribute.Origin, path []bgp.ASNumber, src *Source, pas ...pathattribute.PathAttribute) *RIBEntry {
+		ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := NewRIBEntry(ipv4nw, append([]pathattribute.PathAttribute{o, ap}, pas...))
+		e.src = src
+		return e
+	}
+	ebgp := func(addr, id string) *Source {
+		return &Source{Address: net.ParseIP(addr), RouterID: net.ParseIP(id), AS: 64513}
+	}
+	ibgp := func(addr, id string) *Source {
+		return &Source{Address: net.ParseIP(addr), RouterID: net.ParseIP(id), AS: 64514, IBGP: true}
+	}
+	// AS_SEQUENCEとAS_SETの2つのSegmentを持つルート
+	setEntry := func(o pathattribute.Origin, path, set []bgp.ASNumber, src *Source) *RIBEntry {
+		seq, err := pathattribute.NewASPathSegment(pathattribute.ASSegTypeSequence, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := pathattribute.NewASPathSegment(pathattribute.ASSegTypeSet, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := NewRIBEntry(ipv4nw, []pathattribute.PathAttribute{o, pathattribute.NewASPathFromSegments(seq, st)})
+		e.src = src
+		return e
+	}
+	tests := []struct {
+		name   string
+		paths  []*RIBEntry
+		want   int
+		reason Reason
+	}{
+		{
+			name:   "only path",
+			paths:  []*RIBEntry{entry(pathattribute.Igp, []bgp.ASNumber{64513}, ebgp("10.0.0.1", "1.1.1.1"))},
+			want:   0,
+			reason: OnlyPath,
+		},
+		{
+			name: "higher local pref",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{64513}, ibgp("10.0.0.1", "1.1.1.1")),
+				entry(pathattribute.Igp, []bgp.ASNumber{64513, 64515}, ibgp("10.0.0.2", "2.2.2.2"),
+					pathattribute.LocalPref(200)),
+			},
+			want:   1,
+			reason: HigherLocalPref,
+		},
+		{
+			// 自身が広告するルートより、LOCAL_PREFが大きい対向機器のルートを優先する
+			name: "higher local pref over locally originated",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{}, nil),
+				entry(pathattribute.Igp, []bgp.ASNumber{64513}, ibgp("10.0.0.1", "1.1.1.1"),
+					pathattribute.LocalPref(200)),
+			},
+			want:   1,
+			reason: HigherLocalPref,
+		},
+		{
+			name: "shorter as path",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{64513, 64515}, ebgp("10.0.0.1", "1.1.1.1")),
+				entry(pathattribute.Incomplete, []bgp.ASNumber{64516}, ebgp("10.0.0.2", "2.2.2.2")),
+			},
+			want:   1,
+			reason: ShorterASPath,
+		},
+		{
+			// LOCAL_PREFとAS_PATHが同じ場合は、自身が広告するルートを優先する
+			name: "locally originated",
+			paths: []*RIBEntry{
+				entry(pathattribute.Incomplete, []bgp.ASNumber{}, ibgp("10.0.0.1", "1.1.1.1")),
+				entry(pathattribute.Incomplete, []bgp.ASNumber{}, nil),
+			},
+			want:   1,
+			reason: LocallyOriginated,
+		},
+		{
+			name: "as set counts as one",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{64513, 64515, 64516}, ebgp("10.0.0.1", "1.1.1.1")),
+				setEntry(pathattribute.Incomplete, []bgp.ASNumber{64513}, []bgp.ASNumber{64600, 64601, 64602},
+					ebgp("10.0.0.2", "2.2.2.2")),
+			},
+			want:   1,
+			reason: ShorterASPath,
+		},
+		{
+			name: "lower origin",
+			paths: []*RIBEntry{
+				entry(pathattribute.Egp, []bgp.ASNumber{64513}, ebgp("10.0.0.1", "1.1.1.1")),
+				entry(pathattribute.Igp, []bgp.ASNumber{64516}, ebgp("10.0.0.2", "2.2.2.2")),
+			},
+			want:   1,
+			reason: LowerOrigin,
+		},
+		{
+			name: "lower med",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{64513}, ebgp("10.0.0.1", "1.1.1.1"),
+					pathattribute.MultiExitDisc(20)),
+				entry(pathattribute.Igp, []bgp.ASNumber{64513}, ebgp("10.0.0.2", "2.2.2.2"),
+					pathattribute.MultiExitDisc(10)),
+			},
+			want:   1,
+			reason: LowerMED,
+		},
+		{
+			// 異なる隣接ASのルートのMEDは比較しない
+			name: "med of different neighbor as",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{64513}, ebgp("10.0.0.1", "1.1.1.1"),
+					pathattribute.MultiExitDisc(20)),
+				entry(pathattribute.Igp, []bgp.ASNumber{64516}, ebgp("10.0.0.2", "2.2.2.2"),
+					pathattribute.MultiExitDisc(10)),
+			},
+			want:   0,
+			reason: LowerRouterID,
+		},
+		{
+			name: "ebgp over ibgp",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{64513}, ibgp("10.0.0.1", "1.1.1.1")),
+				entry(pathattribute.Igp, []bgp.ASNumber{64516}, ebgp("10.0.0.2", "2.2.2.2")),
+			},
+			want:   1,
+			reason: EBGPOverIBGP,
+		},
+		{
+			name: "lower router id",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{64513}, ebgp("10.0.0.1", "2.2.2.2")),
+				entry(pathattribute.Igp, []bgp.ASNumber{64516}, ebgp("10.0.0.2", "1.1.1.1")),
+			},
+			want:   1,
+			reason: LowerRouterID,
+		},
+		{
+			name: "lower peer address",
+			paths: []*RIBEntry{
+				entry(pathattribute.Igp, []bgp.ASNumber{64513}, ebgp("10.0.0.2", "1.1.1.1")),
+				entry(pathattribute.Igp, []bgp.ASNumber{64516}, ebgp("10.0.0.1", "1.1.1.1")),
+			},
+			want:   1,
+			reason: LowerPeerAddress,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			get, reason := selectBest(tc.paths, nil)
+			if get != tc.paths[tc.want] {
+				t.Errorf("selectBest() = %v, want %v", get, tc.paths[tc.want])
+			}
+			if reason != tc.reason {
+				t.Errorf("reason = %v, want %v", reason, tc.reason)
+			}
+		})
+	}
+}
+
+// 2つのPeerから同じPrefixを受信した場合、LocRIBにはベストパスのみがインストールされ、
+// ベストパスが取り下げられると、残りの候補が選択される
+func TestLocRIBKeepsBestPath(t *testing.T) {
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(path ...bgp.ASNumber) *message.UpdateMessage {
+		ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		um, err := message.NewUpdateMsg([]pathattribute.PathAttribute{
+			pathattribute.Igp,
+			ap,
+			pathattribute.NextHop(net.ParseIP("10.0.100.3").To4()),
+		}, []*ip.IPv4Net{ipv4nw}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return um
+	}
+	// NEXT_HOPを自身のアドレスとし、カーネルのルーティングテーブルには書き込まない
+	lr := newLocRIB(64514)
+	lr.localIPs = []net.IP{net.ParseIP("10.0.100.3")}
+	ari1 := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari1.Update(update(64513, 64515))
+	lr.Update(ari1)
+	ari1.AllUnchanged()
+	ari2 := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.4"), AS: 64516})
+	ari2.Update(update(64516))
+	lr.Update(ari2)
+	ari2.AllUnchanged()
+
+	if rts := lr.Routes(); len(rts) != 1 || rts[0].Source() != ari2.src {
+		t.Fatalf("Routes() = %v, want best path from %v", rts, ari2.src)
+	}
+	sel, ok := lr.BestPath(ipv4nw)
+	if !ok {
+		t.Fatal("BestPath() not found")
+	}
+	if sel.Reason != ShorterASPath || sel.Candidates != 2 {
+		t.Errorf("BestPath() = %v, %d, want %v, 2", sel.Reason, sel.Candidates, ShorterASPath)
+	}
+
+	ari2.WithdrawAll()
+	lr.Update(ari2)
+	if rts := lr.Routes(); len(rts) != 1 || rts[0].Source() != ari1.src {
+		t.Fatalf("Routes() = %v, want best path from %v", rts, ari1.src)
+	}
+	sel, ok = lr.BestPath(ipv4nw)
+	if !ok || sel.Reason != OnlyPath || sel.Candidates != 1 {
+		t.Errorf("BestPath() = %v, %v, want %v", sel, ok, OnlyPath)
+	}
+
+	ari1.WithdrawAll()
+	lr.Update(ari1)
+	if rts := lr.Routes(); len(rts) != 0 {
+		t.Errorf("Routes() = %v, want none", rts)
+	}
+	if _, ok := lr.BestPath(ipv4nw); ok {
+		t.Error("BestPath() found, want none")
+	}
+}
+
+// カーネルがルートを受け付けない場合も、LocRIBの処理を続ける
+func TestLocRIBContinuesWhenKernelRejectsRoute(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nlri []*ip.IPv4Net
+	for _, s := range []string{"198.51.100.0/25", "198.51.100.128/25"} {
+		_, nw, _ := net.ParseCIDR(s)
+		n, err := ip.NewIPv4Net(nw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nlri = append(nlri, n)
+	}
+	// 直接接続されていないNEXT_HOPのルートは、カーネルが受け付けない
+	um, err := message.NewUpdateMsg([]pathattribute.PathAttribute{
+		pathattribute.Igp, ap, pathattribute.NextHop(net.ParseIP("203.0.113.1").To4()),
+	}, nlri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr := newLocRIB(64514)
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari.Update(um)
+	lr.Update(ari)
+	if rts := lr.Routes(); len(rts) != len(nlri) {
+		t.Errorf("Routes() = %v, want %d routes", rts, len(nlri))
+	}
+}
+
+// 自身が広告するルートが候補にあるPrefixは、対向機器から受信したルートがベストパスでも
+// カーネルのルーティングテーブルに書き込まず、書き込んだルートは候補が変わった時点で削除する
+func TestLocRIBDoesNotOverrideLocalRoutes(t *testing.T) {
+	prefix := func(s string) ip.Prefix {
+		_, nw, _ := net.ParseCIDR(s)
+		p, err := ip.NewPrefix(nw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerAttrs := []pathattribute.PathAttribute{
+		pathattribute.Igp, ap, pathattribute.NextHop(net.ParseIP("10.200.100.2").To4()),
+	}
+	c, err := config.New(64514, "10.200.100.3", 64513, "10.200.100.2", config.Active, nil,
+		config.WithAggregate(prefix("10.100.0.0/16").Net(), false, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr := newLocRIB(64514)
+	lr.localIPs = []net.IP{c.NextHop(bgp.AFIIPv4)}
+	// カーネルのルーティングテーブルの代わりに、書き込んだルートを記録する
+	kernel := map[string]string{}
+	lr.routeReplace = func(r *netlink.Route) error {
+		kernel[r.Dst.String()] = r.Gw.String()
+		return nil
+	}
+	lr.routeDel = func(r *netlink.Route) error {
+		if gw, ok := kernel[r.Dst.String()]; !ok || gw != r.Gw.String() {
+			return fmt.Errorf("route not found: %v", r)
+		}
+		delete(kernel, r.Dst.String())
+		return nil
+	}
+	// 自身が広告するルート
+	local, err := localAttrs(c, bgp.AFIIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnw := prefix("10.200.1.0/24")
+	lr.addPath(NewRIBEntry(lnw, local))
+	lr.decide(lnw)
+	for _, a := range c.Aggregates() {
+		if err := lr.addAggregate(c, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Import PolicyのLOCAL_PREFにより、対向機器から受信したルートがベストパスになる
+	lp := uint32(200)
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513, LocalPref: &lp})
+	install := func(nws ...string) {
+		s := attrSets.intern(ari.importAttrs(peerAttrs))
+		for _, nw := range nws {
+			ari.install(prefix(nw), s)
+		}
+		attrSets.release(s)
+		lr.Update(ari)
+		ari.AllUnchanged()
+	}
+	withdraw := func(nw string) {
+		ari.withdraw(prefix(nw))
+		lr.Update(ari)
+		ari.AllUnchanged()
+	}
+
+	// local best -> peer best: ホストのルートを置き換えない
+	install("10.200.1.0/24")
+	if sel, ok := lr.BestPath(lnw); !ok || sel.Best.Source() == nil || sel.Reason != HigherLocalPref {
+		t.Fatalf("BestPath() = %v, want peer route by %v", sel, HigherLocalPref)
+	}
+	if gw, ok := kernel["10.200.1.0/24"]; ok {
+		t.Errorf("kernel route = %v, want none", gw)
+	}
+	// peer best -> peer withdrawn: 対向機器のルートを残さない
+	withdraw("10.200.1.0/24")
+	if sel, ok := lr.BestPath(lnw); !ok || sel.Best.Source() != nil {
+		t.Fatalf("BestPath() = %v, want locally originated route", sel)
+	}
+	if gw, ok := kernel["10.200.1.0/24"]; ok {
+		t.Errorf("kernel route = %v, want none", gw)
+	}
+
+	// 集約ルートが生成されると、ベストパスが変わらなくても書き込んだルートを削除し、
+	// 取り下げられると、再度書き込む
+	install("10.100.0.0/16")
+	if gw := kernel["10.100.0.0/16"]; gw != "10.200.100.2" {
+		t.Fatalf("kernel route = %v, want 10.200.100.2", gw)
+	}
+	install("10.100.1.0/24")
+	if gw, ok := kernel["10.100.0.0/16"]; ok {
+		t.Errorf("kernel route = %v, want none while aggregate exists", gw)
+	}
+	withdraw("10.100.1.0/24")
+	if gw := kernel["10.100.0.0/16"]; gw != "10.200.100.2" {
+		t.Errorf("kernel route = %v, want 10.200.100.2", gw)
+	}
+	withdraw("10.100.0.0/16")
+	if len(kernel) != 0 {
+		t.Errorf("kernel routes = %v, want none", kernel)
+	}
+}
+
+func TestTrie(t *testing.T) {
+	tr := newTrie[string]()
+	var nws []ip.Prefix
+	for _, c := range []string{
+		"10.0.0.0/8", "10.100.220.0/24", "10.100.0.0/16",
+		"10.100.221.0/24", "192.168.0.0/16", "0.0.0.0/0",
+	} {
+		_, nw, _ := net.ParseCIDR(c)
+		p, err := ip.NewPrefix(nw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.Put(p, c)
+		nws = append(nws, p)
+	}
+	if tr.Len() != len(nws) {
+		t.Fatalf("Len() = %d, want %d", tr.Len(), len(nws))
+	}
+	for _, nw := range nws {
+		if v, ok := tr.Get(nw); !ok || v != nw.Net().String() {
+			t.Errorf("Get(%v) = %v, %v", nw, v, ok)
+		}
+	}
+	// Prefixの順にたどる
+	var get []string
+	tr.Walk(func(_ ip.Prefix, v string) bool {
+		get = append(get, v)
+		return true
+	})
+	want := []string{
+		"0.0.0.0/0", "10.0.0.0/8", "10.100.0.0/16",
+		"10.100.220.0/24", "10.100.221.0/24", "192.168.0.0/16",
+	}
+	if strings.Join(get, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk() = %v, want %v", get, want)
+	}
+
+	// 分岐ノードのPrefixは値を持たない
+	_, nw, _ := net.ParseCIDR("10.100.220.0/23")
+	p, err := ip.NewPrefix(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tr.Get(p); ok {
+		t.Errorf("Get(%v) found", p)
+	}
+	if tr.Delete(p) {
+		t.Errorf("Delete(%v) = true", p)
+	}
+
+	for i, nw := range nws {
+		if !tr.Delete(nw) {
+			t.Errorf("Delete(%v) = false", nw)
+		}
+		if _, ok := tr.Get(nw); ok {
+			t.Errorf("Get(%v) found after Delete", nw)
+		}
+		for _, o := range nws[i+1:] {
+			if _, ok := tr.Get(o); !ok {
+				t.Errorf("Get(%v) not found after Delete(%v)", o, nw)
+			}
+		}
+	}
+	if tr.Len() != 0 || tr.root != nil {
+		t.Errorf("Len() = %d, root = %v, want empty", tr.Len(), tr.root)
+	}
+}
+
+// AdjRIBOutは変更があったPrefixのルートのみをUpdateMessageにする
+func TestAdjRIBOutSendsOnlyChanges(t *testing.T) {
+	c, err := config.New(64514, "10.200.100.3", 64513, "10.200.100.2", config.Passive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64515})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pas := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		pathattribute.NextHop(net.ParseIP("10.0.100.3").To4()),
+	}
+	lr := newLocRIB(64514)
+	var nws []*ip.IPv4Net
+	for _, s := range []string{"10.100.220.0/24", "10.100.221.0/24"} {
+		_, nw, _ := net.ParseCIDR(s)
+		ipv4nw, err := ip.NewIPv4Net(nw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nws = append(nws, ipv4nw)
+		lr.Insert(NewRIBEntry(ipv4nw, pas))
+	}
+	aro := NewAdjRIBOut()
+	aro.Update(lr, c, bgp.IPv4Unicast)
+	aro.AllUnchanged()
+
+	// 変更のないPrefixを同期しても、変更は記録されない
+	aro.Sync(lr, c, []ip.Prefix{nws[0]}, bgp.IPv4Unicast)
+	if aro.ContainChanged() {
+		t.Fatal("ContainChanged() = true, want false")
+	}
+	e := NewRIBEntry(nws[1], pas)
+	lr.tables[bgp.IPv4Unicast].withdraw(nws[1])
+	lr.Insert(e)
+	aro.Sync(lr, c, []ip.Prefix{nws[1]}, bgp.IPv4Unicast)
+	get, err := aro.ToUpdateMessage(bgp.IPv4Unicast, c, UpdateOptions{FourOctetAS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(get) != 1 || len(get[0].NLRI()) != 1 || !get[0].NLRI()[0].Equal(nws[1]) {
+		t.Errorf("ToUpdateMessage() = %v, want NLRI %v", get, nws[1])
+	}
+	aro.AllUnchanged()
+
+	// Route Refreshでは、すべてのルートを再送する
+	aro.Readvertise(bgp.IPv4Unicast)
+	get, err = aro.ToUpdateMessage(bgp.IPv4Unicast, c, UpdateOptions{FourOctetAS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同じPathAttributeのルートは1つのUpdateMessageにまとめる
+	if len(get) != 1 || len(get[0].NLRI()) != 2 {
+		t.Errorf("ToUpdateMessage() = %v, want 1 message with 2 NLRI", get)
+	}
+}
+
+// 多数のルートは、最大長に収まるように少数のUpdateMessageにまとめる
+func TestToUpdateMessagePacking(t *testing.T) {
+	c, err := config.New(64514, "10.200.100.3", 64513, "10.200.100.2", config.Passive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64515})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10000
+	newAdjRIBOut := func() *AdjRIBOut {
+		aro := NewAdjRIBOut()
+		for i := 0; i < n; i++ {
+			ipv4nw, err := ip.NewIPv4Net(&net.IPNet{
+				IP:   net.IPv4(10, byte(i>>8), byte(i), 0),
+				Mask: net.CIDRMask(24, 32),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 受信したUpdateMessageごとに、PathAttributeのスライスは異なる
+			pas := []pathattribute.PathAttribute{
+				pathattribute.Igp,
+				ap,
+				pathattribute.NextHop(net.IPv4(10, 0, 100, byte(i%2+3)).To4()),
+			}
+			aro.Insert(NewRIBEntry(ipv4nw, pas))
+		}
+		return aro
+	}
+	tests := []struct {
+		name    string
+		opts    UpdateOptions
+		maxMsgs int
+	}{
+		{name: "standard", opts: UpdateOptions{FourOctetAS: true}, maxMsgs: 12},
+		{name: "extended", opts: UpdateOptions{FourOctetAS: true, MaxMsgLen: message.MaxExtendedMsgLen}, maxMsgs: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aro := newAdjRIBOut()
+			ums, err := aro.ToUpdateMessage(bgp.IPv4Unicast, c, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ums) > tt.maxMsgs {
+				t.Errorf("len(ToUpdateMessage()) = %d, want <= %d", len(ums), tt.maxMsgs)
+			}
+			nlri := 0
+			for _, um := range ums {
+				b, err := message.Marshal(um)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(b) > tt.opts.maxMsgLen() {
+					t.Errorf("len(UpdateMessage) = %d, want <= %d", len(b), tt.opts.maxMsgLen())
+				}
+				m, err := message.UnMarshal(b, message.WithFourOctetAS(true),
+					message.WithExtendedMessage(tt.opts.MaxMsgLen > message.MaxMsgLen))
+				if err != nil {
+					t.Fatal(err)
+				}
+				nlri += len(m.(*message.UpdateMessage).NLRI())
+			}
+			if nlri != n {
+				t.Errorf("NLRI = %d, want %d", nlri, n)
+			}
+
+			// 取り下げるルートも最大長に収まるように分割する
+			aro.AllUnchanged()
+			for _, e := range aro.Routes() {
+				aro.withdraw(e.Prefix())
+			}
+			ums, err = aro.ToUpdateMessage(bgp.IPv4Unicast, c, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wr := 0
+			for _, um := range ums {
+				b, err := message.Marshal(um)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(b) > tt.opts.maxMsgLen() {
+					t.Errorf("len(UpdateMessage) = %d, want <= %d", len(b), tt.opts.maxMsgLen())
+				}
+				wr += len(um.WithdrawnRoutes())
+			}
+			if len(ums) > tt.maxMsgs || wr != n {
+				t.Errorf("ToUpdateMessage() = %d messages, %d withdrawn, want <= %d, %d",
+					len(ums), wr, tt.maxMsgs, n)
+			}
+		})
+	}
+}
+
+func TestRIBQueries(t *testing.T) {
+	src := &Source{Address: net.ParseIP("10.200.100.2"), AS: 64513}
+	ari := NewAdjRIBIn(src)
+	lr := newLocRIB(64514)
+	prefixes := map[string]ip.Prefix{}
+	for _, c := range []string{
+		"10.0.0.0/8", "10.100.0.0/16", "10.100.220.0/24",
+		"10.100.221.0/24", "10.200.0.0/16", "2001:db8::/32", "2001:db8:1::/48",
+	} {
+		_, nw, _ := net.ParseCIDR(c)
+		p, err := ip.NewPrefix(nw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefixes[c] = p
+		s := attrSets.intern([]pathattribute.PathAttribute{pathattribute.Igp})
+		ari.install(p, s)
+		attrSets.release(s)
+	}
+	lr.Update(ari)
+
+	str := func(es []*RIBEntry) []string {
+		var s []string
+		for _, e := range es {
+			if e.Source() != src {
+				t.Errorf("Source() = %v, want %v", e.Source(), src)
+			}
+			s = append(s, e.Prefix().Net().String())
+		}
+		return s
+	}
+	tests := []struct {
+		name string
+		get  []*RIBEntry
+		want []string
+	}{
+		{
+			name: "exact match",
+			get:  lr.Lookup(prefixes["10.100.0.0/16"]),
+			want: []string{"10.100.0.0/16"},
+		},
+		{
+			name: "longest match",
+			get:  lr.LongestMatch(net.ParseIP("10.100.221.7")),
+			want: []string{"10.100.221.0/24"},
+		},
+		{
+			name: "longest match of covering prefix",
+			get:  lr.LongestMatch(net.ParseIP("10.100.222.7")),
+			want: []string{"10.100.0.0/16"},
+		},
+		{
+			name: "longest match of ipv6 address",
+			get:  lr.LongestMatch(net.ParseIP("2001:db8:2::1")),
+			want: []string{"2001:db8::/32"},
+		},
+		{
+			name: "no longest match",
+			get:  lr.LongestMatch(net.ParseIP("192.168.0.1")),
+			want: nil,
+		},
+		{
+			name: "more specifics",
+			get:  lr.MoreSpecifics(prefixes["10.0.0.0/8"]),
+			want: []string{"10.100.0.0/16", "10.100.220.0/24", "10.100.221.0/24", "10.200.0.0/16"},
+		},
+		{
+			name: "less specifics",
+			get:  lr.LessSpecifics(prefixes["10.100.220.0/24"]),
+			want: []string{"10.0.0.0/8", "10.100.0.0/16"},
+		},
+		{
+			name: "adj-rib-in more specifics",
+			get:  ari.MoreSpecifics(prefixes["2001:db8::/32"]),
+			want: []string{"2001:db8:1::/48"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if get := str(tc.get); strings.Join(get, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("%v, want %v", get, tc.want)
+			}
+		})
+	}
+}
+
+// 対向機器ごとに、LocRIBのルートを変更せずにPathAttributeを書き換えて送信する
+func TestExportRewritesPerPeer(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64515})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nh, err := pathattribute.NewNextHop(net.ParseIP("10.0.100.3").To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// eBGPで受信したルート
+	e := NewRIBEntry(ipv4nw, []pathattribute.PathAttribute{
+		pathattribute.LocalPref(150), pathattribute.Igp, ap, nh, pathattribute.MultiExitDisc(30),
+	})
+	e.src = &Source{Address: net.ParseIP("10.0.100.3"), AS: 64515}
+	want := e.String()
+
+	tests := []struct {
+		name     string
+		remoteAS bgp.ASNumber
+		opts     []config.Option
+		wantPath []bgp.ASNumber
+		wantNH   string
+		// 送信するPathAttributeの文字列(Attribute Type Codeの順)
+		wantAttrs string
+	}{
+		{
+			name: "eBGP", remoteAS: 64513,
+			wantPath: []bgp.ASNumber{64514, 64515}, wantNH: "10.200.100.3",
+			wantAttrs: "[Igp [64514 64515] [10 200 100 3]]",
+		},
+		{
+			name: "eBGP with med", remoteAS: 64513, opts: []config.Option{config.WithMED(10)},
+			wantPath: []bgp.ASNumber{64514, 64515}, wantNH: "10.200.100.3",
+			wantAttrs: "[Igp [64514 64515] [10 200 100 3] MED(10)]",
+		},
+		{
+			name: "iBGP", remoteAS: 64514,
+			wantPath: []bgp.ASNumber{64515}, wantNH: "10.0.100.3",
+			wantAttrs: "[Igp [64515] [10 0 100 3] MED(30) LocalPref(150)]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := config.New(64514, "10.200.100.3", tt.remoteAS, "10.200.100.2", config.Passive, nil, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 複数回送信しても、AS番号が重複して追加されない
+			for range 2 {
+				aro := NewAdjRIBOut()
+				aro.Insert(e)
+				ums, err := aro.ToUpdateMessage(bgp.IPv4Unicast, c, UpdateOptions{FourOctetAS: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(ums) != 1 {
+					t.Fatalf("ToUpdateMessage() = %v, want 1 message", ums)
+				}
+				if s := fmt.Sprint(ums[0].PathAttributes()); s != tt.wantAttrs {
+					t.Errorf("PathAttributes() = %v, want %v", s, tt.wantAttrs)
+				}
+				for _, pa := range ums[0].PathAttributes() {
+					switch a := pa.(type) {
+					case pathattribute.ASPath:
+						if !slices.Equal(a.ASNumbers(), tt.wantPath) {
+							t.Errorf("AS_PATH = %v, want %v", a.ASNumbers(), tt.wantPath)
+						}
+					case pathattribute.NextHop:
+						if a.Val().String() != tt.wantNH {
+							t.Errorf("NEXT_HOP = %v, want %v", a.Val(), tt.wantNH)
+						}
+					}
+				}
+			}
+			if e.String() != want {
+				t.Errorf("RIBEntry = %v, want %v", e, want)
+			}
+		})
+	}
+
+	// iBGPで受信したルートは、iBGPの対向機器に広告しない
+	c, err := config.New(64514, "10.200.100.3", 64514, "10.200.100.2", config.Passive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.src = &Source{Address: net.ParseIP("10.0.100.4"), AS: 64514, IBGP: true}
+	lr := newLocRIB(64514)
+	lr.Insert(e)
+	aro := NewAdjRIBOut()
+	aro.Update(lr, c, bgp.IPv4Unicast)
+	if rs := aro.Routes(); len(rs) != 0 {
+		t.Errorf("AdjRIBOut.Routes() = %v, want none", rs)
+	}
+}
+
+// 同じPathAttributeのルートは、PeerやUPDATE Messageが異なっても1つのattrSetを共有する
+func TestAttrSetInterning(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513, 64520})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nh, err := pathattribute.NewNextHop(net.ParseIP("10.0.100.3").To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 受信するUPDATE MessageごとにPathAttributeは異なる値として生成される
+	newUpdate := func(nws ...string) *message.UpdateMessage {
+		var nlri []*ip.IPv4Net
+		for _, s := range nws {
+			_, nw, _ := net.ParseCIDR(s)
+			ipv4nw, err := ip.NewIPv4Net(nw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nlri = append(nlri, ipv4nw)
+		}
+		um, err := message.NewUpdateMsg([]pathattribute.PathAttribute{
+			pathattribute.Igp, ap, nh,
+		}, nlri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return um
+	}
+	ari1 := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari2 := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.4"), AS: 64513})
+	ari1.Update(newUpdate("10.1.0.0/24", "10.1.1.0/24", "10.1.2.0/24"))
+	ari1.Update(newUpdate("10.1.3.0/24"))
+	ari2.Update(newUpdate("10.1.0.0/24", "10.1.1.0/24"))
+
+	es := append(ari1.Routes(), ari2.Routes()...)
+	s := es[0].attrs
+	for _, e := range es {
+		if e.attrs != s {
+			t.Errorf("%v does not share attrSet", e)
+		}
+	}
+	if s.refs != len(es) {
+		t.Errorf("refs = %d, want %d", s.refs, len(es))
+	}
+
+	// 同じPrefixを置き換えても参照数は変わらない
+	ari2.Update(newUpdate("10.1.0.0/24"))
+	if s.refs != len(es) {
+		t.Errorf("refs = %d, want %d", s.refs, len(es))
+	}
+
+	// 参照するエントリがなくなったattrSetは削除する
+	ari1.WithdrawAll()
+	ari2.WithdrawAll()
+	if s.refs != 0 {
+		t.Errorf("refs = %d, want 0", s.refs)
+	}
+	if _, ok := attrSets.sets[s.key]; ok {
+		t.Errorf("attrSet is not released: %v", s.attrs)
+	}
+}
+
+// LocRIB, AdjRIBOutが参照している間は、AdjRIBInから取り下げてもattrSetを削除しない
+func TestAttrSetHeldByLocRIBAndAdjRIBOut(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513, 64521})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nh, err := pathattribute.NewNextHop(net.ParseIP("10.0.100.3").To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.1.10.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pas := []pathattribute.PathAttribute{pathattribute.Igp, ap, nh}
+	um, err := message.NewUpdateMsg(pas, []*ip.IPv4Net{ipv4nw}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.New(64514, "10.200.100.3", 64515, "10.200.100.5", config.Active, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NEXT_HOPを自身のアドレスとし、カーネルのルーティングテーブルには書き込まない
+	lr := newLocRIB(64514)
+	lr.localIPs = []net.IP{net.ParseIP("10.0.100.3")}
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari.Update(um)
+	lr.Update(ari)
+	ari.AllUnchanged()
+	aro := NewAdjRIBOut()
+	aro.Update(lr, c, bgp.IPv4Unicast)
+	s := ari.Routes()[0].attrs
+
+	ari.WithdrawAll()
+	if _, ok := attrSets.sets[s.key]; !ok {
+		t.Fatalf("attrSet is released while LocRIB and AdjRIBOut hold it: %v", s.attrs)
+	}
+	// 同じPathAttributeは、LocRIB, AdjRIBOutと同じattrSetを共有する
+	if got := attrSets.intern(ari.importAttrs(ipv4Attrs(pas))); got != s {
+		t.Errorf("intern() = %p, want %p", got, s)
+	} else {
+		attrSets.release(got)
+	}
+
+	lr.Update(ari)
+	aro.Sync(lr, c, []ip.Prefix{ipv4nw}, bgp.IPv4Unicast)
+	if _, ok := attrSets.sets[s.key]; ok {
+		t.Errorf("attrSet is not released: %v, refs: %d", s.attrs, s.refs)
+	}
+}
+
+// eBGPで受信したLOCAL_PREFは無視し、Import PolicyのLOCAL_PREFで置き換える
+func TestAdjRIBInImportLocalPref(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nh, err := pathattribute.NewNextHop(net.ParseIP("10.0.100.3").To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um, err := message.NewUpdateMsg([]pathattribute.PathAttribute{
+		pathattribute.Igp, ap, nh, pathattribute.LocalPref(300),
+	}, []*ip.IPv4Net{ipv4nw}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp := uint32(200)
+	tests := []struct {
+		name string
+		src  *Source
+		want uint32
+	}{
+		{name: "eBGP", src: &Source{AS: 64513}, want: defaultLocalPref},
+		{name: "iBGP", src: &Source{AS: 64514, IBGP: true}, want: 300},
+		{name: "import policy", src: &Source{AS: 64513, LocalPref: &lp}, want: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ari := NewAdjRIBIn(tt.src)
+			ari.Update(um)
+			rs := ari.Routes()
+			if len(rs) != 1 || rs[0].localPref() != tt.want {
+				t.Errorf("Routes() = %v, want LOCAL_PREF %d", rs, tt.want)
+			}
+		})
+	}
+}
+
+// 集約されるルートがLocRIBに存在する間だけ集約ルートを生成し、
+// Summary-onlyの場合は集約されるルートを広告しない
+func TestAggregate(t *testing.T) {
+	_, agg1, _ := net.ParseCIDR("10.100.0.0/16")
+	_, agg2, _ := net.ParseCIDR("10.200.0.0/16")
+	// 集約されるルートを受信したPeerとは別の対向機器に広告する
+	c, err := config.New(64514, "10.200.100.3", 64520, "10.200.100.5", config.Passive, nil,
+		config.WithAggregate(agg1, true, false), config.WithAggregate(agg2, false, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr := newLocRIB(64514)
+	// 集約ルートのNEXT_HOPは自身のアドレスであり、カーネルのルーティングテーブルに書き込まれない
+	lr.localIPs = []net.IP{c.NextHop(bgp.AFIIPv4)}
+	for _, a := range c.Aggregates() {
+		if err := lr.addAggregate(c, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rts := lr.Routes(); len(rts) != 0 {
+		t.Fatalf("Routes() = %v, want none", rts)
+	}
+
+	prefix := func(s string) ip.Prefix {
+		_, nw, _ := net.ParseCIDR(s)
+		p, err := ip.NewPrefix(nw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	path := func(as ...bgp.ASNumber) pathattribute.ASPath {
+		ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, as)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ap
+	}
+	// NEXT_HOPを持たないルートは、カーネルのルーティングテーブルに書き込まれない
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	for _, r := range []struct {
+		nw    string
+		attrs []pathattribute.PathAttribute
+	}{
+		{"10.100.220.0/24", []pathattribute.PathAttribute{pathattribute.Igp, path(64513)}},
+		{"10.100.221.0/24", []pathattribute.PathAttribute{pathattribute.Egp, path(64513)}},
+		{"10.200.1.0/24", []pathattribute.PathAttribute{pathattribute.Igp, path(64513, 64600)}},
+		{"10.200.2.0/24", []pathattribute.PathAttribute{pathattribute.Igp, path(64513, 64700, 64600)}},
+	} {
+		s := attrSets.intern(r.attrs)
+		ari.install(prefix(r.nw), s)
+		attrSets.release(s)
+	}
+	var notified []string
+	lr.Subscribe(func(nws []ip.Prefix) {
+		for _, nw := range nws {
+			notified = append(notified, nw.Net().String())
+		}
+	})
+	lr.Update(ari)
+	ari.AllUnchanged()
+
+	tests := []struct {
+		nw        string
+		wantAttrs string
+	}{
+		{
+			nw:        "10.100.0.0/16",
+			wantAttrs: "[Egp [] [10 200 100 3] AtomicAggregate Aggregator{as: 64514, ip: 10.200.100.3}]",
+		},
+		{
+			// 集約されるルートに共通する先頭のAS_SEQUENCEは残し、残りのAS番号をAS_SETにまとめる
+			nw:        "10.200.0.0/16",
+			wantAttrs: "[Igp [64513 {64600,64700}] [10 200 100 3] Aggregator{as: 64514, ip: 10.200.100.3}]",
+		},
+	}
+	for _, tt := range tests {
+		es := lr.Lookup(prefix(tt.nw))
+		if len(es) != 1 || es[0].Source() != nil {
+			t.Fatalf("Lookup(%v) = %v, want 1 aggregate route", tt.nw, es)
+		}
+		if s := fmt.Sprint(es[0].PathAttributes()); s != tt.wantAttrs {
+			t.Errorf("PathAttributes() = %v, want %v", s, tt.wantAttrs)
+		}
+		if !slices.Contains(notified, tt.nw) {
+			t.Errorf("notified = %v, want %v", notified, tt.nw)
+		}
+	}
+
+	// Summary-onlyの集約ルートに集約されるルートは広告しない
+	aro := NewAdjRIBOut()
+	aro.Update(lr, c, bgp.IPv4Unicast)
+	var got []string
+	for _, nw := range aro.table(bgp.IPv4Unicast).prefixes() {
+		got = append(got, nw.Net().String())
+	}
+	want := []string{"10.100.0.0/16", "10.200.0.0/16", "10.200.1.0/24", "10.200.2.0/24"}
+	if !slices.Equal(got, want) {
+		t.Errorf("AdjRIBOut prefixes = %v, want %v", got, want)
+	}
+
+	// 集約されるルートがなくなると、集約ルートを取り下げる
+	ari.WithdrawAll()
+	lr.Update(ari)
+	if rts := lr.Routes(); len(rts) != 0 {
+		t.Errorf("Routes() = %v, want none", rts)
+	}
+	aro.Update(lr, c, bgp.IPv4Unicast)
+	if rts := aro.Routes(); len(rts) != 0 {
+		t.Errorf("AdjRIBOut.Routes() = %v, want none", rts)
+	}
+}
+
+// Well-known Communityを持つルートは、対向機器の種類に応じて広告しない
+func TestWellKnownCommunities(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64515})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		community pathattribute.Community
+		remoteAS  bgp.ASNumber
+		opts      []config.Option
+		want      bool
+	}{
+		{name: "other community to eBGP", community: 64515<<16 | 100, remoteAS: 64513, want: true},
+		{name: "no-advertise to iBGP", community: pathattribute.NoAdvertise, remoteAS: 64514, want: false},
+		{name: "no-export to eBGP", community: pathattribute.NoExport, remoteAS: 64513, want: false},
+		{name: "no-export to iBGP", community: pathattribute.NoExport, remoteAS: 64514, want: true},
+		{name: "no-export-subconfed to eBGP", community: pathattribute.NoExportSubconfed, remoteAS: 64513, want: false},
+		{name: "no-peer to eBGP", community: pathattribute.NoPeer, remoteAS: 64513, want: true},
+		{
+			name: "no-peer to bilateral peer", community: pathattribute.NoPeer, remoteAS: 64513,
+			opts: []config.Option{config.WithBilateralPeer(true)}, want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := config.New(64514, "10.200.100.3", tt.remoteAS, "10.200.100.2", config.Passive, nil, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := NewRIBEntry(ipv4nw, []pathattribute.PathAttribute{
+				pathattribute.Igp, ap,
+				pathattribute.NewCommunities([]pathattribute.Community{tt.community}),
+			})
+			e.src = &Source{Address: net.ParseIP("10.0.100.3"), AS: 64515}
+			lr := newLocRIB(64514)
+			lr.Insert(e)
+			aro := NewAdjRIBOut()
+			aro.Update(lr, c, bgp.IPv4Unicast)
+			if got := len(aro.Routes()) == 1; got != tt.want {
+				t.Errorf("advertised = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Large Community, Extended Communityは、AdjRIBIn -> LocRIB -> AdjRIBOutへ引き継がれ、
+// Non-transitiveなExtended CommunityはeBGPの対向機器に送信しない
+func TestCommunitiesCarryThrough(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64515})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := pathattribute.ParseExtendedCommunity("rt:64515:100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := pathattribute.NewLinkBandwidth(64515, 1250000)
+	lc := pathattribute.LargeCommunity{GlobalAdmin: 4200000001, LocalData1: 1, LocalData2: 2}
+	// NEXT_HOPを持たないルートは、カーネルのルーティングテーブルに書き込まれない
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.0.100.3"), AS: 64515})
+	s := attrSets.intern([]pathattribute.PathAttribute{
+		pathattribute.Igp, ap,
+		pathattribute.NewExtendedCommunities([]pathattribute.ExtendedCommunity{rt, lb}),
+		pathattribute.NewLargeCommunities([]pathattribute.LargeCommunity{lc}),
+	})
+	ari.install(ipv4nw, s)
+	attrSets.release(s)
+	lr := newLocRIB(64514)
+	lr.Update(ari)
+
+	es := lr.Lookup(ipv4nw)
+	if len(es) != 1 {
+		t.Fatalf("Lookup() = %v, want 1 route", es)
+	}
+	if !es[0].HasLargeCommunity(lc) || !es[0].HasExtendedCommunity(rt) || es[0].HasCommunity(pathattribute.NoExport) {
+		t.Errorf("communities of %v are not matched", es[0])
+	}
+
+	tests := []struct {
+		name     string
+		remoteAS bgp.ASNumber
+		want     string
+	}{
+		{name: "eBGP", remoteAS: 64513, want: "ExtendedCommunities[rt:64515:100] LargeCommunities[4200000001:1:2]"},
+		{name: "iBGP", remoteAS: 64514, want: "ExtendedCommunities[rt:64515:100 lb:64515:1250000] LargeCommunities[4200000001:1:2]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := config.New(64514, "10.200.100.3", tt.remoteAS, "10.200.100.2", config.Passive, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			aro := NewAdjRIBOut()
+			aro.Update(lr, c, bgp.IPv4Unicast)
+			ums, err := aro.ToUpdateMessage(bgp.IPv4Unicast, c, UpdateOptions{FourOctetAS: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ums) != 1 {
+				t.Fatalf("ToUpdateMessage() = %v, want 1 message", ums)
+			}
+			var got []string
+			for _, pa := range ums[0].PathAttributes() {
+				switch pa.(type) {
+				case pathattribute.ExtendedCommunities, pathattribute.LargeCommunities:
+					got = append(got, fmt.Sprint(pa))
+				}
+			}
+			if s := strings.Join(got, " "); s != tt.want {
+				t.Errorf("communities = %v, want %v", s, tt.want)
+			}
+		})
+	}
+}
+
+// 不正なPathAttributeを含むUPDATE Messageは、RFC 7606に従って処理され、
+// エラーがIncidentとして記録される
+func TestAdjRIBInRevisedErrorHandling(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{64513})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw, _ := net.ParseCIDR("10.100.220.0/24")
+	ipv4nw, err := ip.NewIPv4Net(nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nw6, _ := net.ParseCIDR("2001:db8:1::/48")
+	ipv6nw, err := ip.NewIPv6Net(nw6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reach, err := pathattribute.NewMPReachNLRI(
+		bgp.IPv6Unicast, []net.IP{net.ParseIP("2001:db8::2")}, []ip.Prefix{ipv6nw},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// UPDATE MessageのByte列のi番目をvに書き換えて受信する
+	// ORIGINは24octet目、MP_REACH_NLRIのNext Hopの長さは43octet目である。
+	recv := func(pas []pathattribute.PathAttribute, nlri []*ip.IPv4Net, i int, v byte) *message.UpdateMessage {
+		um, err := message.NewUpdateMsg(pas, nlri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := message.Marshal(um)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			b[i] = v
+		}
+		m, err := message.UnMarshal(b, message.WithFourOctetAS(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.(*message.UpdateMessage)
+	}
+	ipv4 := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		pathattribute.NextHop(net.ParseIP("10.0.100.3").To4()),
+	}
+	ipv6 := []pathattribute.PathAttribute{pathattribute.Igp, ap, reach}
+
+	ari := NewAdjRIBIn(&Source{Address: net.ParseIP("10.200.100.2"), AS: 64513})
+	ari.Update(recv(ipv4, []*ip.IPv4Net{ipv4nw}, 0, 0))
+	ari.Update(recv(ipv6, nil, 0, 0))
+	if rts := ari.Routes(); len(rts) != 2 {
+		t.Fatalf("Routes() = %v, want 2 routes", rts)
+	}
+
+	// 不正なORIGIN(3)は、Treat-as-withdrawとしてIPv4のルートを取り下げる
+	ari.Update(recv(ipv4, []*ip.IPv4Net{ipv4nw}, 26, 3))
+	if rts := ari.RoutesOf(bgp.IPv4Unicast); len(rts) != 0 {
+		t.Errorf("RoutesOf(IPv4 Unicast) = %v, want none", rts)
+	}
+	is := ari.Incidents()
+	if len(is) != 1 || is[0].Err.Action != pathattribute.TreatAsWithdraw ||
+		!slices.Equal(is[0].Err.Attr, []byte{0x40, 0x01, 0x01, 0x03}) {
+		t.Errorf("Incidents() = %v", is)
+	}
+
+	// Next Hopの長さが不正なMP_REACH_NLRIは、AFI/SAFI disableとしてIPv6のルートを取り下げ、
+	// 以降に受信したIPv6のルートも無視する
+	ari.Update(recv(ipv6, nil, 42, 5))
+	if rts := ari.RoutesOf(bgp.IPv6Unicast); len(rts) != 0 || !ari.Disabled(bgp.IPv6Unicast) {
+		t.Errorf("RoutesOf(IPv6 Unicast) = %v, want none", rts)
+	}
+	ari.Update(recv(ipv6, nil, 0, 0))
+	ari.Update(recv(ipv4, []*ip.IPv4Net{ipv4nw}, 0, 0))
+	if rts := ari.RoutesOf(bgp.IPv6Unicast); len(rts) != 0 {
+		t.Errorf("RoutesOf(IPv6 Unicast) = %v, want none", rts)
+	}
+	if rts := ari.RoutesOf(bgp.IPv4Unicast); len(rts) != 1 {
+		t.Errorf("RoutesOf(IPv4 Unicast) = %v, want 1 route", rts)
+	}
+	if is := ari.Incidents(); len(is) != 2 || is[1].Err.Action != pathattribute.AFISAFIDisable ||
+		is[1].Err.Family != bgp.IPv6Unicast {
+		t.Errorf("Incidents() = %v", is)
+	}
+}
@@ -9,10 +9,10 @@ func _() {
 	// Re-run the stringer command to generate them again.
 	var x [1]struct{}
 	_ = x[New-0]
-	_ = x[UnChanged-1]
+	_ = x[Withdrawn-1]
 }
 
-const _Status_name = "NewUnChanged"
+const _Status_name = "NewWithdrawn"
 
 var _Status_index = [...]uint8{0, 3, 12}
 
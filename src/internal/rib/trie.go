@@ -0,0 +1,279 @@
+package rib
+
+import (
+	"github.com/SotaUeda/usbgp/internal/ip"
+)
+
+// Prefixをキーとするパトリシアトライ
+// 1つのトライには同じAFIのPrefixのみを格納する。
+// 挿入、削除、検索はアドレスのビット数(IPv4は32, IPv6は128)に比例する。
+type trie[V any] struct {
+	root *node[V]
+	size int
+}
+
+type node[V any] struct {
+	// Prefix長でマスクしたアドレス
+	key  []byte
+	bits int
+	// 値を持つノードのPrefix
+	// 分岐のためだけのノードはnil
+	prefix ip.Prefix
+	val    V
+	// 次のビットが0, 1の子ノード
+	children [2]*node[V]
+}
+
+func newTrie[V any]() *trie[V] {
+	return &trie[V]{}
+}
+
+// Prefixのキー(マスクしたアドレス)とPrefix長を返す
+func prefixKey(p ip.Prefix) ([]byte, int) {
+	n := p.Net()
+	ones, _ := n.Mask.Size()
+	a := n.IP.To4()
+	if a == nil {
+		a = n.IP.To16()
+	}
+	return maskKey(a, ones), ones
+}
+
+// アドレスの先頭bitsビット以外を0にしたキーを返す
+func maskKey(a []byte, bits int) []byte {
+	k := make([]byte, len(a))
+	copy(k, a)
+	for i := range k {
+		switch {
+		case bits >= (i+1)*8:
+		case bits <= i*8:
+			k[i] = 0
+		default:
+			k[i] &= byte(0xff << (8 - (bits - i*8)))
+		}
+	}
+	return k
+}
+
+// キーのiビット目(0始まり)を返す
+func bitAt(k []byte, i int) int {
+	return int(k[i/8]>>(7-i%8)) & 1
+}
+
+// 2つのキーの先頭から一致するビット数を返す
+// 短い方のPrefix長を超えない。
+func commonBits(a []byte, alen int, b []byte, blen int) int {
+	n := min(alen, blen)
+	for i := 0; i < n; i++ {
+		if bitAt(a, i) != bitAt(b, i) {
+			return i
+		}
+	}
+	return n
+}
+
+func (t *trie[V]) Len() int {
+	return t.size
+}
+
+// Prefixの値を返す
+func (t *trie[V]) Get(p ip.Prefix) (V, bool) {
+	k, bits := prefixKey(p)
+	n := t.root
+	for n != nil {
+		c := commonBits(n.key, n.bits, k, bits)
+		if c < n.bits {
+			break
+		}
+		if n.bits == bits {
+			if n.prefix == nil {
+				break
+			}
+			return n.val, true
+		}
+		n = n.children[bitAt(k, n.bits)]
+	}
+	var zero V
+	return zero, false
+}
+
+// Prefixの値を設定する
+func (t *trie[V]) Put(p ip.Prefix, v V) {
+	k, bits := prefixKey(p)
+	n := t.lookupOrCreate(k, bits)
+	if n.prefix == nil {
+		t.size++
+	}
+	n.prefix = p
+	n.val = v
+}
+
+// キーのノードを返す
+// 存在しない場合は、分岐ノードを含めて作成する。
+func (t *trie[V]) lookupOrCreate(k []byte, bits int) *node[V] {
+	pn := &t.root
+	for {
+		n := *pn
+		if n == nil {
+			*pn = &node[V]{key: k, bits: bits}
+			return *pn
+		}
+		c := commonBits(n.key, n.bits, k, bits)
+		switch {
+		case c == n.bits && c == bits:
+			return n
+		case c == n.bits:
+			// nはキーを含むPrefixであるため、子ノードをたどる
+			pn = &n.children[bitAt(k, c)]
+			continue
+		case c == bits:
+			// キーはnを含むPrefixであるため、nの親にする
+			nn := &node[V]{key: k, bits: bits}
+			nn.children[bitAt(n.key, c)] = n
+			*pn = nn
+			return nn
+		}
+		// キーとnが途中で分岐するため、分岐ノードを作成する
+		g := &node[V]{key: maskKey(k, c), bits: c}
+		nn := &node[V]{key: k, bits: bits}
+		g.children[bitAt(k, c)] = nn
+		g.children[bitAt(n.key, c)] = n
+		*pn = g
+		return nn
+	}
+}
+
+// Prefixの値を削除する
+// 値が存在しない場合はfalseを返す。
+func (t *trie[V]) Delete(p ip.Prefix) bool {
+	k, bits := prefixKey(p)
+	var ok bool
+	t.root, ok = t.root.delete(k, bits)
+	if ok {
+		t.size--
+	}
+	return ok
+}
+
+// キーの値を削除し、置き換えるノードを返す
+func (n *node[V]) delete(k []byte, bits int) (*node[V], bool) {
+	if n == nil {
+		return nil, false
+	}
+	if commonBits(n.key, n.bits, k, bits) < n.bits {
+		return n, false
+	}
+	if n.bits == bits {
+		if n.prefix == nil {
+			return n, false
+		}
+		var zero V
+		n.prefix = nil
+		n.val = zero
+		return n.compact(), true
+	}
+	i := bitAt(k, n.bits)
+	c, ok := n.children[i].delete(k, bits)
+	n.children[i] = c
+	if !ok {
+		return n, false
+	}
+	return n.compact(), true
+}
+
+// 値を持たず、子ノードが1つ以下のノードを取り除く
+func (n *node[V]) compact() *node[V] {
+	if n.prefix != nil {
+		return n
+	}
+	switch {
+	case n.children[0] == nil:
+		return n.children[1]
+	case n.children[1] == nil:
+		return n.children[0]
+	}
+	return n
+}
+
+// すべての値をPrefixの順にたどる
+// fがfalseを返した場合は終了する。
+func (t *trie[V]) Walk(f func(ip.Prefix, V) bool) {
+	t.root.walk(f)
+}
+
+func (n *node[V]) walk(f func(ip.Prefix, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.prefix != nil && !f(n.prefix, n.val) {
+		return false
+	}
+	return n.children[0].walk(f) && n.children[1].walk(f)
+}
+
+// アドレス(a)を含む最も長いPrefixと、その値を返す
+func (t *trie[V]) LongestMatch(a []byte) (ip.Prefix, V, bool) {
+	bits := len(a) * 8
+	var best *node[V]
+	for n := t.root; n != nil; n = n.children[bitAt(a, n.bits)] {
+		if commonBits(n.key, n.bits, a, bits) < n.bits {
+			break
+		}
+		if n.prefix != nil {
+			best = n
+		}
+		if n.bits == bits {
+			break
+		}
+	}
+	if best == nil {
+		var zero V
+		return nil, zero, false
+	}
+	return best.prefix, best.val, true
+}
+
+// Prefixを含む、より短いPrefixの値を短い順にたどる
+// Prefix自身は含まない。
+func (t *trie[V]) WalkLessSpecifics(p ip.Prefix, f func(ip.Prefix, V) bool) {
+	k, bits := prefixKey(p)
+	for n := t.root; n != nil && n.bits < bits; n = n.children[bitAt(k, n.bits)] {
+		if commonBits(n.key, n.bits, k, bits) < n.bits {
+			return
+		}
+		if n.prefix != nil && !f(n.prefix, n.val) {
+			return
+		}
+	}
+}
+
+// Prefixに含まれる、より長いPrefixの値をPrefixの順にたどる
+// Prefix自身は含まない。
+func (t *trie[V]) WalkMoreSpecifics(p ip.Prefix, f func(ip.Prefix, V) bool) {
+	k, bits := prefixKey(p)
+	n := t.root
+	for n != nil {
+		c := commonBits(n.key, n.bits, k, bits)
+		if n.bits >= bits {
+			// nの先頭bitsビットがPrefixと一致する場合、nはPrefixに含まれる
+			if c < bits {
+				return
+			}
+			break
+		}
+		if c < n.bits {
+			return
+		}
+		n = n.children[bitAt(k, n.bits)]
+	}
+	if n == nil {
+		return
+	}
+	if n.bits == bits {
+		if n.children[0].walk(f) {
+			n.children[1].walk(f)
+		}
+		return
+	}
+	n.walk(f)
+}
@@ -0,0 +1,317 @@
+package rib
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/SotaUeda/usbgp/config"
+	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/ip"
+	"github.com/SotaUeda/usbgp/internal/message"
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
+)
+
+// UPDATE Messageのうち、PathAttributeとNLRI以外の長さ
+// Header(19octet) + Withdrawn Routes Length(2octet) + Total Path Attribute Length(2octet)
+const updateOverhead = 19 + 2 + 2
+
+// MP_UNREACH_NLRIのうち、Withdrawn Routes以外の長さ
+// Attribute Flags, Type Code(2octet) + Extended Length(2octet) + AFI(2octet) + SAFI(1octet)
+const mpUnreachOverhead = 2 + 2 + 2 + 1
+
+// UPDATE Messageを生成するときのオプション
+type UpdateOptions struct {
+	// 4-octet AS Number Capabilityをネゴシエーションしたか
+	// falseの場合は、2octetで表現できないAS番号をAS_TRANSに置き換え、AS4_PATHなどを追加する。
+	FourOctetAS bool
+	// UPDATE Messageの最大長(Headerを含む)
+	// 0の場合はmessage.MaxMsgLenとする。
+	MaxMsgLen int
+}
+
+func (o UpdateOptions) maxMsgLen() int {
+	if o.MaxMsgLen == 0 {
+		return message.MaxMsgLen
+	}
+	return o.MaxMsgLen
+}
+
+// 同じPathAttributeで広告するPrefixの集まり
+type updateGroup struct {
+	attrs []pathattribute.PathAttribute
+	nws   []ip.Prefix
+}
+
+// AdjRIBOutのAFI/SAFI(f)の変更があったルートからUpadateMessageを生成する
+// 送信するPathAttributeのバイト列が同じPrefixは、同じUpdateMessageにまとめる。
+// UpdateMessageが最大長(opts.MaxMsgLen)を超える場合は、複数に分割する。
+// 変更があったPrefixのうち、エントリが残っていないPrefixは取り下げる。
+// IPv4 Unicast以外のルートは、NLRIをMP_REACH_NLRIに、
+// 取り下げるルートをMP_UNREACH_NLRIに含める。
+func (ro *AdjRIBOut) ToUpdateMessage(
+	f bgp.Family,
+	c *config.Config,
+	opts UpdateOptions,
+) ([]*message.UpdateMessage, error) {
+	locIP := c.NextHop(f.AFI)
+	if locIP == nil {
+		return nil, fmt.Errorf("next hop is not configured: %v", f)
+	}
+	// 書籍のRustによる実装では、
+	// PathAttributeをKeyに、Vec<IPv4Network>をValueのHashMapを使って、
+	// 同じPathAttributeのNLRIは同じVec<IPv4Network>にまとめている。
+	// 本実装では、送信するPathAttributeのバイト列をKeyにする。
+	// 受信したUPDATE Messageが異なっていても、送信する内容が同じであれば1つにまとめられる。
+	// 送信するPathAttributeは、RIBEntryが共有するattrSetごとに1度だけ生成する。
+	type exportKey struct {
+		s *attrSet
+		// 自身が広告するルートであるか
+		local bool
+	}
+	exported := map[exportKey]string{}
+	groups := map[string]*updateGroup{}
+	// 生成するUpdateMessageの順序を変更があった順にするため、Keyの順序を保持する
+	var keys []string
+	var withdrawn []ip.Prefix
+	r := ro.tables[f]
+	for _, nw := range r.changedPrefixes() {
+		es := r.entries(nw)
+		if len(es) == 0 {
+			withdrawn = append(withdrawn, nw)
+			continue
+		}
+		ek := exportKey{s: es[0].attrs, local: es[0].src == nil}
+		k, ok := exported[ek]
+		if !ok {
+			attrs, err := exportAttrs(f, c, locIP, es[0], opts.FourOctetAS)
+			if err != nil {
+				return nil, err
+			}
+			k, err = attrsKey(attrs)
+			if err != nil {
+				return nil, err
+			}
+			exported[ek] = k
+			if _, ok := groups[k]; !ok {
+				groups[k] = &updateGroup{attrs: attrs}
+				keys = append(keys, k)
+			}
+		}
+		groups[k].nws = append(groups[k].nws, nw)
+	}
+
+	// UpdateMessageを生成する
+	maxLen := opts.maxMsgLen()
+	ums, err := withdrawnUpdateMessages(f, withdrawn, maxLen)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		u, err := reachUpdateMessages(f, groups[k], maxLen)
+		if err != nil {
+			return nil, err
+		}
+		ums = append(ums, u...)
+	}
+	return ums, nil
+}
+
+// 対向機器(c)に送信するPathAttributeを生成する
+// eBGPの対向機器には、NEXT_HOP, MP_REACH_NLRIのNext Hopを自身のアドレス(locIP)に変更し、
+// AS_PATHの先頭に自身のAS番号を追加する。
+// iBGPの対向機器には、AS_PATHを変更せず、自身が広告するルートのみNext Hopを変更する(RFC 4271 5.1.3)。
+// LOCAL_PREFはiBGPの対向機器にのみ送信し(RFC 4271 5.1.5)、
+// 隣接ASから受信したMEDはeBGPの対向機器に送信しない(RFC 4271 5.1.4)。
+// ConfigでMEDが設定されている場合は、その値で置き換える。
+// MP_REACH_NLRIのNLRIは空にし、UpdateMessageを生成するときに設定する。
+// RIBEntryのPathAttributeは変更せず、新しいスライスと値を生成する。
+func exportAttrs(
+	f bgp.Family,
+	c *config.Config,
+	locIP net.IP,
+	e *RIBEntry,
+	fourOctetAS bool,
+) ([]pathattribute.PathAttribute, error) {
+	pas := e.PathAttributes()
+	nextHopSelf := !c.IBGP() || e.Source() == nil
+	attrs := make([]pathattribute.PathAttribute, 0, len(pas))
+	for _, p := range pas {
+		switch p := p.(type) {
+		case pathattribute.NextHop:
+			if !nextHopSelf {
+				attrs = append(attrs, p)
+				continue
+			}
+			n, err := pathattribute.NewNextHop(locIP.To4())
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, n)
+		case pathattribute.MPReachNLRI:
+			if !nextHopSelf {
+				attrs = append(attrs, p.WithNLRI(nil))
+				continue
+			}
+			r, err := pathattribute.NewMPReachNLRI(f, []net.IP{locIP}, nil)
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, r)
+		case pathattribute.LocalPref:
+			if c.IBGP() {
+				attrs = append(attrs, p)
+			}
+		case pathattribute.MultiExitDisc:
+			if _, ok := c.MED(); ok {
+				continue
+			}
+			if c.IBGP() || e.Source() == nil {
+				attrs = append(attrs, p)
+			}
+		case pathattribute.ExtendedCommunities:
+			// Non-transitiveなExtended Communityは、ほかのASに送信しない(RFC 4360)
+			if c.IBGP() {
+				attrs = append(attrs, p)
+				continue
+			}
+			if t := p.Transitive(); len(t.Values()) > 0 {
+				attrs = append(attrs, t)
+			}
+		case pathattribute.ASPath:
+			if c.IBGP() {
+				attrs = append(attrs, p)
+				continue
+			}
+			attrs = append(attrs, p.Prepend(c.LocalAS()))
+		default:
+			attrs = append(attrs, p)
+		}
+	}
+	if m, ok := c.MED(); ok {
+		attrs = append(attrs, pathattribute.MultiExitDisc(m))
+	}
+	// iBGPの対向機器に送信するUPDATE Messageは、LOCAL_PREFを含まなければならない
+	if c.IBGP() && !slices.ContainsFunc(attrs, func(pa pathattribute.PathAttribute) bool {
+		_, ok := pa.(pathattribute.LocalPref)
+		return ok
+	}) {
+		attrs = append(attrs, pathattribute.LocalPref(e.localPref()))
+	}
+	// PathAttributeはAttribute Type Codeの昇順に並べる(RFC 4271 5章)
+	slices.SortStableFunc(attrs, func(a, b pathattribute.PathAttribute) int {
+		return int(a.Type()) - int(b.Type())
+	})
+	if !fourOctetAS {
+		attrs = pathattribute.ToTwoOctetAS(attrs)
+	}
+	return attrs, nil
+}
+
+// 同じPathAttributeのPrefixを広告するUpdateMessageを生成する
+// 最大長(maxLen)に収まるように、NLRIを複数のUpdateMessageに分割する。
+func reachUpdateMessages(f bgp.Family, g *updateGroup, maxLen int) ([]*message.UpdateMessage, error) {
+	budget := maxLen - updateOverhead
+	for _, pa := range g.attrs {
+		budget -= int(pa.BytesLen())
+	}
+	if f != bgp.IPv4Unicast {
+		// NLRIを追加するとMP_REACH_NLRIのAttribute Lengthが2octetになることがある
+		budget--
+	}
+	chunks, err := chunkPrefixes(g.nws, budget)
+	if err != nil {
+		return nil, err
+	}
+	ums := make([]*message.UpdateMessage, 0, len(chunks))
+	for _, nws := range chunks {
+		attrs := g.attrs
+		// IPv4 UnicastのNLRIのみ、UPDATE MessageのNLRIに含める
+		var nlri []*ip.IPv4Net
+		if f == bgp.IPv4Unicast {
+			for _, nw := range nws {
+				nlri = append(nlri, nw.(*ip.IPv4Net))
+			}
+		} else {
+			attrs = make([]pathattribute.PathAttribute, len(g.attrs))
+			for i, pa := range g.attrs {
+				if r, ok := pa.(pathattribute.MPReachNLRI); ok {
+					pa = r.WithNLRI(nws)
+				}
+				attrs[i] = pa
+			}
+		}
+		um, err := message.NewUpdateMsg(attrs, nlri, nil)
+		if err != nil {
+			return nil, err
+		}
+		ums = append(ums, um)
+	}
+	return ums, nil
+}
+
+// 取り下げるルートのUpdateMessageを生成する
+// 最大長(maxLen)に収まるように、複数のUpdateMessageに分割する。
+// 取り下げるルートがない場合はnilを返す。
+func withdrawnUpdateMessages(f bgp.Family, wr []ip.Prefix, maxLen int) ([]*message.UpdateMessage, error) {
+	if len(wr) == 0 {
+		return nil, nil
+	}
+	budget := maxLen - updateOverhead
+	if f != bgp.IPv4Unicast {
+		budget -= mpUnreachOverhead
+	}
+	chunks, err := chunkPrefixes(wr, budget)
+	if err != nil {
+		return nil, err
+	}
+	ums := make([]*message.UpdateMessage, 0, len(chunks))
+	for _, ws := range chunks {
+		um, err := withdrawnUpdateMessage(f, ws)
+		if err != nil {
+			return nil, err
+		}
+		ums = append(ums, um)
+	}
+	return ums, nil
+}
+
+func withdrawnUpdateMessage(f bgp.Family, wr []ip.Prefix) (*message.UpdateMessage, error) {
+	if f != bgp.IPv4Unicast {
+		u, err := pathattribute.NewMPUnreachNLRI(f, wr)
+		if err != nil {
+			return nil, err
+		}
+		return message.NewUpdateMsg([]pathattribute.PathAttribute{u}, nil, nil)
+	}
+	var v4wr []*ip.IPv4Net
+	for _, w := range wr {
+		v4wr = append(v4wr, w.(*ip.IPv4Net))
+	}
+	return message.NewUpdateMsg(nil, nil, v4wr)
+}
+
+// Prefixのリストを、バイト列の合計がbudget以下になるように分割する
+func chunkPrefixes(nws []ip.Prefix, budget int) ([][]ip.Prefix, error) {
+	var (
+		chunks [][]ip.Prefix
+		cur    []ip.Prefix
+		l      int
+	)
+	for _, nw := range nws {
+		nl := int(nw.Len())
+		if nl > budget {
+			return nil, fmt.Errorf("UPDATE Messageの最大長を超えています: %v", nw)
+		}
+		if l+nl > budget {
+			chunks = append(chunks, cur)
+			cur, l = nil, 0
+		}
+		cur = append(cur, nw)
+		l += nl
+	}
+	if len(cur) > 0 {
+		chunks = append(chunks, cur)
+	}
+	return chunks, nil
+}
@@ -3,24 +3,26 @@ package test
 import (
 	"bytes"
 	"net"
+	"slices"
 	"testing"
 
 	"github.com/SotaUeda/usbgp/internal/ip"
 	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
 )
 
-func RouteEqual(r1, r2 []*ip.IPv4Net, t *testing.T) bool {
+func RouteEqual[P ip.Prefix](r1, r2 []P, t *testing.T) bool {
 	if len(r1) != len(r2) {
 		t.Errorf("len(r1) = %d, len(r2) = %d", len(r1), len(r2))
 		return false
 	}
-	for i, n1 := range r1 {
-		if !n1.IP.Equal(r2[i].IP) {
-			t.Errorf("r1[%d].IP = %v, r2[%d].IP = %v", i, n1.IP, i, r2[i].IP)
+	for i, p1 := range r1 {
+		n1, n2 := p1.Net(), r2[i].Net()
+		if !n1.IP.Equal(n2.IP) {
+			t.Errorf("r1[%d].IP = %v, r2[%d].IP = %v", i, n1.IP, i, n2.IP)
 			return false
 		}
-		if !bytes.Equal(n1.Mask, r2[i].Mask) {
-			t.Errorf("r1[%d].Mask = %v, r2[%d].Mask = %v", i, n1.Mask, i, r2[i].Mask)
+		if !bytes.Equal(n1.Mask, n2.Mask) {
+			t.Errorf("r1[%d].Mask = %v, r2[%d].Mask = %v", i, n1.Mask, i, n2.Mask)
 			return false
 		}
 	}
@@ -59,6 +61,12 @@ func PathAttrEqual(pa1, pa2 pathattribute.PathAttribute, t *testing.T) bool {
 			return false
 		}
 		return true
+	case pathattribute.MultiExitDisc, pathattribute.LocalPref, pathattribute.AtomicAggregate:
+		if pa1 != pa2 {
+			t.Errorf("pa1 = %v, pa2 = %v", pa1, pa2)
+			return false
+		}
+		return true
 	case pathattribute.NextHop:
 		nh1 := pa1.(pathattribute.NextHop)
 		nh2 := pa2.(pathattribute.NextHop)
@@ -67,48 +75,85 @@ func PathAttrEqual(pa1, pa2 pathattribute.PathAttribute, t *testing.T) bool {
 			return false
 		}
 		return true
+	case pathattribute.Aggregator:
+		ag1 := pa1.(pathattribute.Aggregator)
+		ag2, ok := pa2.(pathattribute.Aggregator)
+		if !ok || ag1.AS() != ag2.AS() || !ag1.IP().Equal(ag2.IP()) {
+			t.Errorf("pa1 = %v, pa2 = %v", pa1, pa2)
+			return false
+		}
+		return true
+	case pathattribute.Communities:
+		cs1 := pa1.(pathattribute.Communities)
+		cs2, ok := pa2.(pathattribute.Communities)
+		if !ok || !slices.Equal(cs1.Values(), cs2.Values()) {
+			t.Errorf("pa1 = %v, pa2 = %v", pa1, pa2)
+			return false
+		}
+		return true
+	case pathattribute.LargeCommunities:
+		cs1 := pa1.(pathattribute.LargeCommunities)
+		cs2, ok := pa2.(pathattribute.LargeCommunities)
+		if !ok || !slices.Equal(cs1.Values(), cs2.Values()) {
+			t.Errorf("pa1 = %v, pa2 = %v", pa1, pa2)
+			return false
+		}
+		return true
+	case pathattribute.ExtendedCommunities:
+		cs1 := pa1.(pathattribute.ExtendedCommunities)
+		cs2, ok := pa2.(pathattribute.ExtendedCommunities)
+		if !ok || !slices.Equal(cs1.Values(), cs2.Values()) {
+			t.Errorf("pa1 = %v, pa2 = %v", pa1, pa2)
+			return false
+		}
+		return true
+	case pathattribute.MPReachNLRI:
+		r1 := pa1.(pathattribute.MPReachNLRI)
+		r2, ok := pa2.(pathattribute.MPReachNLRI)
+		if !ok || r1.Family() != r2.Family() ||
+			!slices.EqualFunc(r1.NextHops(), r2.NextHops(), net.IP.Equal) {
+			t.Errorf("pa1 = %v, pa2 = %v", pa1, pa2)
+			return false
+		}
+		return RouteEqual(r1.NLRI(), r2.NLRI(), t)
+	case pathattribute.MPUnreachNLRI:
+		u1 := pa1.(pathattribute.MPUnreachNLRI)
+		u2, ok := pa2.(pathattribute.MPUnreachNLRI)
+		if !ok || u1.Family() != u2.Family() {
+			t.Errorf("pa1 = %v, pa2 = %v", pa1, pa2)
+			return false
+		}
+		return RouteEqual(u1.Withdrawn(), u2.Withdrawn(), t)
 	case pathattribute.DontKnow:
-		_, ok := pa2.(pathattribute.DontKnow)
-		if !ok {
+		d1 := pa1.(pathattribute.DontKnow)
+		d2, ok := pa2.(pathattribute.DontKnow)
+		if !ok || d1.Flags() != d2.Flags() || d1.Type() != d2.Type() ||
+			!slices.Equal(d1.Value(), d2.Value()) {
 			t.Errorf("pa1 = %v, pa2 = %v", pa1, pa2)
+			return false
 		}
-		return ok
+		return true
 	}
 	t.Errorf("invalid PathAttribute type: %v", pa1)
 	return false
 }
 
 func ASPathEqual(ap1, ap2 pathattribute.ASPath, t *testing.T) bool {
-	if ap1.SegType() != ap2.SegType() {
-		t.Errorf("ap1.SegType() = %d, ap2.SegType() = %d", ap1.SegType(), ap2.SegType())
+	segs1, segs2 := ap1.Segments(), ap2.Segments()
+	if len(segs1) != len(segs2) {
+		t.Errorf("len(segs1) = %d, len(segs2) = %d", len(segs1), len(segs2))
 		return false
 	}
-	if ap1.SegLen() != ap2.SegLen() {
-		t.Errorf("ap1.SegLen() = %d, ap2.SegLen() = %d", ap1.SegLen(), ap2.SegLen())
-		return false
-	}
-	switch ap1.(type) {
-	case pathattribute.ASSequence:
-		seq1 := ap1.(pathattribute.ASSequence)
-		seq2 := ap2.(pathattribute.ASSequence)
-		for i, as1 := range seq1 {
-			if as1 != seq2[i] {
-				t.Errorf("seq1[%d] = %v, seq2[%d] = %v", i, as1, i, seq2[i])
-				return false
-			}
+	for i, s1 := range segs1 {
+		s2 := segs2[i]
+		if s1.Type() != s2.Type() {
+			t.Errorf("segs1[%d].Type() = %v, segs2[%d].Type() = %v", i, s1.Type(), i, s2.Type())
+			return false
 		}
-		return true
-	case pathattribute.ASSet:
-		set1 := ap1.(pathattribute.ASSet)
-		set2 := ap2.(pathattribute.ASSet)
-		for as1 := range set1 {
-			_, ok := set2[as1]
-			if !ok {
-				t.Errorf("set1 = %v, set2 = %v", set1, set2)
-			}
-			return ok
+		if !slices.Equal(s1.ASNumbers(), s2.ASNumbers()) {
+			t.Errorf("segs1[%d] = %v, segs2[%d] = %v", i, s1, i, s2)
+			return false
 		}
 	}
-	t.Errorf("invalid ASPath type: %v", ap1)
-	return false
+	return true
 }
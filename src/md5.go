@@ -0,0 +1,44 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCP MD5 Signature Option(RFC 2385)を設定する
+// 対向機器のアドレス(raddr)とのTCPセグメントに、パスワード(key)から計算したMD5ダイジェストを付加し、
+// 対向機器から受信したTCPセグメントのダイジェストを検証する。
+func setTCPMD5Sig(fd uintptr, raddr net.IP, key string) error {
+	if len(key) > unix.TCP_MD5SIG_MAXKEYLEN {
+		return fmt.Errorf("password is too long: %d", len(key))
+	}
+	sig := unix.TCPMD5Sig{Keylen: uint16(len(key))}
+	copy(sig.Key[:], key)
+	// sockaddr_in, sockaddr_in6のFamily以降(Port, Flow Info)を除いた位置にアドレスを格納する
+	if ip4 := raddr.To4(); ip4 != nil {
+		sig.Addr.Family = unix.AF_INET
+		copy(sig.Addr.Data[2:6], ip4)
+	} else {
+		sig.Addr.Family = unix.AF_INET6
+		copy(sig.Addr.Data[6:22], raddr.To16())
+	}
+	return unix.SetsockoptTCPMD5Sig(int(fd), unix.IPPROTO_TCP, unix.TCP_MD5SIG, &sig)
+}
+
+// 接続前のSocketにTCP MD5 Signature Optionを設定する関数を返す
+// net.Dialer, net.ListenConfigのControlとして使用する。
+func md5Control(raddr net.IP, key string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = setTCPMD5Sig(fd, raddr, key)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
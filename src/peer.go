@@ -2,13 +2,20 @@ package peer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/SotaUeda/usbgp/config"
+	"github.com/SotaUeda/usbgp/internal/bgp"
 	"github.com/SotaUeda/usbgp/internal/event"
+	"github.com/SotaUeda/usbgp/internal/ip"
 	"github.com/SotaUeda/usbgp/internal/message"
+	"github.com/SotaUeda/usbgp/internal/message/capability"
 	"github.com/SotaUeda/usbgp/internal/rib"
 )
 
@@ -18,6 +25,7 @@ type State int
 const (
 	Idle State = iota
 	Connect
+	Active
 	OpenSent
 	OpenConfirm
 	Established
@@ -30,193 +38,998 @@ const (
 type Peer struct {
 	State      State
 	eventQueue chan event.Event
-	msgQueue   chan message.Message // OpenMessageを扱うために使用
 	*conn
 	config *config.Config
 	lrib   *rib.LocRIB
 	ribout *rib.AdjRIBOut
 	ribin  *rib.AdjRIBIn
-}
+	// LocRIBで変更され、AdjRIBOutに反映していないPrefix
+	// ほかのPeerのgoroutineから追加されるため、Lockを取得して操作する。
+	pendingMu sync.Mutex
+	pending   []ip.Prefix
 
-// メッセージの送受信を行うためのChannel
-var (
+	// メッセージの送受信を行うためのChannel
 	send chan message.Message
 	recv chan message.Message
 	ech  chan error
-)
+	// TCP Connectionの確立結果を受け取るためのChannel
+	tcp chan tcpResult
+	// TCP Connectionの確立、メッセージの送受信を行うgoroutineのContext
+	connCtx    context.Context
+	cancelConn context.CancelFunc
+
+	// 処理中のEventの契機となった受信Message
+	rcvd message.Message
+	// 処理中のEventの契機となった受信エラー
+	rcvdErr message.ConvMsgErr
+
+	connectRetryCounter int
+
+	// Maximum Prefixの警告を出力済みであるか
+	// 受信したPrefix数が閾値、またはLimitを下回るまで同じ警告を出力しないようにする。
+	maxPrefixWarned   bool
+	maxPrefixExceeded bool
+
+	// ネゴシエーションしたCapability
+	// 自身と対向機器の両方が広告した場合に有効となる。
+	caps capability.Set
+
+	// ネゴシエーションしたHold Time, Keepaliveの間隔
+	holdTime          time.Duration
+	keepaliveTime     time.Duration
+	connectRetryTimer *timer
+	holdTimer         *timer
+	keepaliveTimer    *timer
+	delayOpenTimer    *timer
+	idleHoldTimer     *timer
+}
 
 func New(c *config.Config, lrib *rib.LocRIB) *Peer {
-	return &Peer{
+	p := &Peer{
 		// Stateはnil
 		eventQueue: make(chan event.Event),
-		msgQueue:   make(chan message.Message),
 		conn:       nil,
 		config:     c,
 		lrib:       lrib,
 		ribout:     rib.NewAdjRIBOut(),
-		ribin:      rib.NewAdjRIBIn(),
+		ribin:      rib.NewAdjRIBIn(newSource(c, nil)),
+
+		send: make(chan message.Message),
+		recv: make(chan message.Message),
+		ech:  make(chan error),
+		tcp:  make(chan tcpResult),
+
+		connectRetryTimer: &timer{ev: event.ConnectRetryTimerExpires},
+		holdTimer:         &timer{ev: event.HoldTimerExpires},
+		keepaliveTimer:    &timer{ev: event.KeepaliveTimerExpires},
+		delayOpenTimer:    &timer{ev: event.DelayOpenTimerExpires},
+		idleHoldTimer:     &timer{ev: event.IdleHoldTimerExpires},
 	}
+	// ほかのPeerから受信したルートによってLocRIBが変更された場合も、
+	// 変更されたPrefixのAdjRIBOutを更新する
+	if lrib != nil {
+		lrib.Subscribe(func(nws []ip.Prefix) {
+			p.pendingMu.Lock()
+			p.pending = append(p.pending, nws...)
+			p.pendingMu.Unlock()
+			p.evEnqueue(event.LocRIBChanged)
+		})
+	}
+	return p
 }
 
+// LocRIBで変更されたPrefixを取り出す
+func (p *Peer) takePending() []ip.Prefix {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	nws := p.pending
+	p.pending = nil
+	return nws
+}
+
+// Peerを開始する
+// Passive Modeの場合は、対向機器からの接続を待ち受ける。
 func (p *Peer) Start() {
 	log.Println("peer is started.")
 	p.State = Idle
+	if p.config.Mode() == config.Passive {
+		p.evEnqueue(event.ManualStartWithPassiveTCPEstablishment)
+		return
+	}
 	p.evEnqueue(event.ManualStart)
 }
 
+// Peerを停止する
+func (p *Peer) Stop() {
+	log.Println("peer is stopped.")
+	p.evEnqueue(event.ManualStop)
+}
+
+// 対向機器にAdjRIBOutの再送を要求する
+// Established以外のStateでは無視される。
+func (p *Peer) RouteRefresh() {
+	p.evEnqueue(event.ManualRouteRefresh)
+}
+
 func (p *Peer) Next(ctx context.Context, wg *sync.WaitGroup) error {
 	defer wg.Done()
 	select {
 	case <-ctx.Done():
 		log.Println("Peer Next is done.")
-		return p.Idle()
+		return p.handleEvent(ctx, event.ManualStop)
 	case ev := <-p.eventQueue:
 		log.Printf("event is occured, event=%v.\n", ev)
 		if err := p.handleEvent(ctx, ev); err != nil {
 			return err
 		}
 		return nil
-	case r := <-recv:
-		if err := p.handleMessage(r); err != nil {
+	case r := <-p.tcp:
+		return p.handleTCP(ctx, r)
+	case r := <-p.recv:
+		if err := p.handleMessage(ctx, r); err != nil {
 			return err
 		}
 		return nil
-	case e := <-ech:
+	case e := <-p.ech:
 		log.Printf("send/recv error occured: %v\n", e)
-		return nil
+		return p.handleError(ctx, e)
 	}
 }
 
+// TCP Connectionを閉じ、すべてのタイマーを停止してIdleに遷移する
+// RFC内の"drops the TCP connection"と"releases all BGP resources"に相当する。
 func (p *Peer) Idle() error {
-	if p.conn != nil {
-		if err := p.conn.Close(); err != nil {
-			return err
-		}
+	p.connectRetryTimer.stop()
+	p.holdTimer.stop()
+	p.keepaliveTimer.stop()
+	p.delayOpenTimer.stop()
+	p.idleHoldTimer.stop()
+	p.dropTCP()
+	if p.State == Established {
+		p.flushRoutes()
 	}
+	p.caps = nil
 	p.State = Idle
 	return nil
 }
 
+// セッションがEstablishedから離れたときに、このPeerから学習したルートを削除する
+// AdjRIBInのルートを取り下げてLocRIBに反映し、カーネルのルーティングテーブルから削除する。
+// LocRIBの変更によって、ほかのPeerにはLocRIBChanged Eventが発生し、取り下げが送信される。
+// AdjRIBOutは、保持しているルートの参照を解放した後、
+// 次のセッションで改めてすべてのルートを送信するために作り直す。
+func (p *Peer) flushRoutes() {
+	p.ribin.WithdrawAll()
+	if p.lrib != nil {
+		p.lrib.Update(p.ribin)
+	}
+	p.ribin = rib.NewAdjRIBIn(newSource(p.config, nil))
+	p.ribout.WithdrawAll()
+	p.ribout = rib.NewAdjRIBOut()
+}
+
+// AdjRIBInのルートを受信するPeerの情報を生成する
+// BGP Identifier(id)は、OPEN Messageを受信するまでnilとする。
+func newSource(c *config.Config, id net.IP) *rib.Source {
+	s := &rib.Source{
+		Address:  c.RemoteIP(),
+		RouterID: id,
+		AS:       c.RemoteAS(),
+		IBGP:     c.IBGP(),
+	}
+	if lp, ok := c.LocalPref(); ok {
+		s.LocalPref = &lp
+	}
+	return s
+}
+
+// エラーによってIdleに遷移する
+// ConnectRetryCounterを加算し、IdleHoldTimeが設定されている場合は、
+// IdleHoldTimerの満了後に自動的にPeerを再開する。
+func (p *Peer) fail() error {
+	p.connectRetryCounter++
+	if err := p.Idle(); err != nil {
+		return err
+	}
+	ih := time.Duration(p.config.IdleHoldTime()) * time.Second
+	p.idleHoldTimer.start(p, ih)
+	return nil
+}
+
+// NOTIFICATION Messageを送信してから、エラーによってIdleに遷移する
+func (p *Peer) notifyAndFail(
+	code message.ErrorCode,
+	subcode message.ErrorSubcode,
+	data []byte,
+) error {
+	p.notify(code, subcode, data)
+	return p.fail()
+}
+
+// ManualStop / AutomaticStopによってIdleに遷移する
+// Established以前のOPEN Messageを送信済みのStateでは、Ceaseを送信する。
+func (p *Peer) stop(ev event.Event) error {
+	switch p.State {
+	case OpenSent, OpenConfirm, Established:
+		p.notify(message.Cease, message.AdministrativeShutdown, nil)
+	}
+	if ev == event.ManualStop {
+		p.connectRetryCounter = 0
+		return p.Idle()
+	}
+	p.connectRetryCounter++
+	return p.Idle()
+}
+
 func (p *Peer) evEnqueue(ev event.Event) {
 	go func() { p.eventQueue <- ev }()
 }
 
-func (p *Peer) msgEnqueue(m message.Message) {
-	go func() { p.msgQueue <- m }()
+// TCP Connectionの確立を開始する
+// 確立した場合、Peer.Nextでtcp Channelから結果を受け取る。
+func (p *Peer) initiateTCP(ctx context.Context) {
+	if p.cancelConn != nil {
+		p.cancelConn()
+	}
+	p.connCtx, p.cancelConn = context.WithCancel(ctx)
+	connect(p.connCtx, p.config, p.tcp, func(net.Addr) {
+		p.evEnqueue(event.TCPCRInvalid)
+	})
+}
+
+// TCP Connectionの確立結果を処理する
+func (p *Peer) handleTCP(ctx context.Context, r tcpResult) error {
+	if r.err != nil {
+		// 中断したTCP Connectionの確立は無視する
+		if errors.Is(r.err, context.Canceled) {
+			return nil
+		}
+		log.Printf("connection error: %v", r.err)
+		return p.handleEvent(ctx, event.TCPConnectionFails)
+	}
+	// すでにTCP Connectionが確立している場合、
+	// またはTCP Connectionを待っていない場合は、新しいTCP Connectionを閉じる
+	if p.conn != nil || (p.State != Connect && p.State != Active) {
+		log.Printf("close unexpected connection: %v", r.c.RemoteAddr())
+		return r.c.Close()
+	}
+	p.conn = r.c
+	// 送受信のgoroutineを起動
+	p.conn.sendMsg(p.connCtx, p.send, p.ech)
+	p.conn.recvMsg(p.connCtx, p.recv, p.ech)
+	if r.passive {
+		return p.handleEvent(ctx, event.TCPConnectionConfirmed)
+	}
+	return p.handleEvent(ctx, event.TCPCRAcked)
+}
+
+// タイマーのEventに対応するタイマーを返す
+func (p *Peer) timerOf(ev event.Event) *timer {
+	switch ev {
+	case event.ConnectRetryTimerExpires:
+		return p.connectRetryTimer
+	case event.HoldTimerExpires:
+		return p.holdTimer
+	case event.KeepaliveTimerExpires:
+		return p.keepaliveTimer
+	case event.DelayOpenTimerExpires:
+		return p.delayOpenTimer
+	case event.IdleHoldTimerExpires:
+		return p.idleHoldTimer
+	}
+	return nil
 }
 
 func (p *Peer) handleEvent(ctx context.Context, ev event.Event) error {
+	// 停止済みのタイマーのEventは無視する
+	if t := p.timerOf(ev); t != nil {
+		if !t.running() {
+			return nil
+		}
+		t.expire()
+	}
 	switch p.State {
 	case Idle:
-		if ev == event.ManualStart {
-			var err error
-			p.conn, err = newConnection(ctx, p.config)
-			if err != nil {
-				return fmt.Errorf("connection error: %v", err)
-			}
-			if p.conn == nil {
-				return fmt.Errorf("TCP Connectionが確立されていません")
-			}
-			ech = make(chan error)
-			send = make(chan message.Message)
-			recv = make(chan message.Message)
-			// // 送受信のgoroutineを起動
-			// // ここが原因？
-			// p.sendMsg(ctx, send, ech)
-			// p.recvMsg(ctx, recv, ech)
-			p.State = Connect
-			p.evEnqueue(event.TCPConnectionConfirmed)
-		}
+		return p.handleIdle(ctx, ev)
 	case Connect:
-		if ev == event.TCPConnectionConfirmed {
-			if p.conn == nil {
-				return fmt.Errorf("TCP Conectionが確立されていません")
-			}
-			om, err := message.NewOpenMsg(
-				p.config.LocalAS(),
-				p.config.LocalIP(),
-			)
-			if err != nil {
-				return err
-			}
-			// 送受信のgoroutineを起動
-			// ここに移動すると成功する。
-			p.sendMsg(ctx, send, ech)
-			p.recvMsg(ctx, recv, ech)
-			send <- om
-			p.State = OpenSent
-		}
+		return p.handleConnect(ctx, ev)
+	case Active:
+		return p.handleActive(ctx, ev)
 	case OpenSent:
-		if ev == event.BGPOpen {
-			if p.conn == nil {
-				return fmt.Errorf("TCP Connectionが確立されていません")
-			}
-			km, err := message.NewKeepaliveMsg()
-			if err != nil {
-				return err
-			}
-			send <- km
-			p.State = OpenConfirm
-		}
+		return p.handleOpenSent(ctx, ev)
 	case OpenConfirm:
-		if ev == event.KeepAliveMsg {
-			p.evEnqueue(event.Established)
-			p.State = Established
+		return p.handleOpenConfirm(ctx, ev)
+	case Established:
+		return p.handleEstablished(ctx, ev)
+	}
+	return nil
+}
+
+// RFC 4271 8.2.2 Idle State
+func (p *Peer) handleIdle(ctx context.Context, ev event.Event) error {
+	switch ev {
+	case event.ManualStart, event.AutomaticStart,
+		event.AutomaticStartWithDampPeerOscillations:
+		p.connectRetryCounter = 0
+		p.connectRetryTimer.start(p, p.connectRetryTime())
+		p.initiateTCP(ctx)
+		p.State = Connect
+	case event.ManualStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment:
+		p.connectRetryCounter = 0
+		p.connectRetryTimer.start(p, p.connectRetryTime())
+		p.initiateTCP(ctx)
+		p.State = Active
+	case event.ManualStop, event.AutomaticStop:
+		// 自動的に再開しないようにする
+		p.idleHoldTimer.stop()
+	case event.IdleHoldTimerExpires:
+		// エラーによってIdleに遷移したPeerを自動的に再開する
+		if p.config.Mode() == config.Passive {
+			return p.handleIdle(ctx, event.AutomaticStartWithPassiveTCPEstablishment)
+		}
+		return p.handleIdle(ctx, event.AutomaticStart)
+	}
+	// その他のEventではStateは変わらない
+	return nil
+}
+
+// RFC 4271 8.2.2 Connect State
+func (p *Peer) handleConnect(ctx context.Context, ev event.Event) error {
+	switch ev {
+	case event.ManualStart, event.AutomaticStart,
+		event.ManualStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithDampPeerOscillations,
+		event.AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment,
+		event.TCPConnectionValid, event.TCPCRInvalid:
+		// 無視する
+	case event.ManualStop:
+		return p.stop(ev)
+	case event.ConnectRetryTimerExpires:
+		p.delayOpenTimer.stop()
+		p.dropTCP()
+		p.connectRetryTimer.start(p, p.connectRetryTime())
+		p.initiateTCP(ctx)
+	case event.DelayOpenTimerExpires:
+		return p.sendOpen()
+	case event.TCPCRAcked, event.TCPConnectionConfirmed:
+		p.connectRetryTimer.stop()
+		if p.config.DelayOpenTime() != 0 {
+			p.delayOpenTimer.start(p, p.delayOpenTime())
+			return nil
+		}
+		return p.sendOpen()
+	case event.TCPConnectionFails:
+		if p.delayOpenTimer.running() {
+			p.delayOpenTimer.stop()
+			p.dropTCP()
+			p.connectRetryTimer.start(p, p.connectRetryTime())
+			p.initiateTCP(ctx)
+			p.State = Active
+			return nil
+		}
+		return p.fail()
+	case event.BGPOpenWithDelayOpenTimerRunning:
+		return p.recvOpenWithDelayOpen()
+	case event.BGPHeaderErr, event.BGPOpenMsgErr:
+		return p.notifyAndFail(p.rcvdErr.Code, p.rcvdErr.Subcode, p.rcvdErr.Data)
+	case event.NotifMsgVerErr:
+		return p.Idle()
+	case event.Established, event.LocRIBChanged,
+		event.AdjRIBOutChanged, event.AdjRIBInChanged,
+		event.ManualRouteRefresh:
+		// Idleに遷移する前に発行された独自のEventは無視する
+	default:
+		return p.fail()
+	}
+	return nil
+}
+
+// RFC 4271 8.2.2 Active State
+func (p *Peer) handleActive(ctx context.Context, ev event.Event) error {
+	switch ev {
+	case event.ManualStart, event.AutomaticStart,
+		event.ManualStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithDampPeerOscillations,
+		event.AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment,
+		event.TCPConnectionValid, event.TCPCRInvalid:
+		// 無視する
+	case event.ManualStop:
+		return p.stop(ev)
+	case event.ConnectRetryTimerExpires:
+		p.connectRetryTimer.start(p, p.connectRetryTime())
+		// Passive Modeでは自身から接続せず、待ち受けを続ける
+		if p.config.Mode() == config.Passive {
+			return nil
+		}
+		p.initiateTCP(ctx)
+		p.State = Connect
+	case event.DelayOpenTimerExpires:
+		p.connectRetryTimer.stop()
+		return p.sendOpen()
+	case event.TCPCRAcked, event.TCPConnectionConfirmed:
+		p.connectRetryTimer.stop()
+		if p.config.DelayOpenTime() != 0 {
+			p.delayOpenTimer.start(p, p.delayOpenTime())
+			return nil
 		}
+		return p.sendOpen()
+	case event.TCPConnectionFails:
+		return p.fail()
+	case event.BGPOpenWithDelayOpenTimerRunning:
+		return p.recvOpenWithDelayOpen()
+	case event.BGPHeaderErr, event.BGPOpenMsgErr:
+		return p.notifyAndFail(p.rcvdErr.Code, p.rcvdErr.Subcode, p.rcvdErr.Data)
+	case event.NotifMsgVerErr:
+		return p.Idle()
+	case event.Established, event.LocRIBChanged,
+		event.AdjRIBOutChanged, event.AdjRIBInChanged,
+		event.ManualRouteRefresh:
+		// Idleに遷移する前に発行された独自のEventは無視する
+	default:
+		return p.fail()
+	}
+	return nil
+}
+
+// RFC 4271 8.2.2 OpenSent State
+func (p *Peer) handleOpenSent(ctx context.Context, ev event.Event) error {
+	switch ev {
+	case event.ManualStart, event.AutomaticStart,
+		event.ManualStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithDampPeerOscillations,
+		event.AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment,
+		event.TCPConnectionValid, event.TCPCRInvalid,
+		event.TCPCRAcked, event.TCPConnectionConfirmed:
+		// 2つ目のTCP Connectionは使用しないため無視する
+	case event.ManualStop, event.AutomaticStop:
+		return p.stop(ev)
+	case event.HoldTimerExpires:
+		return p.notifyAndFail(message.HoldTimerExpired, message.Unspecific, nil)
+	case event.TCPConnectionFails:
+		p.dropTCP()
+		p.connectRetryTimer.start(p, p.connectRetryTime())
+		p.initiateTCP(ctx)
+		p.State = Active
+	case event.BGPOpen:
+		p.delayOpenTimer.stop()
+		p.connectRetryTimer.stop()
+		if err := p.recvOpen(); err != nil {
+			return err
+		}
+		p.State = OpenConfirm
+	case event.BGPHeaderErr, event.BGPOpenMsgErr:
+		return p.notifyAndFail(p.rcvdErr.Code, p.rcvdErr.Subcode, p.rcvdErr.Data)
+	case event.OpenCollisionDump:
+		return p.notifyAndFail(message.Cease, message.ConnectionCollisionResolution, nil)
+	case event.NotifMsgVerErr:
+		return p.Idle()
+	case event.Established, event.LocRIBChanged,
+		event.AdjRIBOutChanged, event.AdjRIBInChanged,
+		event.ManualRouteRefresh:
+		// Idleに遷移する前に発行された独自のEventは無視する
+	default:
+		return p.notifyAndFail(message.FSMError, fsmErrSubcode(ev, OpenSent), nil)
+	}
+	return nil
+}
+
+// RFC 4271 8.2.2 OpenConfirm State
+func (p *Peer) handleOpenConfirm(ctx context.Context, ev event.Event) error {
+	switch ev {
+	case event.ManualStart, event.AutomaticStart,
+		event.ManualStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithDampPeerOscillations,
+		event.AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment,
+		event.TCPConnectionValid, event.TCPCRInvalid,
+		event.TCPCRAcked, event.TCPConnectionConfirmed:
+		// 2つ目のTCP Connectionは使用しないため無視する
+	case event.ManualStop, event.AutomaticStop:
+		return p.stop(ev)
+	case event.HoldTimerExpires:
+		return p.notifyAndFail(message.HoldTimerExpired, message.Unspecific, nil)
+	case event.KeepaliveTimerExpires:
+		return p.sendKeepalive()
+	case event.TCPConnectionFails, event.NotifMsg:
+		return p.fail()
+	case event.NotifMsgVerErr:
+		return p.Idle()
+	case event.BGPHeaderErr, event.BGPOpenMsgErr:
+		return p.notifyAndFail(p.rcvdErr.Code, p.rcvdErr.Subcode, p.rcvdErr.Data)
+	case event.OpenCollisionDump:
+		return p.notifyAndFail(message.Cease, message.ConnectionCollisionResolution, nil)
+	case event.KeepAliveMsg:
+		p.holdTimer.start(p, p.holdTime)
+		p.evEnqueue(event.Established)
+		p.State = Established
+	case event.Established, event.LocRIBChanged,
+		event.AdjRIBOutChanged, event.AdjRIBInChanged,
+		event.ManualRouteRefresh:
+		// Idleに遷移する前に発行された独自のEventは無視する
+	default:
+		// 1つのTCP Connectionしか使用しないため、
+		// OpenConfirmでOPEN Messageを受信した場合もFSM Errorとする
+		return p.notifyAndFail(message.FSMError, fsmErrSubcode(ev, OpenConfirm), nil)
+	}
+	return nil
+}
+
+// RFC 4271 8.2.2 Established State
+func (p *Peer) handleEstablished(ctx context.Context, ev event.Event) error {
+	switch ev {
+	case event.ManualStart, event.AutomaticStart,
+		event.ManualStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithPassiveTCPEstablishment,
+		event.AutomaticStartWithDampPeerOscillations,
+		event.AutomaticStartWithDampPeerOscillationsAndPassiveTCPEstablishment,
+		event.TCPConnectionValid, event.TCPCRInvalid,
+		event.TCPCRAcked, event.TCPConnectionConfirmed:
+		// 2つ目のTCP Connectionは使用しないため無視する
+	case event.ManualStop, event.AutomaticStop:
+		return p.stop(ev)
+	case event.HoldTimerExpires:
+		return p.notifyAndFail(message.HoldTimerExpired, message.Unspecific, nil)
+	case event.KeepaliveTimerExpires:
+		return p.sendKeepalive()
+	case event.TCPConnectionFails, event.NotifMsg, event.NotifMsgVerErr:
+		return p.fail()
+	case event.KeepAliveMsg:
+		p.holdTimer.start(p, p.holdTime)
+	case event.UpdateMsg:
+		p.holdTimer.start(p, p.holdTime)
+		u, ok := p.rcvd.(*message.UpdateMessage)
+		if !ok {
+			return fmt.Errorf("UPDATE Messageを受信していません")
+		}
+		p.ribin.Update(u)
+		if p.checkMaxPrefix() {
+			return p.tearDownMaxPrefix()
+		}
+		if p.ribin.ContainChanged() {
+			log.Println("AdjRIB IN is Updated.")
+			p.evEnqueue(event.AdjRIBInChanged)
+		}
+	case event.UpdateMsgErr:
+		return p.notifyAndFail(p.rcvdErr.Code, p.rcvdErr.Subcode, p.rcvdErr.Data)
+	case event.Established:
+		// すべてのPrefixを同期するため、変更されたPrefixは不要になる
+		p.takePending()
+		p.ribout.Update(p.lrib, p.config, p.caps.Families()...)
+		if p.ribout.ContainChanged() {
+			p.evEnqueue(event.AdjRIBOutChanged)
+		}
+	case event.LocRIBChanged:
+		p.ribout.Sync(p.lrib, p.config, p.takePending(), p.caps.Families()...)
+		if p.ribout.ContainChanged() {
+			p.evEnqueue(event.AdjRIBOutChanged)
+		}
+	case event.AdjRIBOutChanged:
+		return p.sendAdjRIBOut(p.caps.Families()...)
+	case event.AdjRIBInChanged:
+		// LocRIBが変更された場合は、すべてのPeerでLocRIBChanged Eventが発生する
+		p.lrib.Update(p.ribin)
+		p.ribin.AllUnchanged()
+	case event.RouteRefreshMsg:
+		p.holdTimer.start(p, p.holdTime)
+		return p.recvRouteRefresh()
+	case event.ManualRouteRefresh:
+		return p.sendRouteRefresh()
+	default:
+		// 1つのTCP Connectionしか使用しないため、
+		// EstablishedでOPEN Messageを受信した場合もFSM Errorとする
+		return p.notifyAndFail(message.FSMError, fsmErrSubcode(ev, Established), nil)
+	}
+	return nil
+}
+
+// AdjRIBInのPrefix数をMaximum Prefixと比較し、セッションを切断する必要があるかを返す
+// 閾値を超えた場合、およびWarningOnlyでLimitを超えた場合は警告を出力する。
+func (p *Peer) checkMaxPrefix() bool {
+	mp, ok := p.config.MaxPrefix()
+	if !ok {
+		return false
+	}
+	n := uint64(p.ribin.PrefixCount())
+	limit := uint64(mp.Limit)
+	if n*100 < limit*uint64(mp.Threshold) {
+		p.maxPrefixWarned = false
+		p.maxPrefixExceeded = false
+		return false
+	}
+	if !p.maxPrefixWarned {
+		log.Printf("number of prefixes from %v reached %d%% of max prefix: %d/%d",
+			p.config.RemoteIP(), mp.Threshold, n, limit)
+		p.maxPrefixWarned = true
+	}
+	if n <= limit {
+		p.maxPrefixExceeded = false
+		return false
+	}
+	if !mp.WarningOnly {
+		return true
+	}
+	if !p.maxPrefixExceeded {
+		log.Printf("number of prefixes from %v exceeded max prefix: %d/%d",
+			p.config.RemoteIP(), n, limit)
+		p.maxPrefixExceeded = true
+	}
+	return false
+}
+
+// Maximum Prefixを超えたため、Ceaseを送信してセッションを切断する(RFC 4486)
+// RestartTimeが設定されている場合は、IdleHoldTimerを使用して指定した時間の後に再開する。
+func (p *Peer) tearDownMaxPrefix() error {
+	mp, _ := p.config.MaxPrefix()
+	log.Printf("number of prefixes from %v exceeded max prefix %d, tear down the session",
+		p.config.RemoteIP(), mp.Limit)
+	p.notify(message.Cease, message.MaximumNumberOfPrefixesReached, nil)
+	p.connectRetryCounter++
+	p.maxPrefixWarned = false
+	p.maxPrefixExceeded = false
+	if err := p.Idle(); err != nil {
+		return err
+	}
+	if mp.RestartTime > 0 {
+		p.idleHoldTimer.start(p, time.Duration(mp.RestartTime)*time.Minute)
+	}
+	return nil
+}
+
+// FSM ErrorのSubcodeを返す
+// Messageの受信によるものではない場合はUnspecificとする(RFC 6608)。
+func fsmErrSubcode(ev event.Event, s State) message.ErrorSubcode {
+	switch ev {
+	case event.BGPOpen, event.BGPOpenWithDelayOpenTimerRunning,
+		event.KeepAliveMsg, event.UpdateMsg, event.NotifMsg,
+		event.RouteRefreshMsg:
+	default:
+		return message.Unspecific
+	}
+	switch s {
+	case OpenSent:
+		return message.UnexpectedMessageInOpenSent
+	case OpenConfirm:
+		return message.UnexpectedMessageInOpenConfirm
 	case Established:
-		switch ev {
-		case event.Established, event.LocRIBChanged:
-			p.ribout.Update(p.lrib, p.config)
-			if p.ribout.ContainNew() {
-				p.evEnqueue(event.AdjRIBOutChanged)
-				p.ribout.AllUnchanged()
-			}
-		case event.AdjRIBOutChanged:
-			ums, err := p.ribout.ToUpdateMessage(
-				p.config.LocalIP(),
-				p.config.LocalAS(),
-			)
-			if err != nil {
-				return err
-			}
-			for _, u := range ums {
-				if p.conn == nil {
-					return fmt.Errorf("TCP Connectionが確立されていません")
-				}
-				send <- u
-			}
-		case event.UpdateMsg:
-			u := <-p.msgQueue
-			switch u := u.(type) {
-			case *message.UpdateMessage:
-				p.ribin.Update(u)
-				if p.ribin.ContainNew() {
-					log.Println("AdjRIB IN is Updated.")
-					p.evEnqueue(event.AdjRIBInChanged)
-					p.ribin.AllUnchanged()
-				}
-			}
-		case event.AdjRIBInChanged:
-			p.lrib.Update(p.ribin)
-			if p.lrib.ContainNew() {
-				p.lrib.WriteRT()
-				p.evEnqueue(event.LocRIBChanged)
-				p.lrib.AllUnchanged()
-			}
+		return message.UnexpectedMessageInEstablished
+	}
+	return message.Unspecific
+}
+
+// TCP Connectionを閉じる
+// Stateは変更しない。
+func (p *Peer) dropTCP() {
+	if p.cancelConn != nil {
+		p.cancelConn()
+		p.cancelConn = nil
+		p.connCtx = nil
+	}
+	if p.conn != nil {
+		if err := p.conn.Close(); err != nil {
+			log.Printf("failed to close connection: %v", err)
 		}
+		p.conn = nil
+	}
+}
+
+func (p *Peer) connectRetryTime() time.Duration {
+	return time.Duration(p.config.ConnectRetryTime()) * time.Second
+}
+
+func (p *Peer) delayOpenTime() time.Duration {
+	return time.Duration(p.config.DelayOpenTime()) * time.Second
+}
+
+// OPEN Messageを送信し、OpenSentに遷移する
+func (p *Peer) sendOpen() error {
+	if p.conn == nil {
+		return fmt.Errorf("TCP Conectionが確立されていません")
 	}
+	om, err := message.NewOpenMsg(
+		p.config.LocalAS(),
+		p.config.RouterID(),
+		p.config.HoldTime(),
+		p.config.Capabilities(),
+	)
+	if err != nil {
+		return err
+	}
+	p.send <- om
+	// OPEN Messageを受信するまでは、Hold Timerに大きな値を設定する
+	if p.config.HoldTime() != 0 {
+		p.holdTimer.start(p, largeHoldTime)
+	}
+	p.State = OpenSent
 	return nil
 }
 
-func (p *Peer) handleMessage(m message.Message) error {
-	switch m.(type) {
+// 受信したOPEN MessageからHold Timeをネゴシエーションし、KEEPALIVE Messageを送信する
+func (p *Peer) recvOpen() error {
+	if p.conn == nil {
+		return fmt.Errorf("TCP Connectionが確立されていません")
+	}
+	om, ok := p.rcvd.(*message.OpenMessage)
+	if !ok {
+		return fmt.Errorf("OPEN Messageを受信していません")
+	}
+	p.holdTime, p.keepaliveTime = negotiateHoldTime(
+		p.config.HoldTime(), om.HoldTime(),
+	)
+	log.Printf("negotiated hold time: %v, keepalive time: %v",
+		p.holdTime, p.keepaliveTime)
+	p.caps = capability.Negotiate(p.config.Capabilities(), om.Capabilities())
+	log.Printf("negotiated capabilities: %v", p.caps)
+	// ベストパスの選択に使用するため、対向機器のBGP Identifierを保持する
+	// Established以前のため、AdjRIBInは空である。
+	p.ribin = rib.NewAdjRIBIn(newSource(p.config, om.BGPID()))
+	// OPEN Messageの次に受信するMessageから、ネゴシエーションした方法で変換する
+	p.conn.fourOctetAS.Store(p.caps.Has(capability.FourOctetAS))
+	p.conn.extendedMessage.Store(p.caps.Has(capability.ExtendedMessage))
+	if err := p.sendKeepalive(); err != nil {
+		return err
+	}
+	p.holdTimer.start(p, p.holdTime)
+	return nil
+}
+
+// DelayOpenTimerの動作中にOPEN Messageを受信した場合、
+// OPEN Message, KEEPALIVE Messageを送信してOpenConfirmに遷移する
+func (p *Peer) recvOpenWithDelayOpen() error {
+	p.connectRetryTimer.stop()
+	p.delayOpenTimer.stop()
+	if err := p.sendOpen(); err != nil {
+		return err
+	}
+	if err := p.recvOpen(); err != nil {
+		return err
+	}
+	p.State = OpenConfirm
+	return nil
+}
+
+// 受信したMessageに対応するEventを処理する
+func (p *Peer) handleMessage(ctx context.Context, m message.Message) error {
+	p.rcvd = m
+	defer func() { p.rcvd = nil }()
+	switch m := m.(type) {
 	case *message.OpenMessage:
-		p.evEnqueue(event.BGPOpen)
+		if err := p.checkOpen(m); err != nil {
+			return p.handleError(ctx, err)
+		}
+		if p.delayOpenTimer.running() {
+			return p.handleEvent(ctx, event.BGPOpenWithDelayOpenTimerRunning)
+		}
+		return p.handleEvent(ctx, event.BGPOpen)
 	case *message.KeepaliveMessage:
-		p.evEnqueue(event.KeepAliveMsg)
+		return p.handleEvent(ctx, event.KeepAliveMsg)
 	case *message.UpdateMessage:
-		p.msgEnqueue(m)
-		p.evEnqueue(event.UpdateMsg)
+		return p.handleEvent(ctx, event.UpdateMsg)
+	case *message.RouteRefreshMessage:
+		return p.handleEvent(ctx, event.RouteRefreshMsg)
+	case *message.NotificationMessage:
+		// NOTIFICATION Messageを受信した場合、対向機器はすでにセッションを閉じている。
+		log.Printf("notification message is received: %v", m)
+		if m.ErrorCode() == message.OpenMessageError &&
+			m.ErrorSubcode() == message.UnsupportedVersionNumber {
+			return p.handleEvent(ctx, event.NotifMsgVerErr)
+		}
+		return p.handleEvent(ctx, event.NotifMsg)
+	}
+	return nil
+}
+
+// OPEN Messageの内容がConfigと一致しているかを確認する
+func (p *Peer) checkOpen(om *message.OpenMessage) error {
+	// 4-octet AS Number Capabilityを広告している場合は、
+	// My Autonomous SystemではなくCapabilityのAS番号を使用する(RFC 6793)。
+	caps := capability.Negotiate(p.config.Capabilities(), om.Capabilities())
+	remoteAS := om.MyAS()
+	if c, ok := caps.Get(capability.FourOctetAS); ok {
+		remoteAS = c.(capability.FourOctetASCap).AS()
+	}
+	if remoteAS != p.config.RemoteAS() {
+		as := om.MyAS().Uint16()
+		return message.NewConvMsgErr(
+			message.OpenMessageError, message.BadPeerAS,
+			[]byte{uint8(as >> 8), uint8(as)},
+			fmt.Sprintf("Peer ASが一致しません: %v", remoteAS),
+		)
+	}
+	// 必須のCapabilityを対向機器が広告していない場合は、
+	// 不足しているCapabilityをDataとして通知する(RFC 5492 5章)。
+	missing := caps.Missing(p.config.Capabilities(), p.config.RequiredCapabilities())
+	if len(missing) > 0 {
+		var data []byte
+		for _, c := range missing {
+			b, err := capability.MarshalBytes(c)
+			if err != nil {
+				return err
+			}
+			data = append(data, b...)
+		}
+		return message.NewConvMsgErr(
+			message.OpenMessageError, message.UnsupportedCapability, data,
+			fmt.Sprintf("必須のCapabilityが広告されていません: %v", missing),
+		)
+	}
+	return nil
+}
+
+// AdjRIBOutのAFI/SAFI(fs)のルートからUPDATE Messageを生成して送信する
+// NEXT_HOPが設定されていないAFIのルートは送信しない。
+// 送信した後、取り下げたルートはAdjRIBOutから削除する。
+func (p *Peer) sendAdjRIBOut(fs ...bgp.Family) error {
+	var ums []*message.UpdateMessage
+	maxLen := message.MaxMsgLen
+	if p.conn != nil {
+		maxLen = p.conn.maxMsgLen()
+	}
+	for _, f := range fs {
+		if p.config.NextHop(f.AFI) == nil {
+			log.Printf("next hop is not configured, skip: %v", f)
+			p.ribout.AllUnchangedOf(f)
+			continue
+		}
+		u, err := p.ribout.ToUpdateMessage(f, p.config, rib.UpdateOptions{
+			FourOctetAS: p.caps.Has(capability.FourOctetAS),
+			MaxMsgLen:   maxLen,
+		})
+		if err != nil {
+			return err
+		}
+		ums = append(ums, u...)
+		p.ribout.AllUnchangedOf(f)
+	}
+	for _, u := range ums {
+		if p.conn == nil {
+			return fmt.Errorf("TCP Connectionが確立されていません")
+		}
+		p.send <- u
+	}
+	// UPDATE Messageを送信した場合もKeepalive Timerを再開する
+	if len(ums) > 0 {
+		p.keepaliveTimer.start(p, p.keepaliveTime)
+	}
+	return nil
+}
+
+// 受信したROUTE-REFRESH Messageを処理する
+// ネゴシエーションしていないAFI/SAFIは無視する。
+func (p *Peer) recvRouteRefresh() error {
+	rr, ok := p.rcvd.(*message.RouteRefreshMessage)
+	if !ok {
+		return fmt.Errorf("ROUTE-REFRESH Messageを受信していません")
+	}
+	if !p.caps.Has(capability.RouteRefresh) {
+		log.Printf("route refresh is not negotiated, ignore: %v", rr)
+		return nil
+	}
+	f := bgp.Family{AFI: rr.AFI(), SAFI: rr.SAFI()}
+	if !slices.Contains(p.caps.Families(), f) {
+		log.Printf("unsupported AFI/SAFI, ignore: %v", rr)
+		return nil
+	}
+	switch rr.Subtype() {
+	case message.NormalRequest:
+		return p.refreshAdjRIBOut(f)
+	case message.BoRR:
+		// 再送されなかったエントリをEoRRの受信時に削除する
+		p.ribin.MarkStale(f)
+	case message.EoRR:
+		purged := p.ribin.PurgeStale(f)
+		log.Printf("stale routes are purged: %v", purged)
+		if len(purged) > 0 {
+			p.evEnqueue(event.AdjRIBInChanged)
+		}
+	default:
+		// 未知のSubtypeは無視する(RFC 7313 5章)
+		log.Printf("unknown route refresh subtype, ignore: %v", rr)
+	}
+	return nil
+}
+
+// AdjRIBOutを更新して、AFI/SAFI(f)のルートを対向機器に再送する
+// Enhanced Route Refreshをネゴシエーションしている場合は、BoRRとEoRRで挟む。
+func (p *Peer) refreshAdjRIBOut(f bgp.Family) error {
+	p.ribout.Update(p.lrib, p.config, f)
+	p.ribout.Readvertise(f)
+	enhanced := p.caps.Has(capability.EnhancedRouteRefresh)
+	if enhanced {
+		if err := p.sendRouteRefreshMsg(f, message.BoRR); err != nil {
+			return err
+		}
 	}
+	if err := p.sendAdjRIBOut(f); err != nil {
+		return err
+	}
+	if enhanced {
+		return p.sendRouteRefreshMsg(f, message.EoRR)
+	}
+	return nil
+}
+
+// 対向機器に、ネゴシエーションしたすべてのAFI/SAFIのAdjRIBOutの再送を要求する
+func (p *Peer) sendRouteRefresh() error {
+	if !p.caps.Has(capability.RouteRefresh) {
+		log.Println("route refresh is not negotiated.")
+		return nil
+	}
+	for _, f := range p.caps.Families() {
+		if err := p.sendRouteRefreshMsg(f, message.NormalRequest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Peer) sendRouteRefreshMsg(f bgp.Family, st message.RouteRefreshSubtype) error {
+	if p.conn == nil {
+		return fmt.Errorf("TCP Connectionが確立されていません")
+	}
+	rr, err := message.NewRouteRefreshMsg(f.AFI, f.SAFI, st)
+	if err != nil {
+		return err
+	}
+	p.send <- rr
 	return nil
 }
+
+// KEEPALIVE Messageを送信し、Keepalive Timerを再開する
+func (p *Peer) sendKeepalive() error {
+	if p.conn == nil {
+		return fmt.Errorf("TCP Connectionが確立されていません")
+	}
+	km, err := message.NewKeepaliveMsg()
+	if err != nil {
+		return err
+	}
+	p.send <- km
+	p.keepaliveTimer.start(p, p.keepaliveTime)
+	return nil
+}
+
+// 送受信で発生したエラーに対応するEventを処理する
+// Messageの変換に失敗した場合は、Error Codeに応じたEventとし、
+// それ以外の場合はTCP Connectionの失敗とする。
+func (p *Peer) handleError(ctx context.Context, e error) error {
+	var cme message.ConvMsgErr
+	if !errors.As(e, &cme) {
+		return p.handleEvent(ctx, event.TCPConnectionFails)
+	}
+	p.rcvdErr = cme
+	switch cme.Code {
+	case message.MessageHeaderError:
+		return p.handleEvent(ctx, event.BGPHeaderErr)
+	case message.OpenMessageError:
+		return p.handleEvent(ctx, event.BGPOpenMsgErr)
+	default:
+		// UPDATE Message Error, ROUTE-REFRESH Message Errorの場合
+		return p.handleEvent(ctx, event.UpdateMsgErr)
+	}
+}
+
+// 対向機器にNOTIFICATION Messageを送信する
+// 送信用のgoroutineを経由するとTCP Connectionを閉じる前に
+// 送信できない可能性があるため、直接送信する。
+func (p *Peer) notify(
+	code message.ErrorCode,
+	subcode message.ErrorSubcode,
+	data []byte,
+) {
+	if p.conn == nil {
+		return
+	}
+	n, err := message.NewNotificationMsg(code, subcode, data)
+	if err != nil {
+		log.Printf("failed to create notification message: %v", err)
+		return
+	}
+	if err := p.conn.writeMsg(n); err != nil {
+		log.Printf("failed to send notification message: %v", err)
+	}
+}
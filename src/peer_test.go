@@ -2,13 +2,21 @@ package peer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/SotaUeda/usbgp/config"
+	"github.com/SotaUeda/usbgp/internal/bgp"
+	"github.com/SotaUeda/usbgp/internal/event"
+	"github.com/SotaUeda/usbgp/internal/ip"
+	"github.com/SotaUeda/usbgp/internal/message"
+	"github.com/SotaUeda/usbgp/internal/message/capability"
+	"github.com/SotaUeda/usbgp/internal/message/pathattribute"
 	"github.com/SotaUeda/usbgp/internal/rib"
 )
 
@@ -151,3 +159,299 @@ func TestTransitionToEstablishedState(t *testing.T) {
 		t.Fatalf("Timeout. Local Peer State: %v, Remote Peer State: %v", ls, rs)
 	}
 }
+
+func TestUnexpectedEventMovesToIdle(t *testing.T) {
+	cfg, err := config.New(64512, "127.0.0.1", 65413, "127.0.0.2", config.Active, nil,
+		config.WithIdleHoldTime(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		state State
+		ev    event.Event
+		want  State
+	}{
+		{name: "update in connect", state: Connect, ev: event.UpdateMsg, want: Idle},
+		{name: "keepalive in active", state: Active, ev: event.KeepAliveMsg, want: Idle},
+		{name: "update in open sent", state: OpenSent, ev: event.UpdateMsg, want: Idle},
+		{name: "open in open confirm", state: OpenConfirm, ev: event.BGPOpen, want: Idle},
+		{name: "open in established", state: Established, ev: event.BGPOpen, want: Idle},
+		{name: "tcp fails in open sent", state: OpenSent, ev: event.TCPConnectionFails, want: Active},
+		{name: "manual stop in established", state: Established, ev: event.ManualStop, want: Idle},
+		{name: "invalid connection in connect", state: Connect, ev: event.TCPCRInvalid, want: Connect},
+		{name: "update in idle", state: Idle, ev: event.UpdateMsg, want: Idle},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			p := New(cfg, nil)
+			p.State = tc.state
+			if err := p.handleEvent(ctx, tc.ev); err != nil {
+				t.Fatal(err)
+			}
+			if p.State != tc.want {
+				t.Errorf("%s: want %v, got %v", tc.name, tc.want, p.State)
+			}
+			p.Idle()
+		})
+	}
+}
+
+func TestCheckOpen(t *testing.T) {
+	remoteAS := bgp.ASNumber(4200000001)
+	cfg, err := config.New(64512, "127.0.0.1", remoteAS, "127.0.0.2", config.Active, nil,
+		config.WithRequiredCapabilities(capability.EnhancedRouteRefresh))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		as      bgp.ASNumber
+		caps    []capability.Capability
+		subcode message.ErrorSubcode
+	}{
+		{
+			name: "4-octet AS",
+			as:   bgp.ASTrans,
+			caps: []capability.Capability{
+				capability.EnhancedRouteRefreshCap{},
+				capability.NewFourOctetAS(remoteAS),
+			},
+		},
+		{
+			name: "bad peer AS",
+			as:   bgp.ASTrans,
+			caps: []capability.Capability{
+				capability.EnhancedRouteRefreshCap{},
+				capability.NewFourOctetAS(4200000002),
+			},
+			subcode: message.BadPeerAS,
+		},
+		{
+			name: "unsupported capability",
+			as:   bgp.ASTrans,
+			caps: []capability.Capability{
+				capability.RouteRefreshCap{},
+				capability.NewFourOctetAS(remoteAS),
+			},
+			subcode: message.UnsupportedCapability,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			om, err := message.NewOpenMsg(tc.as, net.ParseIP("127.0.0.2"), 90, tc.caps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := New(cfg, nil)
+			err = p.checkOpen(om)
+			if tc.subcode == message.Unspecific {
+				if err != nil {
+					t.Errorf("%s: want nil, got %v", tc.name, err)
+				}
+				return
+			}
+			var cme message.ConvMsgErr
+			if !errors.As(err, &cme) || cme.Subcode != tc.subcode {
+				t.Errorf("%s: want subcode %d, got %v", tc.name, tc.subcode, err)
+			}
+		})
+	}
+}
+
+// 受信したPrefix数がMaximum Prefixを超えた場合は、セッションを切断する
+// WarningOnlyの場合はセッションを維持し、RestartTimeが設定されている場合は再開する
+func TestMaxPrefix(t *testing.T) {
+	ap, err := pathattribute.NewASPath(pathattribute.ASSegTypeSequence, []bgp.ASNumber{65413})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pas := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		ap,
+		pathattribute.NextHop(net.ParseIP("127.0.0.2").To4()),
+	}
+	var nlri []*ip.IPv4Net
+	for _, s := range []string{"10.100.1.0/24", "10.100.2.0/24", "10.100.3.0/24"} {
+		_, nw, _ := net.ParseCIDR(s)
+		n, err := ip.NewIPv4Net(nw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nlri = append(nlri, n)
+	}
+	um, err := message.NewUpdateMsg(pas, nlri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		mp      config.MaxPrefix
+		want    State
+		warned  bool
+		restart bool
+	}{
+		{name: "under threshold", mp: config.MaxPrefix{Limit: 10}, want: Established},
+		{name: "over threshold", mp: config.MaxPrefix{Limit: 3}, want: Established, warned: true},
+		{name: "warning only", mp: config.MaxPrefix{Limit: 2, WarningOnly: true}, want: Established, warned: true},
+		{name: "tear down", mp: config.MaxPrefix{Limit: 2}, want: Idle},
+		{name: "tear down and restart", mp: config.MaxPrefix{Limit: 2, RestartTime: 1}, want: Idle, restart: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := config.New(64512, "127.0.0.1", 65413, "127.0.0.2", config.Active, nil,
+				config.WithMaxPrefix(tc.mp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			p := New(cfg, nil)
+			p.State = Established
+			p.rcvd = um
+			if err := p.handleEvent(ctx, event.UpdateMsg); err != nil {
+				t.Fatal(err)
+			}
+			if p.State != tc.want || p.maxPrefixWarned != tc.warned {
+				t.Errorf("%s: want %v (warned: %v), got %v (warned: %v)",
+					tc.name, tc.want, tc.warned, p.State, p.maxPrefixWarned)
+			}
+			if p.idleHoldTimer.running() != tc.restart {
+				t.Errorf("%s: idle hold timer running = %v, want %v",
+					tc.name, p.idleHoldTimer.running(), tc.restart)
+			}
+			p.Idle()
+		})
+	}
+}
+
+func TestTCPMD5Signature(t *testing.T) {
+	// 同じパスワードを設定したPeer同士は、Established Stateに遷移する
+	acfg, err := config.New(64512, "127.0.0.3", 65413, "127.0.0.4", config.Active, nil,
+		config.WithPassword("usbgp-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcfg, err := config.New(65413, "127.0.0.4", 64512, "127.0.0.3", config.Passive, nil,
+		config.WithPassword("usbgp-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t_ctx, t_cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer t_cancel()
+	t_wg := sync.WaitGroup{}
+	errCh := make(chan error, 2)
+	run := func(p *Peer) {
+		defer t_wg.Done()
+		for p.State != Established {
+			select {
+			case <-t_ctx.Done():
+				errCh <- fmt.Errorf("timeout. %v peer state: %v", p.config.Mode(), p.State)
+				return
+			default:
+			}
+			wg.Add(1)
+			if err := p.Next(t_ctx, &wg); err != nil {
+				errCh <- err
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	plr, err := rib.NewLocRIB(pcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pp := New(pcfg, plr)
+	pp.Start()
+	defer pp.Idle()
+	t_wg.Add(1)
+	go run(pp)
+	time.Sleep(1 * time.Second) // passive peerが待ち受けるよう、1秒待つ
+	alr, err := rib.NewLocRIB(acfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap := New(acfg, alr)
+	ap.Start()
+	defer ap.Idle()
+	t_wg.Add(1)
+	go run(ap)
+	t_wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+
+	// パスワードが異なる場合は、TCP Connectionを確立できない
+	lc := &net.ListenConfig{Control: md5Control(net.ParseIP("127.0.0.3"), "usbgp-secret")}
+	l, err := lc.Listen(context.Background(), "tcp", "127.0.0.4:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.3")},
+		Timeout:   1 * time.Second,
+		Control:   md5Control(net.ParseIP("127.0.0.4"), "wrong-secret"),
+	}
+	if c, err := d.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Errorf("want dial error with mismatched password, got nil")
+	}
+}
+
+func TestSendAfterConnectionClosed(t *testing.T) {
+	// 送信中にTCP Connectionが閉じられても、状態遷移が停止しないことを確認する
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.New(64512, "127.0.0.1", 65413, "127.0.0.2", config.Active, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(cfg, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newConnection(tc.(*net.TCPConn))
+	c.sendMsg(ctx, p.send, p.ech)
+	// 送信に失敗させるため、先にTCP Connectionを閉じる
+	c.Close()
+
+	pas := []pathattribute.PathAttribute{
+		pathattribute.Igp,
+		pathattribute.ASPath{},
+		pathattribute.NextHop(net.ParseIP("127.0.0.1").To4()),
+	}
+	um, err := message.NewUpdateMsg(pas, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		// sendAdjRIBOutと同様に、続けてUPDATE Messageを送信する
+		for range 10 {
+			p.send <- um
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending update messages is blocked")
+	}
+	select {
+	case err := <-p.ech:
+		log.Printf("send error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("send error is not notified")
+	}
+}
@@ -10,14 +10,15 @@ func _() {
 	var x [1]struct{}
 	_ = x[Idle-0]
 	_ = x[Connect-1]
-	_ = x[OpenSent-2]
-	_ = x[OpenConfirm-3]
-	_ = x[Established-4]
+	_ = x[Active-2]
+	_ = x[OpenSent-3]
+	_ = x[OpenConfirm-4]
+	_ = x[Established-5]
 }
 
-const _State_name = "IdleConnectOpenSentOpenConfirmEstablished"
+const _State_name = "IdleConnectActiveOpenSentOpenConfirmEstablished"
 
-var _State_index = [...]uint8{0, 4, 11, 19, 30, 41}
+var _State_index = [...]uint8{0, 4, 11, 17, 25, 36, 47}
 
 func (i State) String() string {
 	if i < 0 || i >= State(len(_State_index)-1) {
@@ -0,0 +1,56 @@
+package peer
+
+import (
+	"time"
+
+	"github.com/SotaUeda/usbgp/internal/event"
+)
+
+// OpenSent Stateで使用するHold Timerの値
+// RFC 4271 8.2.2では、4分が推奨されている。
+var largeHoldTime = 4 * time.Minute
+
+// RFC 4271 8章で定義されているタイマー
+// 満了したときに、対応するEventをPeerのEvent Queueに追加する。
+type timer struct {
+	t  *time.Timer
+	ev event.Event
+}
+
+// タイマーを開始する
+// すでに開始されている場合は、dの時間で再開する。
+// dが0の場合は停止する。
+func (t *timer) start(p *Peer, d time.Duration) {
+	t.stop()
+	if d == 0 {
+		return
+	}
+	t.t = time.AfterFunc(d, func() { p.evEnqueue(t.ev) })
+}
+
+func (t *timer) stop() {
+	if t.t != nil {
+		t.t.Stop()
+		t.t = nil
+	}
+}
+
+// タイマーが動作中であるかを返す
+// 満了した後、Eventが処理されるまでは動作中とみなす。
+func (t *timer) running() bool {
+	return t.t != nil
+}
+
+// 満了したEventを処理する際に呼び出し、タイマーを停止済みにする
+func (t *timer) expire() {
+	t.t = nil
+}
+
+// ネゴシエーションしたHold TimeとKeepalive Timerの間隔を返す
+// Hold Timeは自身と対向機器が送信したOPEN Messageのうち、小さい値を使用する。
+// Keepaliveの間隔はHold Timeの1/3とする。
+func negotiateHoldTime(local, remote uint16) (hold, keepalive time.Duration) {
+	ht := min(local, remote)
+	hold = time.Duration(ht) * time.Second
+	return hold, hold / 3
+}
@@ -0,0 +1,27 @@
+package peer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegotiateHoldTime(t *testing.T) {
+	tests := []struct {
+		name          string
+		local, remote uint16
+		hold, ka      time.Duration
+	}{
+		{name: "same", local: 90, remote: 90, hold: 90 * time.Second, ka: 30 * time.Second},
+		{name: "remote is smaller", local: 90, remote: 30, hold: 30 * time.Second, ka: 10 * time.Second},
+		{name: "local is smaller", local: 9, remote: 180, hold: 9 * time.Second, ka: 3 * time.Second},
+		{name: "disabled", local: 90, remote: 0, hold: 0, ka: 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hold, ka := negotiateHoldTime(tc.local, tc.remote)
+			if hold != tc.hold || ka != tc.ka {
+				t.Errorf("%s: want %v/%v, got %v/%v", tc.name, tc.hold, tc.ka, hold, ka)
+			}
+		})
+	}
+}